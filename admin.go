@@ -0,0 +1,400 @@
+package permission
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+const adminRealm = "Permission Admin"
+
+var errNotFound = errors.New("not found")
+
+// AdminAPI serves an HTTP API to manage the users, groups and rules of writable backends.
+// It is protected by its own credentials and is not subject to the rules.
+type AdminAPI struct {
+	Path string
+	// Users maps usernames to passwords.
+	Users map[string]string
+	// Allow restricts access to these networks, if not empty.
+	Allow []*net.IPNet
+}
+
+// adminUser is a user in requests to and responses of the admin API.
+type adminUser struct {
+	PolicyUser
+	// Password sets a new password.
+	Password string `json:",omitempty"`
+	// TTL sets ValidUntil relative to now, in seconds.
+	TTL int64 `json:",omitempty"`
+	// HasPassword is set in responses, as password hashes are not returned.
+	HasPassword bool
+}
+
+// adminError is returned by the admin API on errors.
+type adminError struct {
+	Error string
+}
+
+// redactUser prepares a user for a response.
+func redactUser(user *PolicyUser) *adminUser {
+	redacted := &adminUser{
+		PolicyUser:  *user,
+		HasPassword: user.PasswordHash != "",
+	}
+	redacted.PasswordHash = ""
+	return redacted
+}
+
+// redactPolicy prepares a policy for a response.
+func redactPolicy(policy *Policy) map[string]interface{} {
+	users := make(map[string]*adminUser)
+	for name, user := range policy.Users {
+		users[name] = redactUser(user)
+	}
+	return map[string]interface{}{
+		"Users":   users,
+		"Groups":  policy.Groups,
+		"Default": policy.Default,
+		"Public":  policy.Public,
+	}
+}
+
+// ServeHTTP serves the admin API for the writable backends and ends sessions of users.
+func (admin *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request, handler *Handler) (int, error) {
+	if !admin.allowed(r) {
+		return adminErrorf(w, http.StatusForbidden, "access denied")
+	}
+	adminUsername, ok := admin.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\""+adminRealm+"\"")
+		return adminErrorf(w, http.StatusUnauthorized, "authentication required")
+	}
+
+	backends := handler.Backends
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, admin.Path), "/"), "/")
+	if segments[0] == "" {
+		if r.Method != "GET" {
+			return adminErrorf(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		}
+		return writeJSON(w, http.StatusOK, writableNames(backends))
+	}
+
+	// log users out everywhere
+	if segments[0] == "sessions" && len(segments) == 2 && segments[1] != "" {
+		if r.Method != "DELETE" {
+			return adminErrorf(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		}
+		err := handler.RevokeUser(r.Context(), segments[1])
+		if err != nil {
+			return adminErrorf(w, http.StatusBadGateway, "%s", err)
+		}
+		if printError || printDebug {
+			fmt.Printf("[permission] admin %s: logged out %s everywhere\n", adminUsername, segments[1])
+		}
+		return writeJSON(w, http.StatusOK, struct{}{})
+	}
+
+	// find writable backend
+	var writable Writable
+	for _, backend := range backends {
+		if backend.Name() == segments[0] {
+			writable, _ = unwrapBackend(backend).(Writable)
+			break
+		}
+	}
+	if writable == nil {
+		return adminErrorf(w, http.StatusNotFound, "no writable backend %s", segments[0])
+	}
+
+	status, response, err := admin.handle(r, writable, segments[1:])
+	if err != nil {
+		return adminErrorf(w, status, "%s", err)
+	}
+	if r.Method != "GET" && (printError || printDebug) {
+		fmt.Printf("[permission] admin %s: %s %s\n", adminUsername, r.Method, r.URL.Path)
+	}
+	return writeJSON(w, status, response)
+}
+
+// handle handles a request for a writable backend and returns the status and response.
+func (admin *AdminAPI) handle(r *http.Request, writable Writable, segments []string) (int, interface{}, error) {
+	switch {
+	case len(segments) == 0:
+		if r.Method != "GET" {
+			return http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method)
+		}
+		return http.StatusOK, redactPolicy(writable.Policy()), nil
+
+	case segments[0] == "users" && len(segments) == 1:
+		if r.Method != "GET" {
+			return http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method)
+		}
+		return http.StatusOK, redactPolicy(writable.Policy())["Users"], nil
+
+	case segments[0] == "users" && len(segments) == 2:
+		return admin.handleUser(r, writable, segments[1])
+
+	case segments[0] == "groups" && len(segments) == 1:
+		if r.Method != "GET" {
+			return http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method)
+		}
+		groups := writable.Policy().Groups
+		if groups == nil {
+			groups = make(map[string]*PolicyRules)
+		}
+		return http.StatusOK, groups, nil
+
+	case segments[0] == "groups" && len(segments) == 2:
+		name := segments[1]
+		return admin.handleRules(r, writable, "group "+name, func(policy *Policy) *PolicyRules {
+			return policy.Groups[name]
+		}, func(policy *Policy, rules *PolicyRules) error {
+			if rules != nil {
+				if policy.Groups == nil {
+					policy.Groups = make(map[string]*PolicyRules)
+				}
+				policy.Groups[name] = rules
+				return nil
+			}
+			for username, user := range policy.Users {
+				for _, group := range user.Groups {
+					if group == name {
+						return fmt.Errorf("group %s is still used by user %s", name, username)
+					}
+				}
+			}
+			delete(policy.Groups, name)
+			return nil
+		})
+
+	case (segments[0] == DefaultIdentifier || segments[0] == PublicIdentifier) && len(segments) == 1:
+		public := segments[0] == PublicIdentifier
+		return admin.handleRules(r, writable, segments[0]+" permit", func(policy *Policy) *PolicyRules {
+			if public {
+				return policy.Public
+			}
+			return policy.Default
+		}, func(policy *Policy, rules *PolicyRules) error {
+			if public {
+				policy.Public = rules
+			} else {
+				policy.Default = rules
+			}
+			return nil
+		})
+	}
+
+	return http.StatusNotFound, nil, errNotFound
+}
+
+// handleUser gets, sets or deletes a user.
+func (admin *AdminAPI) handleUser(r *http.Request, writable Writable, name string) (int, interface{}, error) {
+	switch r.Method {
+	case "GET":
+		user, ok := writable.Policy().Users[name]
+		if !ok {
+			return http.StatusNotFound, nil, fmt.Errorf("no user %s", name)
+		}
+		return http.StatusOK, redactUser(user), nil
+
+	case "PUT":
+		request := &adminUser{}
+		err := json.NewDecoder(r.Body).Decode(request)
+		if err != nil {
+			return http.StatusBadRequest, nil, fmt.Errorf("invalid user: %s", err)
+		}
+		user := &request.PolicyUser
+		if request.Password != "" {
+			err = user.SetPassword(request.Password)
+			if err != nil {
+				return http.StatusInternalServerError, nil, err
+			}
+		}
+		if request.TTL > 0 {
+			user.ValidUntil = time.Now().Unix() + request.TTL
+		}
+
+		err = writable.UpdatePolicy(func(policy *Policy) error {
+			if policy.Users == nil {
+				policy.Users = make(map[string]*PolicyUser)
+			}
+			// keep the password, if no new one is given
+			if existing, ok := policy.Users[name]; ok && user.PasswordHash == "" {
+				user.PasswordHash = existing.PasswordHash
+			}
+			policy.Users[name] = user
+			return nil
+		})
+		if err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		return http.StatusOK, redactUser(user), nil
+
+	case "DELETE":
+		err := writable.UpdatePolicy(func(policy *Policy) error {
+			if _, ok := policy.Users[name]; !ok {
+				return errNotFound
+			}
+			delete(policy.Users, name)
+			return nil
+		})
+		if err == errNotFound {
+			return http.StatusNotFound, nil, fmt.Errorf("no user %s", name)
+		}
+		if err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		return http.StatusOK, struct{}{}, nil
+	}
+
+	return http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method)
+}
+
+// handleRules gets, sets or deletes rules. get returns the rules from the policy, set sets them or deletes them, if nil.
+func (admin *AdminAPI) handleRules(r *http.Request, writable Writable, what string, get func(policy *Policy) *PolicyRules, set func(policy *Policy, rules *PolicyRules) error) (int, interface{}, error) {
+	switch r.Method {
+	case "GET":
+		rules := get(writable.Policy())
+		if rules == nil {
+			return http.StatusNotFound, nil, fmt.Errorf("no %s", what)
+		}
+		return http.StatusOK, rules, nil
+
+	case "PUT":
+		rules := &PolicyRules{}
+		err := json.NewDecoder(r.Body).Decode(rules)
+		if err != nil {
+			return http.StatusBadRequest, nil, fmt.Errorf("invalid rules: %s", err)
+		}
+		err = writable.UpdatePolicy(func(policy *Policy) error {
+			return set(policy, rules)
+		})
+		if err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		return http.StatusOK, rules, nil
+
+	case "DELETE":
+		err := writable.UpdatePolicy(func(policy *Policy) error {
+			if get(policy) == nil {
+				return errNotFound
+			}
+			return set(policy, nil)
+		})
+		if err == errNotFound {
+			return http.StatusNotFound, nil, fmt.Errorf("no %s", what)
+		}
+		if err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		return http.StatusOK, struct{}{}, nil
+	}
+
+	return http.StatusMethodNotAllowed, nil, fmt.Errorf("method %s not allowed", r.Method)
+}
+
+// allowed checks whether the client is in an allowed network.
+func (admin *AdminAPI) allowed(r *http.Request) bool {
+	if len(admin.Allow) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range admin.Allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the admin credentials of the request.
+func (admin *AdminAPI) authenticate(r *http.Request) (string, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, ok := admin.Users[username]
+	if !ok {
+		return "", false
+	}
+	return username, subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+// adminErrorf writes an error response.
+func adminErrorf(w http.ResponseWriter, status int, format string, args ...interface{}) (int, error) {
+	return writeJSON(w, status, &adminError{Error: fmt.Sprintf(format, args...)})
+}
+
+// NewAdminAPI creates a new AdminAPI from configuration.
+func NewAdminAPI(c *caddy.Controller) (*AdminAPI, error) {
+	new := &AdminAPI{
+		Users: make(map[string]string),
+	}
+
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	new.Path = strings.TrimRight(c.Val(), "/")
+	if !strings.HasPrefix(new.Path, "/") {
+		return nil, c.Errf("permission > admin: path must start with / and must not be the root, got \"%s\"", c.Val())
+	}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "user":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			new.Users[args[0]] = args[1]
+		case "allow":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, arg := range args {
+				_, network, err := net.ParseCIDR(arg)
+				if err != nil {
+					return nil, c.Errf("permission > admin > allow: invalid network \"%s\": %s", arg, err)
+				}
+				new.Allow = append(new.Allow, network)
+			}
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	if len(new.Users) == 0 {
+		return nil, c.Errf("permission > admin needs at least one user")
+	}
+
+	return new, nil
+}
+
+// writableNames returns the sorted names of all writable backends.
+func writableNames(backends []BackendV2) []string {
+	names := []string{}
+	for _, backend := range backends {
+		if _, ok := unwrapBackend(backend).(Writable); ok {
+			names = append(names, backend.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,223 @@
+package permission
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Outcomes of access decisions
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+	OutcomeLogin   = "login"
+	// OutcomeWouldDeny is used for denied requests that are forwarded in report only mode.
+	OutcomeWouldDeny = "would_deny"
+	// OutcomeFailedLogin is used for failed attempts to log in with a password or second factor.
+	OutcomeFailedLogin = "failed_login"
+	// OutcomeLockedOut is used for attempts that are rejected because of too many failed attempts.
+	OutcomeLockedOut = "locked_out"
+	// OutcomeRateLimited is used for allowed requests that are rejected because the rate limit of the rule is exceeded.
+	OutcomeRateLimited = "rate_limited"
+)
+
+// AuditLog writes one JSON line per access decision.
+type AuditLog struct {
+	Output string
+	// SampleRate is the fraction of allowed requests that are logged. Denied requests are always logged.
+	SampleRate float64
+
+	RollSize     int
+	RollKeep     int
+	RollAge      int
+	RollCompress bool
+
+	// SecretParams are query parameters that carry credentials, such as API keys and the signatures of share links. Their values are redacted.
+	SecretParams []string
+
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// AuditEntry is a single line of the audit log.
+type AuditEntry struct {
+	Time        string  `json:"time"`
+	ClientIP    string  `json:"client_ip"`
+	User        string  `json:"user,omitempty"`
+	Attempt     string  `json:"attempted_user,omitempty"`
+	Source      string  `json:"source,omitempty"`
+	KeyID       string  `json:"key_id,omitempty"`
+	Backend     string  `json:"permit_backend,omitempty"`
+	PermitType  string  `json:"permit_type,omitempty"`
+	RuleName    string  `json:"rule_name,omitempty"`
+	RulePath    string  `json:"rule_path,omitempty"`
+	RuleMethods string  `json:"rule_methods,omitempty"`
+	Method      string  `json:"method"`
+	Path        string  `json:"path"`
+	Outcome     string  `json:"outcome"`
+	LatencyMs   float64 `json:"latency_ms"`
+}
+
+// Log writes an entry for the given decision. It is safe to call Log on a nil AuditLog.
+func (audit *AuditLog) Log(r *http.Request, identity *Identity, decision *Decision, outcome string, start time.Time) {
+	if audit == nil {
+		return
+	}
+	if outcome == OutcomeAllowed && audit.SampleRate < 1 && rand.Float64() >= audit.SampleRate {
+		return
+	}
+
+	entry := NewAuditEntry(r, identity, decision, outcome)
+	entry.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	audit.Write(entry)
+}
+
+// LogAttempt writes an entry for a failed or rejected login attempt. It is safe to call LogAttempt on a nil AuditLog.
+func (audit *AuditLog) LogAttempt(r *http.Request, username, outcome string, start time.Time) {
+	if audit == nil {
+		return
+	}
+	entry := NewAuditEntry(r, nil, nil, outcome)
+	entry.Attempt = username
+	entry.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	audit.Write(entry)
+}
+
+// NewAuditEntry creates a new entry for the given decision.
+func NewAuditEntry(r *http.Request, identity *Identity, decision *Decision, outcome string) *AuditEntry {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	entry := &AuditEntry{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		ClientIP: clientIP,
+		Method:   r.Method,
+		Path:     r.RequestURI,
+		Outcome:  outcome,
+	}
+	if identity != nil {
+		entry.User = identity.Username
+		entry.Source = identity.Source
+		entry.KeyID = identity.Attributes[AttributeKeyID]
+	}
+	if decision != nil && decision.Rule != nil {
+		entry.Backend = decision.BackendName()
+		entry.PermitType = PermitTypeName(decision.PermitType)
+		entry.RuleName = decision.Rule.Name
+		entry.RulePath = decision.Rule.Path
+		entry.RuleMethods = decision.Rule.MethodString()
+	}
+	return entry
+}
+
+// Write writes an entry to the audit log.
+func (audit *AuditLog) Write(entry *AuditEntry) {
+	if audit == nil {
+		return
+	}
+	entry.Path = rewriteQuery(entry.Path, audit.SecretParams, true)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	_, err = audit.writer.Write(line)
+	if err != nil && (printError || printDebug) {
+		fmt.Printf("[permission] failed to write audit log: %s\n", err)
+	}
+}
+
+// Close closes the audit log file.
+func (audit *AuditLog) Close() error {
+	if audit == nil {
+		return nil
+	}
+	if closer, ok := audit.writer.(io.Closer); ok && audit.writer != os.Stdout && audit.writer != os.Stderr {
+		return closer.Close()
+	}
+	return nil
+}
+
+// NewAuditLog creates a new AuditLog from configuration.
+func NewAuditLog(c *caddy.Controller) (*AuditLog, error) {
+	new := &AuditLog{
+		SampleRate:   1,
+		RollSize:     100,
+		RollKeep:     10,
+		RollAge:      14,
+		RollCompress: true,
+	}
+
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	new.Output = c.Val()
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "sample":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, c.Errf("permission > audit > sample must be between 0 and 1")
+			}
+			new.SampleRate = rate
+		case "roll_size", "roll_keep", "roll_age":
+			option := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			i, err := strconv.Atoi(c.Val())
+			if err != nil || i < 0 {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "roll_size":
+				new.RollSize = i
+			case "roll_keep":
+				new.RollKeep = i
+			case "roll_age":
+				new.RollAge = i
+			}
+		case "roll_uncompressed":
+			new.RollCompress = false
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	switch new.Output {
+	case "stdout":
+		new.writer = os.Stdout
+	case "stderr":
+		new.writer = os.Stderr
+	default:
+		new.writer = &lumberjack.Logger{
+			Filename:   new.Output,
+			MaxSize:    new.RollSize,
+			MaxBackups: new.RollKeep,
+			MaxAge:     new.RollAge,
+			Compress:   new.RollCompress,
+		}
+	}
+
+	return new, nil
+}
@@ -1,13 +1,15 @@
 package permission
 
 import (
+	"context"
 	"net/http"
 	"sync"
 
 	"github.com/caddyserver/caddy"
 )
 
-// Backend is an interface for adding backend plugins
+// Backend is an interface for adding backend plugins.
+// New backends should implement BackendV2 instead.
 type Backend interface {
 	GetUsername(r *http.Request) (username string, authSuccess bool, err error)
 	GetPermit(username string) (*Permit, error)
@@ -17,27 +19,138 @@ type Backend interface {
 	Name() string
 }
 
+// UserInfoBackend is an optional interface for backends that know more about a user than the username.
+// It is used for backends that implement Backend, BackendV2 backends return this information in the Identity.
+type UserInfoBackend interface {
+	GetUserInfo(username string) *User
+}
+
+// Authenticator authenticates requests.
+type Authenticator interface {
+	// Authenticate returns the identity of the request, or nil if the request could not be authenticated by this backend.
+	Authenticate(ctx context.Context, r *http.Request) (*Identity, error)
+}
+
+// Authorizer provides permits for requests.
+type Authorizer interface {
+	// Authorize returns the permit of the given type (PermitTypeUser, PermitTypeDefault or PermitTypePublic) for the request.
+	// The identity is nil for PermitTypePublic. A nil permit means that the backend has no permit of this type.
+	Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error)
+}
+
+// BackendV2 is the context-aware interface for backend plugins.
+type BackendV2 interface {
+	Authenticator
+	Authorizer
+	Login(w http.ResponseWriter, r *http.Request, realm string) (bool, int, error)
+	Name() string
+}
+
+// Starter is an optional interface for backends that run background work, such as cleaning caches.
+// Start is called when Caddy starts serving the site.
+type Starter interface {
+	Start() error
+}
+
+// Closer is an optional interface for backends that need to release resources.
+// Close is called when Caddy shuts down or the site is replaced by a reload.
+type Closer interface {
+	Close() error
+}
+
+// Successor is an optional interface for backends that can take over the state (caches, sessions) of the backend they replace on a graceful reload.
+// TakeOver is called with the backend of the same name of the previous configuration, before Start.
+// The predecessor is the backend as returned by its factory: a BackendV2, or a Backend for backends registered with RegisterBackend.
+type Successor interface {
+	TakeOver(predecessor interface{}) error
+}
+
+// Linter is an optional interface for backends that can check their configuration for likely mistakes.
+// Lint is called after the configuration was parsed.
+type Linter interface {
+	Lint() []*LintWarning
+}
+
+// Writable is an optional interface for backends whose users, groups and rules can be changed at runtime through the admin API.
+// UpdatePolicy must apply update to a copy of the policy and only replace the current policy if update and validation succeed.
+type Writable interface {
+	Policy() *Policy
+	UpdatePolicy(update func(policy *Policy) error) error
+}
+
+// Decider is an optional interface for backends that decide requests with their own logic instead of permits.
+// For authenticated requests, Decide is consulted in place of the user and default permits of the backend, for anonymous requests in place of its public permit.
+// It returns the deciding rule, or nil if the backend does not decide the request.
+type Decider interface {
+	Decide(ctx context.Context, r *http.Request, identity *Identity, method, path string) (allowed bool, rule *Rule, err error)
+}
+
+// Endpoint is an optional interface for backends that serve requests to a path themselves, such as minting share links.
+// Requests to the path are authenticated as usual and then passed to ServeEndpoint instead of being checked and forwarded. The identity is nil for anonymous requests.
+type Endpoint interface {
+	EndpointPath() string
+	ServeEndpoint(w http.ResponseWriter, r *http.Request, handler *Handler, identity *Identity) (int, error)
+}
+
+// Revoker is an optional interface for backends that cache authentications or hold sessions of users.
+// Revoke is called when a user logs out, with the logout request, or with a nil request if all sessions of the user end ("log out everywhere").
+type Revoker interface {
+	Revoke(ctx context.Context, r *http.Request, username string) error
+}
+
 // BackendFactory creates a plug
 type BackendFactory func(c *caddy.Controller, now int64) (Backend, error)
 
+// BackendV2Factory creates a BackendV2 plug
+type BackendV2Factory func(c *caddy.Controller, now int64) (BackendV2, error)
+
 var (
-	backendFactories     map[string]BackendFactory
-	backendFactoriesLock sync.RWMutex
+	backendFactories       map[string]BackendV2Factory
+	legacyBackendFactories map[string]BackendFactory
+	backendFactoriesLock   sync.RWMutex
 )
 
 func init() {
-	backendFactories = make(map[string]BackendFactory)
+	backendFactories = make(map[string]BackendV2Factory)
+	legacyBackendFactories = make(map[string]BackendFactory)
 }
 
 // RegisterBackend registers a Permission backend for use
 func RegisterBackend(name string, plugFactory BackendFactory) {
+	RegisterBackendV2(name, func(c *caddy.Controller, now int64) (BackendV2, error) {
+		backend, err := plugFactory(c, now)
+		if err != nil {
+			return nil, err
+		}
+		return AdaptBackend(backend), nil
+	})
+	backendFactoriesLock.Lock()
+	defer backendFactoriesLock.Unlock()
+	legacyBackendFactories[name] = plugFactory
+}
+
+// RegisterBackendV2 registers a context-aware Permission backend for use
+func RegisterBackendV2(name string, plugFactory BackendV2Factory) {
 	backendFactoriesLock.Lock()
 	defer backendFactoriesLock.Unlock()
 	backendFactories[name] = plugFactory
+	delete(legacyBackendFactories, name)
 }
 
-// GetFactory returns the factory for the given backend name
+// GetFactory returns the factory for the given backend name, if it was registered with RegisterBackend.
+// Use GetFactoryV2 to get the factories of all backends.
 func GetFactory(name string) BackendFactory {
+	backendFactoriesLock.RLock()
+	defer backendFactoriesLock.RUnlock()
+	factory, ok := legacyBackendFactories[name]
+	if !ok {
+		return nil
+	}
+	return factory
+}
+
+// GetFactoryV2 returns the factory for the given backend name
+func GetFactoryV2(name string) BackendV2Factory {
 	backendFactoriesLock.RLock()
 	defer backendFactoriesLock.RUnlock()
 	factory, ok := backendFactories[name]
@@ -1,12 +1,17 @@
 package permission
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,69 +24,139 @@ import (
 type APIBackend struct {
 	CustomName string
 
+	// Store caches users and permits.
+	Store     CacheStore
+	StoreType string
+	StoreArgs []string
+
 	Lock          sync.RWMutex
-	Users         map[string]*User
-	Permits       map[string]*Permit
 	DefaultPermit *Permit
 	PublicPermit  *Permit
 
 	UserURL   string
 	PermitURL string
 
-	LoginURL string
+	LoginURL  string
+	LogoutURL string
 
 	AddPrefixes      []string
 	AddWithoutPrefix bool
 
+	ForwardHeaders []string
+	ForwardCookies []string
+
 	CacheTime int64
 	Cleanup   int64
+
+	TLSClientCert string
+	TLSClientKey  string
+	TLSCA         string
+	SignSecret    string
+	BearerToken   string
+
+	UnixSockets         map[string]string
+	Proxy               string
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     int64
+	NoHTTP2             bool
+	Timeout             int64
+	Client              *http.Client
+
+	PersistFile   string
+	persistKey    []byte
+	persistSignal chan struct{}
+
+	stop chan struct{}
 }
 
 // GetUsername authenticates and returns a username, if successful.
 func (backend *APIBackend) GetUsername(r *http.Request) (username string, ok bool, err error) {
+	user, err := backend.getUser(r)
+	if user == nil {
+		return "", false, err
+	}
+	return user.Username, true, nil
+}
+
+// Authenticate authenticates the request and returns the identity of the user, if successful.
+func (backend *APIBackend) Authenticate(ctx context.Context, r *http.Request) (*Identity, error) {
+	if backend.Store == nil || isSimulation(ctx) {
+		return nil, errNotStarted
+	}
+	user, err := backend.getUser(r.WithContext(ctx))
+	if user == nil {
+		return nil, err
+	}
+	return user.Identity(backend.Name()), nil
+}
 
-	var user *User
+// getUser returns the cached user of the request or authenticates the request via the API.
+func (backend *APIBackend) getUser(r *http.Request) (*User, error) {
 
-	backend.Lock.RLock()
-	user, ok = backend.Users["auth="+r.Header.Get("Authorization")]
-	if !ok {
+	user, err := backend.Store.User("auth=" + r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
 		for _, cookie := range r.Cookies() {
-			user, ok = backend.Users[cookie.Name+"="+cookie.Value]
-			if ok {
+			user, err = backend.Store.User(cookie.Name + "=" + cookie.Value)
+			if user != nil || err != nil {
 				break
 			}
 		}
+		if err != nil {
+			return nil, err
+		}
 	}
-	backend.Lock.RUnlock()
 
-	if ok && user.ValidUntil > time.Now().Unix() {
-		username = user.Username
-		return
+	if user != nil && user.ValidUntil > time.Now().Unix() {
+		countCache(backend.Name(), "users", cacheHit, 1)
+		return user, nil
 	}
 
-	user, err = backend.AuthenticateUser(r)
-	if user != nil {
-		ok = true
-	}
-	return
+	countCache(backend.Name(), "users", cacheMiss, 1)
+	return backend.AuthenticateUser(r)
 
 }
 
 // GetPermit returns the user permit of a user.
-func (backend *APIBackend) GetPermit(username string) (permit *Permit, err error) {
+func (backend *APIBackend) GetPermit(username string) (*Permit, error) {
+	return backend.getPermit(context.Background(), username)
+}
+
+// Authorize returns the permit of the given type.
+func (backend *APIBackend) Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error) {
+	if backend.Store == nil || isSimulation(ctx) {
+		return nil, errNotStarted
+	}
+	switch permitType {
+	case PermitTypeUser:
+		return backend.getPermit(ctx, identity.Username)
+	case PermitTypeDefault:
+		return backend.GetDefaultPermit()
+	case PermitTypePublic:
+		return backend.GetPublicPermit()
+	}
+	return nil, nil
+}
 
-	var ok bool
+// getPermit returns the cached user permit or refreshes it via the API.
+func (backend *APIBackend) getPermit(ctx context.Context, username string) (*Permit, error) {
 
-	backend.Lock.RLock()
-	permit, ok = backend.Permits[username]
-	backend.Lock.RUnlock()
+	permit, err := backend.Store.Permit(username)
+	if err != nil {
+		return nil, err
+	}
 
 	// Use >= to get an extra second compared to GetUsername, which may save a roundtrip if a request happens to occur between these two calls.
-	if ok && permit.ValidUntil >= time.Now().Unix() {
-		return
+	if permit != nil && permit.ValidUntil >= time.Now().Unix() {
+		countCache(backend.Name(), "permits", cacheHit, 1)
+		return permit, nil
 	}
 
-	return backend.RefreshUserPermit(username)
+	countCache(backend.Name(), "permits", cacheMiss, 1)
+	return backend.refreshUserPermit(ctx, username)
 
 }
 
@@ -118,10 +193,13 @@ func init() {
 func NewAPIBackend(c *caddy.Controller, now int64) (Backend, error) {
 
 	new := APIBackend{
-		Users:     make(map[string]*User),
-		Permits:   make(map[string]*Permit),
-		CacheTime: 600,
-		Cleanup:   3600,
+		StoreType:           StoreMemory,
+		CacheTime:           600,
+		Cleanup:             3600,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90,
+		Timeout:             10,
 	}
 
 	// we start right after the permission keyword
@@ -136,12 +214,20 @@ func NewAPIBackend(c *caddy.Controller, now int64) (Backend, error) {
 			if !c.NextArg() {
 				return nil, c.ArgErr()
 			}
-			new.UserURL = c.Val()
+			url, err := new.parseAPIURL(c.Val())
+			if err != nil {
+				return nil, err
+			}
+			new.UserURL = url
 		case "permit":
 			if !c.NextArg() {
 				return nil, c.ArgErr()
 			}
-			new.PermitURL = c.Val()
+			url, err := new.parseAPIURL(c.Val())
+			if err != nil {
+				return nil, err
+			}
+			new.PermitURL = url
 			if !strings.Contains(new.PermitURL, "{{username}}") {
 				return nil, fmt.Errorf("permission > api > permit must contain a username placeholder: \"{{username}}\"")
 			}
@@ -150,12 +236,109 @@ func NewAPIBackend(c *caddy.Controller, now int64) (Backend, error) {
 				return nil, c.ArgErr()
 			}
 			new.LoginURL = c.Val()
+		case "logout":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			url, err := new.parseAPIURL(c.Val())
+			if err != nil {
+				return nil, err
+			}
+			new.LogoutURL = url
 		case "add_prefix":
 			for c.NextArg() {
 				new.AddPrefixes = append(new.AddPrefixes, c.Val())
 			}
 		case "add_without_prefix":
 			new.AddWithoutPrefix = true
+		case "forward_headers", "forward_cookies":
+			option := c.Val()
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "forward_headers":
+				// credentials have their own options, so that forward_cookies cannot be bypassed
+				for _, name := range args {
+					switch http.CanonicalHeaderKey(name) {
+					case "Cookie":
+						return nil, c.Errf("permission > api > forward_headers: Cookie cannot be forwarded as a header, use forward_cookies")
+					case "Authorization":
+						return nil, c.Errf("permission > api > forward_headers: Authorization cannot be forwarded as a header, BasicAuth credentials are always forwarded")
+					}
+					if apiReservedHeader(name) {
+						return nil, c.Errf("permission > api > forward_headers: %s is set by the plugin and cannot be forwarded", name)
+					}
+				}
+				new.ForwardHeaders = append(new.ForwardHeaders, args...)
+			case "forward_cookies":
+				new.ForwardCookies = append(new.ForwardCookies, args...)
+			}
+		case "tls_client_cert":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			new.TLSClientCert = args[0]
+			new.TLSClientKey = args[1]
+		case "tls_ca":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.TLSCA = c.Val()
+		case "sign_secret":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.SignSecret = c.Val()
+		case "bearer_token":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.BearerToken = c.Val()
+		case "proxy":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.Proxy = c.Val()
+		case "no_http2":
+			new.NoHTTP2 = true
+		case "max_idle_conns", "max_idle_conns_per_host", "idle_timeout", "timeout":
+			option := c.Val()
+			// require argument
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			// parse integer
+			i, err := strconv.ParseInt(c.Val(), 10, 64)
+			if err != nil || i < 0 {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "max_idle_conns":
+				new.MaxIdleConns = int(i)
+			case "max_idle_conns_per_host":
+				new.MaxIdleConnsPerHost = int(i)
+			case "idle_timeout":
+				new.IdleConnTimeout = i
+			case "timeout":
+				new.Timeout = i
+			}
+		case "store":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			new.StoreType = args[0]
+			new.StoreArgs = args[1:]
+		case "persist":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			new.PersistFile = args[0]
+			new.setPersistKey(args[1])
 		case "cache", "cleanup":
 			option := c.Val()
 			// require argument
@@ -182,27 +365,94 @@ func NewAPIBackend(c *caddy.Controller, now int64) (Backend, error) {
 		}
 	}
 
-	// kick of cleaner
-	go new.Cleaner()
+	err := new.setupClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if new.PersistFile != "" && new.StoreType != StoreMemory {
+		return nil, fmt.Errorf("permission > api > persist: only possible with the %s store", StoreMemory)
+	}
+	// shared stores are opened when the backend starts, the memory store is needed for the persisted cache and reloads
+	err = checkCacheStore(new.StoreType, new.StoreArgs)
+	if err != nil {
+		return nil, fmt.Errorf("permission > api > store: %s", err)
+	}
+	if new.StoreType == StoreMemory {
+		new.Store = NewMemoryStore()
+	}
+	if new.PersistFile != "" {
+		new.persistSignal = make(chan struct{}, 1)
+	}
 
 	return &new, nil
 }
 
+// API response versions
+const (
+	ResponseVersion1 = 1
+	ResponseVersion2 = 2
+
+	ResponseVersionLatest = ResponseVersion2
+)
+
 // Response is a respone to an API request.
 type Response struct {
+	Version     int
 	BasicAuth   bool
 	Cookie      string
 	Username    string
 	Permissions map[string]string
+
+	// Version 2
+	Groups      []string
+	TTL         int64
+	Headers     map[string]string
+	DisplayName string
+	Email       string
+	Deny        []string
+}
+
+// ParseResponse unpacks and checks a response from the API.
+// Fields of newer versions are ignored if the response declares an older version.
+func ParseResponse(content []byte) (*Response, error) {
+	apiResponse := &Response{}
+	err := json.Unmarshal(content, apiResponse)
+	if err != nil {
+		return nil, fmt.Errorf("could not unpack response: %s", err)
+	}
+
+	switch apiResponse.Version {
+	case 0, ResponseVersion1:
+		return &Response{
+			Version:     ResponseVersion1,
+			BasicAuth:   apiResponse.BasicAuth,
+			Cookie:      apiResponse.Cookie,
+			Username:    apiResponse.Username,
+			Permissions: apiResponse.Permissions,
+		}, nil
+	case ResponseVersion2:
+		if apiResponse.TTL < 0 {
+			return nil, errors.New("invalid response: \"TTL\" may not be negative")
+		}
+		return apiResponse, nil
+	default:
+		return nil, fmt.Errorf("invalid response: unsupported version %d", apiResponse.Version)
+	}
+}
+
+// cacheTime returns the time the response may be cached.
+func (backend *APIBackend) cacheTime(apiResponse *Response) int64 {
+	if apiResponse.TTL > 0 {
+		return apiResponse.TTL
+	}
+	return backend.CacheTime
 }
 
 // AuthenticateUser handles authentication via API.
 func (backend *APIBackend) AuthenticateUser(r *http.Request) (*User, error) {
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	apiRequest, err := http.NewRequest("GET", backend.UserURL, nil)
+	apiRequest, err := backend.newAPIRequest(r.Context(), "GET", backend.UserURL)
 	if err != nil {
 		return nil, err
 	}
@@ -223,66 +473,90 @@ func (backend *APIBackend) AuthenticateUser(r *http.Request) (*User, error) {
 	} else {
 		apiRequest.Header.Set("X-Forwarded-Proto", "http")
 	}
+	apiRequest.Header.Set("X-Forwarded-Method", r.Method)
+	apiRequest.Header.Set("X-Forwarded-Uri", r.RequestURI)
+	setClientCertHeaders(apiRequest, r)
+
+	// Add configured headers
+	for _, name := range backend.ForwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+		for _, value := range r.Header[name] {
+			apiRequest.Header.Add(name, value)
+		}
+	}
 
 	// Add basicauth and cookies
+	// The Authorization header is taken by the bearer token, if configured.
 	rUsername, rPassword, ok := r.BasicAuth()
 	if ok {
-		apiRequest.SetBasicAuth(rUsername, rPassword)
+		if backend.BearerToken != "" {
+			apiRequest.Header.Set("X-Forwarded-Authorization", r.Header.Get("Authorization"))
+		} else {
+			apiRequest.SetBasicAuth(rUsername, rPassword)
+		}
 	}
 	for _, cookie := range r.Cookies() {
-		apiRequest.AddCookie(cookie)
+		if backend.forwardCookie(cookie.Name) {
+			apiRequest.AddCookie(cookie)
+		}
 	}
 
-	resp, err := client.Do(apiRequest)
+	resp, err := backend.Client.Do(apiRequest)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	countAPIResponse(backend, "user", resp.StatusCode)
 
 	switch resp.StatusCode {
 	case 200:
 
-		apiResponse := &Response{}
-		// var content []byte
-		// _, err := resp.Body.Read(content)
 		content, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			return nil, fmt.Errorf("could not read response: %s", err)
 		}
-		fmt.Println(string(content))
-		err = json.Unmarshal(content, apiResponse)
+		apiResponse, err := ParseResponse(content)
 		if err != nil {
-			return nil, fmt.Errorf("could not unpack response: %s", err)
+			return nil, err
 		}
 
 		// process username
 
-		var user *User
+		var authKey string
 		switch {
 		case apiResponse.BasicAuth:
-			backend.Lock.Lock()
-			user = NewUser(apiResponse.Username, backend.CacheTime)
-			backend.Users["auth="+r.Header.Get("Authorization")] = user
-			backend.Lock.Unlock()
+			authKey = "auth=" + r.Header.Get("Authorization")
 		case apiResponse.Cookie != "":
-			backend.Lock.Lock()
-			user = NewUser(apiResponse.Username, backend.CacheTime)
-			backend.Users[apiResponse.Cookie] = user
-			backend.Lock.Unlock()
+			authKey = apiResponse.Cookie
 		default:
 			return nil, errors.New("invalid response: missing either \"BasicAuth\" or \"Cookie\" for user identification")
 		}
 
+		user := NewUser(apiResponse.Username, backend.cacheTime(apiResponse))
+		user.Groups = apiResponse.Groups
+		user.DisplayName = apiResponse.DisplayName
+		user.Email = apiResponse.Email
+		user.Headers = apiResponse.Headers
+
+		err = backend.Store.SetUser(authKey, user)
+		if err != nil {
+			return nil, err
+		}
+		backend.markDirty()
+
 		// process optional permit
 
-		if len(apiResponse.Permissions) > 0 {
+		if len(apiResponse.Permissions) > 0 || len(apiResponse.Deny) > 0 {
 			new, err := backend.CreatePermit(apiResponse)
 			if err != nil {
 				return nil, err
 			}
 
-			backend.Lock.Lock()
-			backend.Permits[apiResponse.Username] = new
-			backend.Lock.Unlock()
+			err = backend.Store.SetPermit(apiResponse.Username, new)
+			if err != nil {
+				return nil, err
+			}
+			backend.markDirty()
 		}
 
 		return user, nil
@@ -296,28 +570,66 @@ func (backend *APIBackend) AuthenticateUser(r *http.Request) (*User, error) {
 	return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 }
 
+// forwardCookie returns whether the cookie with the given name should be forwarded to the API.
+// All cookies are forwarded if no cookies are configured.
+func (backend *APIBackend) forwardCookie(name string) bool {
+	if len(backend.ForwardCookies) == 0 {
+		return true
+	}
+	for _, allowed := range backend.ForwardCookies {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// setClientCertHeaders adds the fields of the TLS client certificate of the original request to the API request.
+func setClientCertHeaders(apiRequest, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	apiRequest.Header.Set("X-Forwarded-Tls-Client-Cert-Subject", cert.Subject.String())
+	apiRequest.Header.Set("X-Forwarded-Tls-Client-Cert-Issuer", cert.Issuer.String())
+	apiRequest.Header.Set("X-Forwarded-Tls-Client-Cert-Serial", cert.SerialNumber.String())
+	apiRequest.Header.Set("X-Forwarded-Tls-Client-Cert-Not-After", cert.NotAfter.UTC().Format(time.RFC3339))
+	apiRequest.Header.Set("X-Forwarded-Tls-Client-Cert-Fingerprint", hex.EncodeToString(fingerprint[:]))
+}
+
 // RefreshUserPermit gets the Permit of an already authenticated user via API.
 func (backend *APIBackend) RefreshUserPermit(username string) (*Permit, error) {
+	return backend.refreshUserPermit(context.Background(), username)
+}
+
+func (backend *APIBackend) refreshUserPermit(ctx context.Context, username string) (*Permit, error) {
 
 	url := strings.Replace(backend.PermitURL, "{{username}}", username, -1)
 
-	resp, err := http.Get(url)
+	apiRequest, err := backend.newAPIRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := backend.Client.Do(apiRequest)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	countAPIResponse(backend, "permit", resp.StatusCode)
 
 	switch resp.StatusCode {
 	case 200:
 
-		apiResponse := &Response{}
-		var content []byte
-		_, err := resp.Body.Read(content)
+		content, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			return nil, fmt.Errorf("could not read response: %s", err)
 		}
-		err = json.Unmarshal(content, apiResponse)
+		apiResponse, err := ParseResponse(content)
 		if err != nil {
-			return nil, fmt.Errorf("could not unpack response: %s", err)
+			return nil, err
 		}
 
 		// process permit
@@ -326,31 +638,21 @@ func (backend *APIBackend) RefreshUserPermit(username string) (*Permit, error) {
 			return nil, err
 		}
 
-		backend.Lock.Lock()
-		switch username {
-		case DefaultIdentifier:
-			backend.DefaultPermit = new
-		case PublicIdentifier:
-			backend.PublicPermit = new
-		default:
-			backend.Permits[username] = new
+		err = backend.setPermit(username, new)
+		if err != nil {
+			return nil, err
 		}
-		backend.Lock.Unlock()
+		backend.markDirty()
 
 		return new, nil
 
 	case 404, 403:
 		new := NewPermit(backend.CacheTime, 0)
-		backend.Lock.Lock()
-		switch username {
-		case DefaultIdentifier:
-			backend.DefaultPermit = new
-		case PublicIdentifier:
-			backend.PublicPermit = new
-		default:
-			backend.Permits[username] = new
+		err = backend.setPermit(username, new)
+		if err != nil {
+			return nil, err
 		}
-		backend.Lock.Unlock()
+		backend.markDirty()
 		return new, nil
 
 	case 500:
@@ -360,57 +662,240 @@ func (backend *APIBackend) RefreshUserPermit(username string) (*Permit, error) {
 	return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 }
 
-// Cleaner periodically cleans up the APIBackend
-// This consists of deleting all timed-out users and permits.
-func (backend *APIBackend) Cleaner() {
-	c := time.Tick(time.Duration(backend.Cleanup * 1000000000))
-	for now := range c {
-		nowUnix := now.Unix()
+// setPermit caches the permit of a user, or the default or public permit.
+func (backend *APIBackend) setPermit(username string, permit *Permit) error {
+	switch username {
+	case DefaultIdentifier:
+		backend.Lock.Lock()
+		backend.DefaultPermit = permit
+		backend.Lock.Unlock()
+	case PublicIdentifier:
 		backend.Lock.Lock()
+		backend.PublicPermit = permit
+		backend.Lock.Unlock()
+	default:
+		return backend.Store.SetPermit(username, permit)
+	}
+	return nil
+}
+
+// Invalidate removes the cached permit and all cached authentications of a user, on all nodes sharing the cache store.
+func (backend *APIBackend) Invalidate(username string) error {
+	err := backend.Store.Invalidate(username)
+	backend.markDirty()
+	return err
+}
+
+// LogoutScopeHeader tells the logout URL of the API whether the session of the request ("session") or all sessions of the user ("everywhere") end.
+const LogoutScopeHeader = "X-Logout-Scope"
+
+// apiReservedHeader returns whether the plugin sets the header on API requests itself, so that clients cannot provide it.
+func apiReservedHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	switch name {
+	case "Host", "X-Real-Ip", LogoutScopeHeader:
+		return true
+	}
+	return strings.HasPrefix(name, "X-Forwarded-") || strings.HasPrefix(name, "X-Permission-")
+}
+
+// Revoke removes the user from the cache and calls the logout URL of the API, if configured.
+// The API receives the credentials of the logout request, if any, so that it can end the session on its side.
+func (backend *APIBackend) Revoke(ctx context.Context, r *http.Request, username string) error {
+	err := backend.Invalidate(username)
+	if err != nil || backend.LogoutURL == "" {
+		return err
+	}
 
-		// clean users
-		for auth, user := range backend.Users {
-			if user.ValidUntil < nowUnix {
-				delete(backend.Users, auth)
+	url := strings.Replace(backend.LogoutURL, "{{username}}", username, -1)
+	apiRequest, err := backend.newAPIRequest(ctx, "POST", url)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		apiRequest.Header.Set(LogoutScopeHeader, "everywhere")
+	} else {
+		apiRequest.Header.Set(LogoutScopeHeader, "session")
+		if authorization := r.Header.Get("Authorization"); authorization != "" {
+			if backend.BearerToken != "" {
+				apiRequest.Header.Set("X-Forwarded-Authorization", authorization)
+			} else {
+				apiRequest.Header.Set("Authorization", authorization)
 			}
 		}
-
-		// clean permits
-		for username, permit := range backend.Permits {
-			if permit.ValidUntil < nowUnix {
-				delete(backend.Permits, username)
+		for _, cookie := range r.Cookies() {
+			if backend.forwardCookie(cookie.Name) {
+				apiRequest.AddCookie(cookie)
 			}
 		}
+	}
 
-		backend.Lock.Unlock()
+	resp, err := backend.Client.Do(apiRequest)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	countAPIResponse(backend, "logout", resp.StatusCode)
+
+	switch resp.StatusCode {
+	case 200, 204, 404:
+		return nil
+	case 500:
+		return errors.New("server error")
 	}
+	return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 }
 
-// CreatePermit creates a new permit according to the configuration.
-func (backend *APIBackend) CreatePermit(apiResponse *Response) (*Permit, error) {
+// Cleaner periodically cleans up the APIBackend until stop is closed.
+func (backend *APIBackend) Cleaner(stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(backend.Cleanup) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			backend.clean(now.Unix())
+		case <-stop:
+			return
+		}
+	}
+}
 
-	new := NewPermit(backend.CacheTime, 0)
-	for path, methods := range apiResponse.Permissions {
+// clean deletes all timed-out users and permits.
+func (backend *APIBackend) clean(nowUnix int64) {
+	evictedUsers, evictedPermits := backend.Store.Clean(nowUnix)
+	countCache(backend.Name(), "users", cacheEviction, evictedUsers)
+	countCache(backend.Name(), "permits", cacheEviction, evictedPermits)
+	if evictedUsers > 0 || evictedPermits > 0 {
+		backend.markDirty()
+	}
+}
 
-		if len(backend.AddPrefixes) == 0 || backend.AddWithoutPrefix {
-			err := new.AddRule(methods, path)
-			if err != nil {
-				return nil, fmt.Errorf("could not parse permission: %s", err)
-			}
+// Start opens the cache store, if it is shared, and starts the cleaner and the cache writer.
+func (backend *APIBackend) Start() error {
+	if backend.Store == nil {
+		store, err := NewCacheStore(backend.StoreType, backend.StoreArgs, "caddy-permission:"+backend.Name()+":")
+		if err != nil {
+			return err
 		}
-
-		if len(backend.AddPrefixes) > 0 {
-			for _, prefix := range backend.AddPrefixes {
-				err := new.AddRule(methods, prefix+path)
-				if err != nil {
-					return nil, fmt.Errorf("could not parse permission: %s", err)
+		backend.Store = store
+	}
+	// load persisted cache, the writer is started with the backend
+	// the cache is best-effort: if it cannot be loaded, it is moved aside and the backend starts empty
+	if backend.PersistFile != "" {
+		err := backend.loadCache()
+		if err != nil {
+			invalidFile := backend.PersistFile + persistInvalidSuffix
+			renameErr := os.Rename(backend.PersistFile, invalidFile)
+			if printError || printDebug {
+				fmt.Printf("[permission] %s failed to load persisted cache %s, starting empty: %s\n", backend.Name(), backend.PersistFile, err)
+				if renameErr == nil {
+					fmt.Printf("[permission] %s moved invalid cache to %s\n", backend.Name(), invalidFile)
 				}
 			}
 		}
+	}
+	backend.stop = make(chan struct{})
+	go backend.Cleaner(backend.stop)
+	if backend.PersistFile != "" {
+		go backend.cacheWriter(backend.stop)
+	}
+	return nil
+}
+
+// Close stops all background work, writes the cache to disk, if configured, and closes the cache store.
+func (backend *APIBackend) Close() error {
+	if backend.Store == nil {
+		return nil
+	}
+	if backend.stop == nil {
+		return backend.Store.Close()
+	}
+	close(backend.stop)
+	backend.stop = nil
+
+	if backend.PersistFile != "" {
+		err := backend.saveCache()
+		if err != nil {
+			backend.Store.Close()
+			return err
+		}
+	}
+	return backend.Store.Close()
+}
+
+// TakeOver takes over the cache of the APIBackend this one replaces, if both use the same API.
+// Shared stores are not taken over, as the cache is already shared.
+func (backend *APIBackend) TakeOver(predecessor interface{}) error {
+	old, ok := predecessor.(*APIBackend)
+	if !ok ||
+		old.UserURL != backend.UserURL ||
+		old.PermitURL != backend.PermitURL ||
+		old.AddWithoutPrefix != backend.AddWithoutPrefix ||
+		!reflect.DeepEqual(old.AddPrefixes, backend.AddPrefixes) {
+		return nil
+	}
+	oldStore, oldOk := old.Store.(*MemoryStore)
+	store, ok := backend.Store.(*MemoryStore)
+	if !oldOk || !ok {
+		return nil
+	}
+	store.merge(oldStore)
+
+	old.Lock.RLock()
+	defer old.Lock.RUnlock()
+	backend.Lock.Lock()
+	defer backend.Lock.Unlock()
+	if old.DefaultPermit != nil {
+		backend.DefaultPermit = old.DefaultPermit
+	}
+	if old.PublicPermit != nil {
+		backend.PublicPermit = old.PublicPermit
+	}
+
+	return nil
+}
+
+// CreatePermit creates a new permit according to the configuration.
+// Denied paths are added first, so that they take precedence over permissions.
+func (backend *APIBackend) CreatePermit(apiResponse *Response) (*Permit, error) {
 
+	new := NewPermit(backend.cacheTime(apiResponse), 0)
+	for _, path := range apiResponse.Deny {
+		err := backend.addPermission(new, "none", path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for path, methods := range apiResponse.Permissions {
+		err := backend.addPermission(new, methods, path)
+		if err != nil {
+			return nil, err
+		}
 	}
 	new.Finalize()
 
 	return new, nil
 
 }
+
+// addPermission adds a permission to the permit, respecting configured prefixes.
+func (backend *APIBackend) addPermission(permit *Permit, methods, path string) error {
+
+	if len(backend.AddPrefixes) == 0 || backend.AddWithoutPrefix {
+		err := permit.AddRule(methods, path)
+		if err != nil {
+			return fmt.Errorf("could not parse permission: %s", err)
+		}
+	}
+
+	if len(backend.AddPrefixes) > 0 {
+		for _, prefix := range backend.AddPrefixes {
+			err := permit.AddRule(methods, prefix+path)
+			if err != nil {
+				return fmt.Errorf("could not parse permission: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package permission
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers used to sign requests to the API.
+const (
+	APITimestampHeader = "X-Permission-Timestamp"
+	APISignatureHeader = "X-Permission-Signature"
+)
+
+// SignAPIRequest returns the signature of an API request with the given shared secret.
+// The signature is the hex encoded HMAC-SHA256 of the method, the request URI (path and query) and the timestamp, separated by newlines.
+// The host is not signed, as the Host header of API requests is set to the one of the original request.
+func SignAPIRequest(secret, method, requestURI, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAPIRequest checks if the signature of the given API request is valid and not older than maxAge.
+// It may be used by API implementations written in Go.
+func VerifyAPIRequest(r *http.Request, secret string, maxAge time.Duration) error {
+	timestamp := r.Header.Get(APITimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid timestamp")
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age > maxAge || age < -maxAge {
+		return errors.New("timestamp out of range")
+	}
+
+	expected := SignAPIRequest(secret, r.Method, r.URL.RequestURI(), timestamp)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(APISignatureHeader))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// newAPIRequest creates a new request to the API and adds the configured authentication.
+func (backend *APIBackend) newAPIRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	apiRequest, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	apiRequest = apiRequest.WithContext(ctx)
+
+	if backend.BearerToken != "" {
+		apiRequest.Header.Set("Authorization", "Bearer "+backend.BearerToken)
+	}
+	if backend.SignSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		apiRequest.Header.Set(APITimestampHeader, timestamp)
+		apiRequest.Header.Set(APISignatureHeader, SignAPIRequest(backend.SignSecret, method, apiRequest.URL.RequestURI(), timestamp))
+	}
+
+	return apiRequest, nil
+}
+
+// parseAPIURL parses an URL of an API endpoint.
+// URLs in the form of "unix:/path/to/socket:/request/path" are rewritten to a placeholder host that is dialed via the unix socket.
+func (backend *APIBackend) parseAPIURL(rawURL string) (string, error) {
+	if !strings.HasPrefix(rawURL, "unix:") {
+		return rawURL, nil
+	}
+
+	socket := strings.TrimPrefix(rawURL, "unix:")
+	requestPath := "/"
+	if i := strings.Index(socket, ":"); i >= 0 {
+		socket, requestPath = socket[:i], socket[i+1:]
+	}
+	if socket == "" || !strings.HasPrefix(requestPath, "/") {
+		return "", fmt.Errorf("invalid unix socket URL \"%s\", expected \"unix:/path/to/socket:/request/path\"", rawURL)
+	}
+
+	if backend.UnixSockets == nil {
+		backend.UnixSockets = make(map[string]string)
+	}
+	host := ""
+	for existingHost, existingSocket := range backend.UnixSockets {
+		if existingSocket == socket {
+			host = existingHost
+		}
+	}
+	if host == "" {
+		host = fmt.Sprintf("unix-socket-%d", len(backend.UnixSockets))
+		backend.UnixSockets[host] = socket
+	}
+
+	return "http://" + host + requestPath, nil
+}
+
+// setupClient creates the HTTP client used for all requests to the API.
+func (backend *APIBackend) setupClient() error {
+	tlsConfig := &tls.Config{}
+
+	if backend.TLSClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(backend.TLSClientCert, backend.TLSClientKey)
+		if err != nil {
+			return fmt.Errorf("permission > api > tls_client_cert: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if backend.TLSCA != "" {
+		caData, err := ioutil.ReadFile(backend.TLSCA)
+		if err != nil {
+			return fmt.Errorf("permission > api > tls_ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return fmt.Errorf("permission > api > tls_ca: no certificates found in %s", backend.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err == nil {
+				if socket, ok := backend.UnixSockets[host]; ok {
+					return dialer.DialContext(ctx, "unix", socket)
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        backend.MaxIdleConns,
+		MaxIdleConnsPerHost: backend.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(backend.IdleConnTimeout) * time.Second,
+		ForceAttemptHTTP2:   !backend.NoHTTP2,
+	}
+
+	switch backend.Proxy {
+	case "":
+	case "none":
+		transport.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(backend.Proxy)
+		if err != nil {
+			return fmt.Errorf("permission > api > proxy: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	// requests to unix sockets never go through a proxy
+	if proxy := transport.Proxy; proxy != nil {
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			if _, ok := backend.UnixSockets[r.URL.Hostname()]; ok {
+				return nil, nil
+			}
+			return proxy(r)
+		}
+	}
+
+	backend.Client = &http.Client{
+		Timeout:   time.Duration(backend.Timeout) * time.Second,
+		Transport: transport,
+	}
+	return nil
+}
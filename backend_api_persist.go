@@ -0,0 +1,204 @@
+package permission
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	persistVersion = 1
+
+	// persistDelay is the time to wait for further changes before writing the cache to disk.
+	persistDelay = 5 * time.Second
+)
+
+// persistedCache is the on-disk format of the APIBackend cache.
+type persistedCache struct {
+	Version       int
+	Users         map[string]*User
+	Permits       map[string]*Permit
+	DefaultPermit *Permit
+	PublicPermit  *Permit
+}
+
+// setPersistKey derives the encryption key for the persisted cache from the configured secret.
+func (backend *APIBackend) setPersistKey(secret string) {
+	key := sha256.Sum256([]byte(secret))
+	backend.persistKey = key[:]
+}
+
+// persistInvalidSuffix is appended to the name of a persisted cache that cannot be loaded.
+const persistInvalidSuffix = ".invalid"
+
+// loadCache loads the persisted cache from disk, skipping everything that is not valid anymore.
+// Entries taken over from the previous configuration are newer and are kept. A missing file is not an error.
+func (backend *APIBackend) loadCache() error {
+	data, err := ioutil.ReadFile(backend.PersistFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	plaintext, err := backend.decryptCache(data)
+	if err != nil {
+		return err
+	}
+
+	cache := &persistedCache{}
+	err = json.Unmarshal(plaintext, cache)
+	if err != nil {
+		return fmt.Errorf("could not unpack cache: %s", err)
+	}
+	if cache.Version != persistVersion {
+		return fmt.Errorf("unsupported cache version %d", cache.Version)
+	}
+
+	now := time.Now().Unix()
+
+	for auth, user := range cache.Users {
+		if existing, _ := backend.Store.User(auth); existing == nil && user.ValidUntil > now {
+			backend.Store.SetUser(auth, user)
+		}
+	}
+	for username, permit := range cache.Permits {
+		if existing, _ := backend.Store.Permit(username); existing == nil && permit.ValidUntil >= now {
+			backend.Store.SetPermit(username, permit)
+		}
+	}
+
+	backend.Lock.Lock()
+	defer backend.Lock.Unlock()
+	if backend.DefaultPermit == nil && cache.DefaultPermit != nil && cache.DefaultPermit.ValidUntil >= now {
+		backend.DefaultPermit = cache.DefaultPermit
+	}
+	if backend.PublicPermit == nil && cache.PublicPermit != nil && cache.PublicPermit.ValidUntil >= now {
+		backend.PublicPermit = cache.PublicPermit
+	}
+
+	return nil
+}
+
+// saveCache writes the current cache to disk. Only the memory store can be persisted.
+func (backend *APIBackend) saveCache() error {
+	store, ok := backend.Store.(*MemoryStore)
+	if !ok {
+		return nil
+	}
+
+	store.Lock.RLock()
+	backend.Lock.RLock()
+	plaintext, err := json.Marshal(&persistedCache{
+		Version:       persistVersion,
+		Users:         store.Users,
+		Permits:       store.Permits,
+		DefaultPermit: backend.DefaultPermit,
+		PublicPermit:  backend.PublicPermit,
+	})
+	backend.Lock.RUnlock()
+	store.Lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	data, err := backend.encryptCache(plaintext)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that the cache is never left half-written
+	tmpFile, err := ioutil.TempFile(filepath.Dir(backend.PersistFile), "."+filepath.Base(backend.PersistFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), backend.PersistFile)
+}
+
+// markDirty signals the cache writer that the cache changed.
+func (backend *APIBackend) markDirty() {
+	if backend.persistSignal == nil {
+		return
+	}
+	select {
+	case backend.persistSignal <- struct{}{}:
+	default:
+	}
+}
+
+// cacheWriter asynchronously writes the cache to disk after it changed, until the backend is closed.
+func (backend *APIBackend) cacheWriter(stop chan struct{}) {
+	for {
+		select {
+		case <-backend.persistSignal:
+		case <-stop:
+			return
+		}
+
+		// wait for further changes
+		select {
+		case <-time.After(persistDelay):
+		case <-stop:
+			return
+		}
+
+		err := backend.saveCache()
+		if err != nil && (printError || printDebug) {
+			fmt.Printf("[permission] failed to persist cache of %s: %s\n", backend.Name(), err)
+		}
+	}
+}
+
+func (backend *APIBackend) encryptCache(plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(backend.persistKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (backend *APIBackend) decryptCache(data []byte) ([]byte, error) {
+	gcm, err := newGCM(backend.persistKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("cache file too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt cache, wrong key?")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
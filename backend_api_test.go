@@ -0,0 +1,446 @@
+package permission
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+func newTestAPIBackend(t *testing.T, config string) *APIBackend {
+	c := caddy.NewTestController("http", "permission api {\n"+config+"\n}")
+	c.Next()
+	c.NextArg()
+	backend, err := NewAPIBackend(c, 0)
+	if err != nil {
+		t.Fatalf("failed to create api backend: %s", err)
+	}
+	return backend.(*APIBackend)
+}
+
+func TestAPIRequestAuthentication(t *testing.T) {
+	var lastErr error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastErr = VerifyAPIRequest(r, "s3cret", time.Minute)
+		if lastErr == nil && (len(r.Header["Authorization"]) != 1 || r.Header.Get("Authorization") != "Bearer t0ken") {
+			lastErr = fmt.Errorf("unexpected Authorization header: %v", r.Header["Authorization"])
+		}
+		if lastErr == nil && (len(r.Header["X-Forwarded-Authorization"]) != 1 || r.Header.Get("X-Forwarded-Authorization") != "Basic Z3JlZzpxd2VydHkx") {
+			lastErr = fmt.Errorf("unexpected X-Forwarded-Authorization header: %v", r.Header["X-Forwarded-Authorization"])
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	backend := newTestAPIBackend(t, fmt.Sprintf(`
+		user %s/caddyapi
+		permit %s/caddyapi/{{username}}
+		sign_secret s3cret
+		bearer_token t0ken
+	`, server.URL, server.URL))
+
+	r := httptest.NewRequest("GET", "/tmp/", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	_, err := backend.AuthenticateUser(r)
+	if err != nil {
+		t.Fatalf("failed to authenticate user: %s", err)
+	}
+	if lastErr != nil {
+		t.Errorf("user request: %s", lastErr)
+	}
+
+	// the signature must not verify with another secret
+	apiRequest, err := backend.newAPIRequest(context.Background(), "GET", server.URL+"/caddyapi/greg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyAPIRequest(apiRequest, "other", time.Minute) == nil {
+		t.Error("signature verified with wrong secret")
+	}
+}
+
+func TestAPIUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "auth.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/caddyapi/greg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Permissions": {"/tmp/": "rw"}}`))
+	}))
+
+	backend := newTestAPIBackend(t, fmt.Sprintf(`
+		user unix:%s:/caddyapi
+		permit unix:%s:/caddyapi/{{username}}
+		proxy http://127.0.0.1:1 # unix sockets must not be proxied
+		max_idle_conns 4
+		idle_timeout 30
+	`, socket, socket))
+
+	if len(backend.UnixSockets) != 1 {
+		t.Errorf("expected one socket, got %v", backend.UnixSockets)
+	}
+
+	permit, err := backend.RefreshUserPermit("greg")
+	if err != nil {
+		t.Fatalf("failed to get permit via unix socket: %s", err)
+	}
+	if len(permit.Rules) != 1 || permit.Rules[0].Path != "/tmp/" {
+		t.Errorf("unexpected permit: %+v", permit)
+	}
+}
+
+func TestAPIResponseConformance(t *testing.T) {
+	tests := []struct {
+		file      string
+		valid     bool
+		authKey   string
+		user      *User
+		cacheTime int64
+		allowed   []string
+		denied    []string
+	}{
+		{
+			file:      "v1_cookie.json",
+			valid:     true,
+			authKey:   "PHPSESSID=12345",
+			user:      &User{Username: "tom"},
+			cacheTime: 600,
+			allowed:   []string{"PUT /tmp/file"},
+		},
+		{
+			file:      "v1_basicauth.json",
+			valid:     true,
+			authKey:   "auth=Basic dG9tOnB3",
+			user:      &User{Username: "tom"},
+			cacheTime: 600,
+			allowed:   []string{"GET /static/file"},
+			denied:    []string{"PUT /static/file"},
+		},
+		{
+			file:      "v1_ignores_v2_fields.json",
+			valid:     true,
+			authKey:   "PHPSESSID=12345",
+			user:      &User{Username: "tom"},
+			cacheTime: 600,
+			allowed:   []string{"PUT /tmp/file", "GET /tmp/secret/file"},
+		},
+		{
+			file:    "v2_full.json",
+			valid:   true,
+			authKey: "PHPSESSID=12345",
+			user: &User{
+				Username:    "tom",
+				Groups:      []string{"admins", "staff"},
+				DisplayName: "Tom Tester",
+				Email:       "tom@example.com",
+				Headers:     map[string]string{"X-Tenant": "acme"},
+			},
+			cacheTime: 60,
+			allowed:   []string{"PUT /tmp/file"},
+			denied:    []string{"GET /tmp/secret/file"},
+		},
+		{file: "invalid_version.json"},
+		{file: "invalid_ttl.json"},
+		{file: "invalid_identification.json"},
+	}
+
+	for _, test := range tests {
+		content, err := ioutil.ReadFile(filepath.Join("testdata", "api", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content)
+		}))
+
+		backend := newTestAPIBackend(t, fmt.Sprintf("user %s/caddyapi", server.URL))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("tom", "pw")
+		now := time.Now().Unix()
+		user, err := backend.AuthenticateUser(r)
+		server.Close()
+
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected error", test.file)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to authenticate: %s", test.file, err)
+			continue
+		}
+
+		if backend.Store.(*MemoryStore).Users[test.authKey] != user {
+			t.Errorf("%s: user not cached with key %s", test.file, test.authKey)
+		}
+		// the second may tick over while authenticating
+		if cacheTime := user.ValidUntil - now; cacheTime < test.cacheTime-1 || cacheTime > test.cacheTime+1 {
+			t.Errorf("%s: expected cache time %d, got %d", test.file, test.cacheTime, cacheTime)
+		}
+		user.ValidUntil = 0
+		if !reflect.DeepEqual(user, test.user) {
+			t.Errorf("%s: unexpected user: %+v", test.file, user)
+		}
+
+		permit := backend.Store.(*MemoryStore).Permits["tom"]
+		for _, request := range test.allowed {
+			var method, path string
+			fmt.Sscan(request, &method, &path)
+			if allowed, _ := permit.Check(testPermitsHandler, method, path, false); !allowed {
+				t.Errorf("%s: expected %s to be allowed", test.file, request)
+			}
+		}
+		for _, request := range test.denied {
+			var method, path string
+			fmt.Sscan(request, &method, &path)
+			if allowed, _ := permit.Check(testPermitsHandler, method, path, false); allowed {
+				t.Errorf("%s: expected %s to be denied", test.file, request)
+			}
+		}
+	}
+}
+
+func TestAPIForwardContext(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	backend := newTestAPIBackend(t, fmt.Sprintf(`
+		user %s/caddyapi
+		forward_headers Accept-Language X-Request-Id
+		forward_cookies session
+	`, server.URL))
+
+	r := httptest.NewRequest("PUT", "/tmp/file?x=1", nil)
+	r.Header.Set("Accept-Language", "en")
+	r.Header.Set("X-Other", "secret")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "12345"})
+	r.AddCookie(&http.Cookie{Name: "tracking", Value: "abc"})
+	_, err := backend.AuthenticateUser(r)
+	if err != nil {
+		t.Fatalf("failed to authenticate user: %s", err)
+	}
+
+	expected := map[string]string{
+		"X-Forwarded-Method": "PUT",
+		"X-Forwarded-Uri":    "/tmp/file?x=1",
+		"Accept-Language":    "en",
+		"X-Other":            "",
+		"Cookie":             "session=12345",
+	}
+	for name, value := range expected {
+		if received.Header.Get(name) != value {
+			t.Errorf("expected header %s to be %q, got %q", name, value, received.Header.Get(name))
+		}
+	}
+
+	// credentials cannot be forwarded as headers, they have their own options, and neither can headers the plugin sets
+	for _, name := range []string{"cookie", "Authorization", "host", "X-Real-IP", "X-Forwarded-For", "x-forwarded-uri", "X-Permission-Signature", "X-Logout-Scope"} {
+		c := caddy.NewTestController("http", "permission api {\nuser "+server.URL+"/caddyapi\nforward_headers Accept-Language "+name+"\n}")
+		c.Next()
+		c.NextArg()
+		if _, err := NewAPIBackend(c, 0); err == nil {
+			t.Errorf("expected forwarding %s header to fail", name)
+		}
+	}
+}
+
+func TestAPIPersistentCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache")
+
+	backend := newTestAPIBackend(t, "persist "+cacheFile+" s3cret")
+	now := time.Now().Unix()
+	store := backend.Store.(*MemoryStore)
+	store.Users["PHPSESSID=valid"] = &User{Username: "tom", ValidUntil: now + 60}
+	store.Users["PHPSESSID=expired"] = &User{Username: "tom", ValidUntil: now - 60}
+	store.Permits["tom"] = NewPermit(60, now)
+	addRule(store.Permits["tom"], "rw", "/tmp/")
+	err = backend.saveCache()
+	if err != nil {
+		t.Fatalf("failed to save cache: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "PHPSESSID") {
+		t.Error("cache is not encrypted")
+	}
+
+	loadedBackend := newTestAPIBackend(t, "persist "+cacheFile+" s3cret")
+	err = loadedBackend.Start()
+	if err != nil {
+		t.Fatalf("failed to start backend: %s", err)
+	}
+	loaded := loadedBackend.Store.(*MemoryStore)
+	if _, ok := loaded.Users["PHPSESSID=valid"]; !ok {
+		t.Error("valid user was not loaded")
+	}
+	if _, ok := loaded.Users["PHPSESSID=expired"]; ok {
+		t.Error("expired user was loaded")
+	}
+	if !reflect.DeepEqual(loaded.Permits["tom"], store.Permits["tom"]) {
+		t.Errorf("unexpected permit: %+v", loaded.Permits["tom"])
+	}
+	loadedBackend.Close()
+
+	// caches that cannot be loaded are moved aside
+	c := caddy.NewTestController("http", "permission api {\npersist "+cacheFile+" wrong\n}")
+	c.Next()
+	c.NextArg()
+	wrongKey, err := NewAPIBackend(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Errorf("expected cache not to be loaded before the backend starts: %s", err)
+	}
+	err = wrongKey.(*APIBackend).Start()
+	if err != nil {
+		t.Fatalf("expected invalid cache to be ignored: %s", err)
+	}
+	defer wrongKey.(*APIBackend).Close()
+	if users := wrongKey.(*APIBackend).Store.(*MemoryStore).Users; len(users) != 0 {
+		t.Errorf("loaded cache with wrong key: %v", users)
+	}
+	if _, err := os.Stat(cacheFile + persistInvalidSuffix); err != nil {
+		t.Errorf("expected invalid cache to be moved aside: %s", err)
+	}
+	if _, err := os.Stat(cacheFile); !os.IsNotExist(err) {
+		t.Errorf("expected invalid cache to be removed: %v", err)
+	}
+
+	// the cache is only written again if cleaning removed entries
+	cleaned := newTestAPIBackend(t, "persist "+cacheFile+" s3cret")
+	cleaned.Store.(*MemoryStore).Users["PHPSESSID=valid"] = &User{Username: "tom", ValidUntil: now + 60}
+	cleaned.clean(now)
+	if len(cleaned.persistSignal) != 0 {
+		t.Error("expected cache not to be marked dirty without evictions")
+	}
+	cleaned.clean(now + 120)
+	if len(cleaned.persistSignal) != 1 {
+		t.Error("expected cache to be marked dirty after evictions")
+	}
+}
+
+func TestAPIHandover(t *testing.T) {
+	config := `
+	permission api {
+		user http://localhost:8080/caddyapi
+	}`
+	old, err := NewHandler(caddy.NewTestController("http", config), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := NewHandler(caddy.NewTestController("http", config), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = old.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldBackend := old.Backends[0].(*APIBackend)
+	oldBackend.Store.SetUser("PHPSESSID=12345", NewUser("tom", 60))
+
+	err = new.TakeOver(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = new.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldBackend.stop != nil {
+		t.Error("old backend was not stopped")
+	}
+
+	newBackend := new.Backends[0].(*APIBackend)
+	if user, _ := newBackend.Store.User("PHPSESSID=12345"); user == nil {
+		t.Error("user was not taken over")
+	}
+	err = new.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPILogout(t *testing.T) {
+	var received []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	backend := newTestAPIBackend(t, fmt.Sprintf(`
+		user %s/caddyapi
+		logout %s/logout/{{username}}
+		forward_cookies session
+	`, server.URL, server.URL))
+	backend.Store.SetUser("session=12345", NewUser("tom", 60))
+	backend.Store.SetPermit("tom", NewPermit(60, 0))
+
+	r := httptest.NewRequest("GET", "/.logout", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "12345"})
+	r.AddCookie(&http.Cookie{Name: "tracking", Value: "abc"})
+	err := backend.Revoke(r.Context(), r, "tom")
+	if err != nil {
+		t.Fatalf("failed to log out: %s", err)
+	}
+	if user, _ := backend.Store.User("session=12345"); user != nil {
+		t.Error("user was not removed from the cache")
+	}
+	if permit, _ := backend.Store.Permit("tom"); permit != nil {
+		t.Error("permit was not removed from the cache")
+	}
+	if len(received) != 1 || received[0].Method != "POST" || received[0].URL.Path != "/logout/tom" ||
+		received[0].Header.Get(LogoutScopeHeader) != "session" || received[0].Header.Get("Cookie") != "session=12345" {
+		t.Fatalf("unexpected logout request: %+v", received)
+	}
+
+	err = backend.Revoke(context.Background(), nil, "tom")
+	if err != nil {
+		t.Fatalf("failed to log out everywhere: %s", err)
+	}
+	if len(received) != 2 || received[1].Header.Get(LogoutScopeHeader) != "everywhere" || received[1].Header.Get("Cookie") != "" {
+		t.Errorf("unexpected logout request: %+v", received[1])
+	}
+}
@@ -0,0 +1,411 @@
+package permission
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+const (
+	defaultAPIKeyHeader = "X-API-Key"
+	apiKeyHashPrefix    = "sha256:"
+	// apiKeyIDLength is the number of hex characters of the key hash that identify a key, eg. in the audit log.
+	apiKeyIDLength = 12
+)
+
+// APIKeyBackend authenticates services with API keys. Every key belongs to a service user and has its own rules.
+type APIKeyBackend struct {
+	CustomName string
+	Header     string
+	QueryParam string
+	NoBearer   bool
+	File       string
+
+	// Keys holds the keys by the hex encoded SHA-256 hash of the key.
+	Keys map[string]*APIKey
+
+	warnings []*LintWarning
+}
+
+// APIKey is an API key of a service user.
+type APIKey struct {
+	User string
+	// Hash is the hex encoded SHA-256 hash of the key.
+	Hash string
+	// Expires is the unix time when the key expires, 0 if it does not.
+	Expires int64
+	// From restricts the networks the key may be used from.
+	From   []*net.IPNet
+	Permit *Permit
+}
+
+// apiKeyFile is the format of key files.
+type apiKeyFile struct {
+	Keys []*apiKeyFileEntry
+}
+
+type apiKeyFileEntry struct {
+	User    string
+	Hash    string
+	Expires string `json:",omitempty"`
+	From    []string
+	PolicyRules
+}
+
+// ID returns the identifier of the key, a prefix of its hash.
+func (key *APIKey) ID() string {
+	return key.Hash[:apiKeyIDLength]
+}
+
+// valid returns whether the key may be used now from the given IP address.
+func (key *APIKey) valid(now int64, ip net.IP) bool {
+	if key.Expires != 0 && key.Expires <= now {
+		return false
+	}
+	if len(key.From) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range key.From {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashAPIKey returns the hash of an API key as used in the configuration.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return apiKeyHashPrefix + hex.EncodeToString(hash[:])
+}
+
+// lookup returns the valid key of the request, or nil.
+func (backend *APIKeyBackend) lookup(r *http.Request) *APIKey {
+	secret := r.Header.Get(backend.Header)
+	if secret == "" && !backend.NoBearer {
+		authorization := r.Header.Get("Authorization")
+		if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+			secret = strings.TrimSpace(authorization[7:])
+		}
+	}
+	if secret == "" && backend.QueryParam != "" && r.URL != nil {
+		secret = r.URL.Query().Get(backend.QueryParam)
+	}
+	if secret == "" {
+		return nil
+	}
+
+	key, ok := backend.Keys[strings.TrimPrefix(HashAPIKey(secret), apiKeyHashPrefix)]
+	if !ok {
+		return nil
+	}
+
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if !key.valid(time.Now().Unix(), net.ParseIP(remoteIP)) {
+		return nil
+	}
+	return key
+}
+
+// Authenticate authenticates the request with an API key.
+func (backend *APIKeyBackend) Authenticate(ctx context.Context, r *http.Request) (*Identity, error) {
+	key := backend.lookup(r)
+	if key == nil {
+		return nil, nil
+	}
+	identity := NewIdentity(key.User, backend.Name())
+	identity.SetAttribute(AttributeKeyID, key.ID())
+	return identity, nil
+}
+
+// Authorize returns the rules of the API key used for the request.
+func (backend *APIKeyBackend) Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error) {
+	if permitType != PermitTypeUser {
+		return nil, nil
+	}
+	key := backend.lookup(r)
+	if key == nil || key.User != identity.Username {
+		return nil, nil
+	}
+	return key.Permit, nil
+}
+
+// Login is not supported, services must send their key with every request.
+func (backend *APIKeyBackend) Login(w http.ResponseWriter, r *http.Request, realm string) (bool, int, error) {
+	return false, 0, nil
+}
+
+// Name returns the name of the backend.
+func (backend *APIKeyBackend) Name() string {
+	if backend.CustomName != "" {
+		return fmt.Sprintf("%s:%s", BackendAPIKeyName, backend.CustomName)
+	}
+	return BackendAPIKeyName
+}
+
+// Lint returns the likely mistakes found while parsing the configuration.
+func (backend *APIKeyBackend) Lint() []*LintWarning {
+	return backend.warnings
+}
+
+// lintf records a likely mistake in the configuration.
+func (backend *APIKeyBackend) lintf(file string, line int, format string, args ...interface{}) {
+	backend.warnings = append(backend.warnings, &LintWarning{
+		File:    file,
+		Line:    line,
+		Backend: backend.Name(),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// addKey adds a key, later keys with the same hash replace earlier ones.
+func (backend *APIKeyBackend) addKey(key *APIKey, file string, line int, now int64) {
+	if _, ok := backend.Keys[key.Hash]; ok {
+		backend.lintf(file, line, "key %s is already declared and is replaced", key.ID())
+	}
+	if key.Expires != 0 && key.Expires <= now {
+		backend.lintf(file, line, "key %s of %s has expired", key.ID(), key.User)
+	}
+	backend.Keys[key.Hash] = key
+}
+
+func init() {
+	RegisterBackendV2(BackendAPIKeyName, NewAPIKeyBackend)
+}
+
+// NewAPIKeyBackend creates a new APIKeyBackend.
+func NewAPIKeyBackend(c *caddy.Controller, now int64) (BackendV2, error) {
+	if now == 0 {
+		now = time.Now().Unix()
+	}
+
+	new := &APIKeyBackend{
+		Header: defaultAPIKeyHeader,
+		Keys:   make(map[string]*APIKey),
+	}
+
+	args := c.RemainingArgs()
+	if len(args) != 0 {
+		return nil, c.ArgErr()
+	}
+
+	var key *APIKey
+	var keyLine int
+	finishKey := func() {
+		if key != nil {
+			key.Permit.Finalize()
+			new.addKey(key, c.File(), keyLine, now)
+			key = nil
+		}
+	}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "name":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.CustomName = c.Val()
+		case "header":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.Header = c.Val()
+		case "query":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.QueryParam = c.Val()
+		case "no_bearer":
+			new.NoBearer = true
+		case "file":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.File = c.Val()
+		case "key":
+			finishKey()
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, c.ArgErr()
+			}
+			var err error
+			key, err = newAPIKey(args[0], args[1])
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			keyLine = c.Line()
+			for i := 2; i < len(args); i++ {
+				switch {
+				case args[i] == "expires" && i+1 < len(args):
+					i++
+					key.Expires, err = parseExpiry(args[i])
+				case args[i] == "from" && i+1 < len(args):
+					for i+1 < len(args) && args[i+1] != "expires" {
+						i++
+						err = key.addNetwork(args[i])
+						if err != nil {
+							break
+						}
+					}
+				default:
+					return nil, c.ArgErr()
+				}
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+			}
+		case rateOption:
+			// rate limit of the rules of the current key
+			if key == nil || !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			limit, err := ParseRateLimit(c.Val())
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			key.Permit.Rate = limit
+		default:
+			// add permission to the current key
+			if key == nil {
+				return nil, c.ArgErr()
+			}
+			methods := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			err := key.Permit.AddRule(methods, c.Val(), c.RemainingArgs()...)
+			if err != nil {
+				return nil, err
+			}
+			for _, message := range LintMethods(methods) {
+				new.lintf(c.File(), c.Line(), "%s", message)
+			}
+			last := len(key.Permit.Rules) - 1
+			for _, message := range LintRule(key.Permit.Rules[:last], key.Permit.Rules[last]) {
+				new.lintf(c.File(), c.Line(), "%s", message)
+			}
+		}
+	}
+	finishKey()
+
+	if new.File != "" {
+		err := new.loadFile(now)
+		if err != nil {
+			return nil, c.Errf("failed to load keys of %s: %s", new.Name(), err)
+		}
+	}
+
+	return new, nil
+}
+
+// loadFile adds the keys of the configured key file.
+func (backend *APIKeyBackend) loadFile(now int64) error {
+	data, err := ioutil.ReadFile(backend.File)
+	if err != nil {
+		return err
+	}
+	file := &apiKeyFile{}
+	err = decodeConfigFile(backend.File, data, file)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range file.Keys {
+		key, err := newAPIKey(entry.User, entry.Hash)
+		if err != nil {
+			return fmt.Errorf("key %d: %s", i+1, err)
+		}
+		if entry.Expires != "" {
+			key.Expires, err = parseExpiry(entry.Expires)
+			if err != nil {
+				return fmt.Errorf("key %d: %s", i+1, err)
+			}
+		}
+		for _, network := range entry.From {
+			err = key.addNetwork(network)
+			if err != nil {
+				return fmt.Errorf("key %d: %s", i+1, err)
+			}
+		}
+		err = entry.PolicyRules.addTo(key.Permit)
+		if err != nil {
+			return fmt.Errorf("key %d: %s", i+1, err)
+		}
+		key.Permit.Finalize()
+		backend.addKey(key, backend.File, 0, now)
+	}
+	return nil
+}
+
+// newAPIKey creates a key without rules from its user and hash.
+func newAPIKey(user, hash string) (*APIKey, error) {
+	if user == "" {
+		return nil, fmt.Errorf("missing user")
+	}
+	if !strings.HasPrefix(hash, apiKeyHashPrefix) {
+		return nil, fmt.Errorf("invalid key hash of %s, must start with \"%s\"", user, apiKeyHashPrefix)
+	}
+	hash = strings.ToLower(strings.TrimPrefix(hash, apiKeyHashPrefix))
+	decoded, err := hex.DecodeString(hash)
+	if err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("invalid key hash of %s, must be a hex encoded SHA-256 hash", user)
+	}
+	return &APIKey{
+		User:   user,
+		Hash:   hash,
+		Permit: NewPermit(0, 0),
+	}, nil
+}
+
+// addNetwork restricts the key to a network, in CIDR notation or a single IP address.
+func (key *APIKey) addNetwork(network string) error {
+	parsed, err := parseNetwork(network)
+	if err != nil {
+		return err
+	}
+	key.From = append(key.From, parsed)
+	return nil
+}
+
+// parseNetwork parses a network in CIDR notation or a single IP address.
+func parseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") {
+		if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+			network += "/32"
+		} else {
+			network += "/128"
+		}
+	}
+	_, parsed, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network \"%s\"", network)
+	}
+	return parsed, nil
+}
+
+// parseExpiry parses a date (2006-01-02, UTC) or a time in RFC 3339 format.
+func parseExpiry(value string) (int64, error) {
+	if expiry, err := time.Parse("2006-01-02", value); err == nil {
+		return expiry.Unix(), nil
+	}
+	expiry, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiry \"%s\", expected a date (2006-01-02) or time (2006-01-02T15:04:05Z)", value)
+	}
+	return expiry.Unix(), nil
+}
@@ -0,0 +1,122 @@
+package permission
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeyBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys.yml")
+	err = ioutil.WriteFile(keyFile, []byte(`
+Keys:
+  - User: deploy
+    Hash: `+HashAPIKey("deploy-secret")+`
+    Expires: 2999-01-01
+    From: [192.0.2.0/24]
+    Permissions:
+      /deploy/: rw
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, next := newTestHandler(t, `
+	permission apikey {
+		query api_key
+		file `+keyFile+`
+		key ci `+HashAPIKey("ci-1-secret")+`
+		rw /artifacts/ci-1/
+		ro /artifacts/
+		key ci `+HashAPIKey("ci-2-secret")+` from 10.0.0.0/8
+		rw /artifacts/ci-2/
+		key old `+HashAPIKey("old-secret")+` expires 2019-01-01
+		rw /
+	}`)
+
+	tests := []struct {
+		header     string
+		value      string
+		method     string
+		path       string
+		remoteAddr string
+		allowed    bool
+	}{
+		{"X-API-Key", "ci-1-secret", "PUT", "/artifacts/ci-1/build.tar", "", true},
+		{"X-API-Key", "ci-1-secret", "PUT", "/artifacts/ci-2/build.tar", "", false},
+		{"X-API-Key", "ci-1-secret", "GET", "/artifacts/ci-2/build.tar", "", true},
+		{"Authorization", "Bearer ci-1-secret", "PUT", "/artifacts/ci-1/build.tar", "", true},
+		{"", "", "PUT", "/artifacts/ci-1/build.tar?api_key=ci-1-secret", "", true},
+		{"X-API-Key", "wrong-secret", "GET", "/artifacts/", "", false},
+		// keys of the same user have their own rules
+		{"X-API-Key", "ci-2-secret", "PUT", "/artifacts/ci-2/build.tar", "10.1.2.3:1234", true},
+		{"X-API-Key", "ci-2-secret", "GET", "/artifacts/ci-1/build.tar", "10.1.2.3:1234", false},
+		{"X-API-Key", "ci-2-secret", "PUT", "/artifacts/ci-2/build.tar", "198.51.100.1:1234", false},
+		{"X-API-Key", "old-secret", "GET", "/", "", false},
+		{"X-API-Key", "deploy-secret", "PUT", "/deploy/app", "", true},
+		{"X-API-Key", "deploy-secret", "PUT", "/deploy/app", "198.51.100.1:1234", false},
+	}
+	for _, test := range tests {
+		next.request = nil
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if test.remoteAddr != "" {
+			r.RemoteAddr = test.remoteAddr
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if allowed := next.request != nil; allowed != test.allowed {
+			t.Errorf("%s %s with %s %q: expected allowed=%v", test.method, test.path, test.header, test.value, test.allowed)
+		}
+	}
+
+	// keys in headers are not forwarded
+	for _, header := range []string{"X-API-Key", "Authorization"} {
+		next.request = nil
+		r := httptest.NewRequest("GET", "/artifacts/ci-1/build.tar", nil)
+		value := "ci-1-secret"
+		if header == "Authorization" {
+			value = "Bearer " + value
+		}
+		r.Header.Set(header, value)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if next.request == nil || next.request.Header.Get(header) != "" {
+			t.Errorf("expected %s to be removed from the forwarded request, got %+v", header, next.request)
+		}
+	}
+
+	// keys in the query are neither forwarded nor logged
+	buf := &bytes.Buffer{}
+	handler.Audit = &AuditLog{SampleRate: 1, SecretParams: handler.secretParams(), writer: buf}
+	next.request = nil
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/artifacts/ci-1/build.tar?api_key=ci-1-secret&v=2", nil))
+	if next.request == nil || next.request.URL.RawQuery != "v=2" || next.request.RequestURI != "/artifacts/ci-1/build.tar?v=2" {
+		t.Errorf("expected API key to be removed from the forwarded request, got %+v", next.request)
+	}
+	if strings.Contains(buf.String(), "ci-1-secret") || !strings.Contains(buf.String(), "api_key=REDACTED") {
+		t.Errorf("expected API key to be redacted in the audit log: %s", buf.String())
+	}
+	handler.Audit = nil
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "ci-1-secret")
+	identity := handler.Authenticate(r.Context(), r)
+	if identity == nil || identity.Username != "ci" || identity.Attributes[AttributeKeyID] != HashAPIKey("ci-1-secret")[7:19] {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+
+	warnings := handler.Lint()
+	if len(warnings) != 1 || warnings[0].Line != 10 {
+		t.Errorf("expected expired key warning, got %v", warnings)
+	}
+}
@@ -19,6 +19,17 @@ type BasicBackend struct {
 	Permits       map[string]*Permit
 	DefaultPermit *Permit
 	PublicPermit  *Permit
+
+	// passwordless records where users without a password were declared, for linting.
+	passwordless []*basicUser
+	warnings     []*LintWarning
+}
+
+// basicUser records where a user was declared.
+type basicUser struct {
+	name string
+	file string
+	line int
 }
 
 // GetUsername authenticates and returns a username, if successful.
@@ -60,6 +71,21 @@ func (backend *BasicBackend) Login(w http.ResponseWriter, r *http.Request, realm
 	return true, http.StatusUnauthorized, nil
 }
 
+// Lint returns the likely mistakes found while parsing the configuration.
+func (backend *BasicBackend) Lint() []*LintWarning {
+	return backend.warnings
+}
+
+// lintf records a likely mistake in the configuration.
+func (backend *BasicBackend) lintf(c *caddy.Controller, format string, args ...interface{}) {
+	backend.warnings = append(backend.warnings, &LintWarning{
+		File:    c.File(),
+		Line:    c.Line(),
+		Backend: BackendBasicName,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
 // Name returns the name of the plug.
 func (backend *BasicBackend) Name() string {
 	return BackendBasicName
@@ -80,6 +106,7 @@ func NewBasicBackend(c *caddy.Controller, now int64) (Backend, error) {
 	var nextPermit *Permit
 	var username string
 	var compiledPass string
+	declared := make(map[string]int)
 
 	// we start right after the plugin keyword
 	for c.NextBlock() {
@@ -110,6 +137,11 @@ func NewBasicBackend(c *caddy.Controller, now int64) (Backend, error) {
 				case 1:
 					username = args[0]
 					compiledPass = ""
+					new.passwordless = append(new.passwordless, &basicUser{
+						name: username,
+						file: c.File(),
+						line: c.Line(),
+					})
 				case 2:
 					username = args[0]
 					compiledPass = compileBasicAuthCreds(args[0], args[1])
@@ -121,16 +153,42 @@ func NewBasicBackend(c *caddy.Controller, now int64) (Backend, error) {
 			case PublicIdentifier:
 				username = PublicIdentifier
 			}
+			// check for duplicates, later declarations replace earlier ones
+			if line, ok := declared[username]; ok {
+				if username == DefaultIdentifier || username == PublicIdentifier {
+					new.lintf(c, "%s permit is already declared in line %d and is replaced", username, line)
+				} else {
+					new.lintf(c, "user %s is already declared in line %d and is replaced", username, line)
+				}
+			}
+			declared[username] = c.Line()
+		case rateOption:
+			// rate limit of the rules of the permit
+			if nextPermit == nil || !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			limit, err := ParseRateLimit(c.Val())
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			nextPermit.Rate = limit
 		default:
 			// add permission
 			methods := c.Val()
 			if !c.NextArg() {
 				return nil, c.ArgErr()
 			}
-			err := nextPermit.AddRule(methods, c.Val())
+			err := nextPermit.AddRule(methods, c.Val(), c.RemainingArgs()...)
 			if err != nil {
 				return nil, err
 			}
+			for _, message := range LintMethods(methods) {
+				new.lintf(c, "%s", message)
+			}
+			last := len(nextPermit.Rules) - 1
+			for _, message := range LintRule(nextPermit.Rules[:last], nextPermit.Rules[last]) {
+				new.lintf(c, "%s", message)
+			}
 		}
 	}
 
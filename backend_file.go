@@ -0,0 +1,241 @@
+package permission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/naoina/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultPollInterval = 5 * time.Second
+
+// FileBackend loads users, groups and rules from a JSON, YAML or TOML file and reloads it when it changes.
+type FileBackend struct {
+	policyBackend
+	CustomName   string
+	File         string
+	PollInterval time.Duration
+
+	// loaded is the content of the currently used file.
+	loaded     []byte
+	loadedLock sync.Mutex
+	stop       chan struct{}
+}
+
+// Name returns the name of the backend.
+func (backend *FileBackend) Name() string {
+	if backend.CustomName != "" {
+		return fmt.Sprintf("%s:%s", BackendFileName, backend.CustomName)
+	}
+	return BackendFileName
+}
+
+// Authorize returns the permit of the given type.
+func (backend *FileBackend) Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error) {
+	return backend.authorize(identity, permitType, backend.Name()), nil
+}
+
+// Reload loads the file, if it changed. If the new version is invalid, the current policy is kept.
+func (backend *FileBackend) Reload() (changed bool, err error) {
+	backend.loadedLock.Lock()
+	defer backend.loadedLock.Unlock()
+
+	data, err := ioutil.ReadFile(backend.File)
+	if err != nil {
+		return false, err
+	}
+	if backend.loaded != nil && bytes.Equal(data, backend.loaded) {
+		return false, nil
+	}
+
+	policy, err := ParsePolicy(backend.File, data)
+	if err != nil {
+		return false, err
+	}
+	compiled, err := compilePolicy(policy)
+	if err != nil {
+		return false, err
+	}
+
+	backend.replace(compiled)
+	backend.loaded = data
+	return true, nil
+}
+
+// watch reloads the file whenever its modification time or size changes, until stop is closed.
+func (backend *FileBackend) watch(stop chan struct{}) {
+	var lastModTime time.Time
+	var lastSize int64
+	if info, err := os.Stat(backend.File); err == nil {
+		lastModTime, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(backend.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		info, err := os.Stat(backend.File)
+		if err != nil {
+			if printError || printDebug {
+				fmt.Printf("[permission] failed to check policy file of %s: %s\n", backend.Name(), err)
+			}
+			continue
+		}
+		if info.ModTime().Equal(lastModTime) && info.Size() == lastSize {
+			continue
+		}
+		lastModTime, lastSize = info.ModTime(), info.Size()
+
+		changed, err := backend.Reload()
+		switch {
+		case err != nil:
+			if printError || printDebug {
+				fmt.Printf("[permission] failed to reload policy file of %s, keeping current policy: %s\n", backend.Name(), err)
+			}
+		case changed && printDebug:
+			fmt.Printf("[permission] reloaded policy file of %s\n", backend.Name())
+		}
+	}
+}
+
+// Start starts watching the file.
+func (backend *FileBackend) Start() error {
+	if backend.PollInterval <= 0 {
+		return nil
+	}
+	backend.stop = make(chan struct{})
+	go backend.watch(backend.stop)
+	return nil
+}
+
+// Close stops watching the file.
+func (backend *FileBackend) Close() error {
+	if backend.stop != nil {
+		close(backend.stop)
+		backend.stop = nil
+	}
+	return nil
+}
+
+func init() {
+	RegisterBackendV2(BackendFileName, NewFileBackend)
+}
+
+// NewFileBackend creates a new FileBackend.
+func NewFileBackend(c *caddy.Controller, now int64) (BackendV2, error) {
+
+	new := &FileBackend{
+		PollInterval: defaultPollInterval,
+	}
+
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, c.ArgErr()
+	}
+	new.File = args[0]
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "name":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.CustomName = c.Val()
+		case "poll":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			seconds, err := strconv.Atoi(c.Val())
+			if err != nil || seconds < 0 {
+				return nil, c.ArgErr()
+			}
+			new.PollInterval = time.Duration(seconds) * time.Second
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	_, err := new.Reload()
+	if err != nil {
+		return nil, c.Errf("failed to load policy file of %s: %s", new.Name(), err)
+	}
+
+	return new, nil
+}
+
+// ParsePolicy parses a policy in the format indicated by the extension of filename: .json, .yml, .yaml or .toml.
+// All formats use the same keys as the JSON format.
+func ParsePolicy(filename string, data []byte) (*Policy, error) {
+	policy := &Policy{}
+	err := decodeConfigFile(filename, data, policy)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// decodeConfigFile decodes a JSON, YAML or TOML file into v, as indicated by the extension of filename.
+// All formats are converted to JSON first, so that they share the same schema. Unknown fields are rejected.
+func decodeConfigFile(filename string, data []byte, v interface{}) error {
+	var generic interface{}
+	var err error
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		generic = json.RawMessage(data)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &generic)
+		generic = normalizeYAML(generic)
+	case ".toml":
+		var table map[string]interface{}
+		err = toml.Unmarshal(data, &table)
+		generic = table
+	default:
+		return fmt.Errorf("unknown format \"%s\", expected .json, .yml, .yaml or .toml", filepath.Ext(filename))
+	}
+	if err != nil {
+		return err
+	}
+
+	converted, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(converted))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// normalizeYAML converts the maps of a YAML document to maps with string keys.
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized[fmt.Sprintf("%v", key)] = normalizeYAML(item)
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+	}
+	return value
+}
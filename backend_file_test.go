@@ -0,0 +1,139 @@
+package permission
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParsePolicy(t *testing.T) {
+	expected := &Policy{
+		Users: map[string]*PolicyUser{
+			"greg": {
+				Groups:      []string{"staff"},
+				ValidUntil:  1562000000,
+				PolicyRules: PolicyRules{Permissions: map[string]string{"/tmp/": "rw"}},
+			},
+		},
+		Groups: map[string]*PolicyRules{
+			"staff": {Permissions: map[string]string{"/staff/": "rw"}, Deny: []string{"/staff/secret/"}},
+		},
+		Public: &PolicyRules{Permissions: map[string]string{"/": "ro"}},
+	}
+
+	tests := map[string]string{
+		"policy.json": `{
+			"Users": {"greg": {"Groups": ["staff"], "ValidUntil": 1562000000, "Permissions": {"/tmp/": "rw"}}},
+			"Groups": {"staff": {"Permissions": {"/staff/": "rw"}, "Deny": ["/staff/secret/"]}},
+			"Public": {"Permissions": {"/": "ro"}}
+		}`,
+		"policy.yml": `
+Users:
+  greg:
+    Groups: [staff]
+    ValidUntil: 1562000000
+    Permissions:
+      /tmp/: rw
+Groups:
+  staff:
+    Permissions:
+      /staff/: rw
+    Deny: [/staff/secret/]
+Public:
+  Permissions:
+    /: ro
+`,
+		"policy.toml": `
+[Users.greg]
+Groups = ["staff"]
+ValidUntil = 1562000000
+[Users.greg.Permissions]
+"/tmp/" = "rw"
+
+[Groups.staff]
+Deny = ["/staff/secret/"]
+[Groups.staff.Permissions]
+"/staff/" = "rw"
+
+[Public.Permissions]
+"/" = "ro"
+`,
+	}
+
+	for filename, content := range tests {
+		policy, err := ParsePolicy(filename, []byte(content))
+		if err != nil {
+			t.Errorf("%s: failed to parse: %s", filename, err)
+			continue
+		}
+		if !reflect.DeepEqual(policy, expected) {
+			t.Errorf("%s: unexpected policy: %+v", filename, policy)
+		}
+	}
+
+	_, err := ParsePolicy("policy.json", []byte(`{"Users": {"greg": {"Permission": {"/": "rw"}}}}`))
+	if err == nil {
+		t.Error("unknown fields should fail")
+	}
+}
+
+func TestFileBackendReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.yml")
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("qwerty1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePolicy := func(rules string) {
+		content := "Users:\n  greg:\n    PasswordHash: " + string(hash) + "\n    Permissions:\n" + rules
+		err := ioutil.WriteFile(policyFile, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePolicy("      /tmp/: rw\n")
+
+	handler, next := newTestHandler(t, "permission file "+policyFile+" {\n poll 0\n}")
+	backend := unwrapBackend(handler.Backends[0]).(*FileBackend)
+	allowed := func(path string) bool {
+		next.request = nil
+		r := httptest.NewRequest("PUT", path, nil)
+		r.SetBasicAuth("greg", "qwerty1")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return next.request != nil
+	}
+
+	if !allowed("/tmp/file") || allowed("/other/file") {
+		t.Fatal("unexpected decisions with initial policy")
+	}
+
+	// changed policy is swapped in
+	writePolicy("      /other/: rw\n")
+	changed, err := backend.Reload()
+	if !changed || err != nil {
+		t.Fatalf("failed to reload policy: %v %s", changed, err)
+	}
+	if allowed("/tmp/file") || !allowed("/other/file") {
+		t.Error("unexpected decisions with changed policy")
+	}
+
+	// invalid policy is rejected, current policy is kept
+	writePolicy("      other/: rw\n")
+	_, err = backend.Reload()
+	if err == nil {
+		t.Error("invalid policy should fail")
+	}
+	if !allowed("/other/file") {
+		t.Error("current policy should be kept")
+	}
+}
@@ -0,0 +1,58 @@
+package permission
+
+import (
+	"context"
+	"net/http"
+)
+
+// LegacyBackend adapts a Backend to the BackendV2 interface.
+type LegacyBackend struct {
+	Backend
+}
+
+// AdaptBackend returns the given Backend as a BackendV2.
+// Backends that already implement BackendV2 are returned as is.
+func AdaptBackend(backend Backend) BackendV2 {
+	if v2, ok := backend.(BackendV2); ok {
+		return v2
+	}
+	return &LegacyBackend{Backend: backend}
+}
+
+// Authenticate authenticates the request using GetUsername, and GetUserInfo if the backend implements UserInfoBackend.
+func (legacy *LegacyBackend) Authenticate(ctx context.Context, r *http.Request) (*Identity, error) {
+	username, authSuccess, err := legacy.GetUsername(r.WithContext(ctx))
+	if err != nil || !authSuccess {
+		return nil, err
+	}
+	if info, ok := legacy.Backend.(UserInfoBackend); ok {
+		if user := info.GetUserInfo(username); user != nil {
+			// the user may be shared with a cache, do not modify it
+			named := *user
+			named.Username = username
+			return named.Identity(legacy.Name()), nil
+		}
+	}
+	return NewIdentity(username, legacy.Name()), nil
+}
+
+// Authorize returns the permit of the given type using GetPermit, GetDefaultPermit or GetPublicPermit.
+func (legacy *LegacyBackend) Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error) {
+	switch permitType {
+	case PermitTypeUser:
+		return legacy.GetPermit(identity.Username)
+	case PermitTypeDefault:
+		return legacy.GetDefaultPermit()
+	case PermitTypePublic:
+		return legacy.GetPublicPermit()
+	}
+	return nil, nil
+}
+
+// unwrapBackend returns the original backend of adapted backends.
+func unwrapBackend(backend BackendV2) interface{} {
+	if legacy, ok := backend.(*LegacyBackend); ok {
+		return legacy.Backend
+	}
+	return backend
+}
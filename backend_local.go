@@ -0,0 +1,165 @@
+package permission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/caddy"
+)
+
+// LocalBackend keeps users, groups and rules in memory. They are managed at runtime through the admin API and may be persisted to a file.
+type LocalBackend struct {
+	policyBackend
+	CustomName  string
+	PersistFile string
+}
+
+// Name returns the name of the backend.
+func (backend *LocalBackend) Name() string {
+	if backend.CustomName != "" {
+		return fmt.Sprintf("%s:%s", BackendLocalName, backend.CustomName)
+	}
+	return BackendLocalName
+}
+
+// Authorize returns the permit of the given type.
+func (backend *LocalBackend) Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error) {
+	return backend.authorize(identity, permitType, backend.Name()), nil
+}
+
+// Policy returns a copy of the current policy.
+func (backend *LocalBackend) Policy() *Policy {
+	return backend.current().policy.Copy()
+}
+
+// UpdatePolicy applies update to a copy of the current policy and replaces the current policy with it, if it is valid.
+// Updates are serialized, and persisted before they are applied.
+func (backend *LocalBackend) UpdatePolicy(update func(policy *Policy) error) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	policy := backend.compiled.policy.Copy()
+	err := update(policy)
+	if err != nil {
+		return err
+	}
+	compiled, err := compilePolicy(policy)
+	if err != nil {
+		return err
+	}
+
+	if backend.PersistFile != "" {
+		err = savePolicy(backend.PersistFile, policy)
+		if err != nil {
+			return fmt.Errorf("failed to persist policy: %s", err)
+		}
+	}
+
+	backend.compiled = compiled
+	return nil
+}
+
+// TakeOver takes over the policy of the LocalBackend this one replaces, if the policy is not persisted.
+func (backend *LocalBackend) TakeOver(predecessor interface{}) error {
+	old, ok := predecessor.(*LocalBackend)
+	if !ok || backend.PersistFile != "" {
+		return nil
+	}
+
+	backend.replace(old.current())
+	return nil
+}
+
+func init() {
+	RegisterBackendV2(BackendLocalName, NewLocalBackend)
+}
+
+// NewLocalBackend creates a new LocalBackend.
+func NewLocalBackend(c *caddy.Controller, now int64) (BackendV2, error) {
+
+	new := &LocalBackend{}
+
+	args := c.RemainingArgs()
+	if len(args) != 0 {
+		return nil, c.ArgErr()
+	}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "name":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.CustomName = c.Val()
+		case "persist":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.PersistFile = c.Val()
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	policy := &Policy{}
+	if new.PersistFile != "" {
+		var err error
+		policy, err = loadPolicy(new.PersistFile)
+		if err != nil {
+			return nil, c.Errf("failed to load policy of %s: %s", new.Name(), err)
+		}
+	}
+	compiled, err := compilePolicy(policy)
+	if err != nil {
+		return nil, c.Errf("invalid policy of %s: %s", new.Name(), err)
+	}
+	new.replace(compiled)
+
+	return new, nil
+}
+
+// loadPolicy loads a persisted policy. A missing file results in an empty policy.
+func loadPolicy(filename string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Policy{}, nil
+		}
+		return nil, err
+	}
+
+	policy := &Policy{}
+	err = json.Unmarshal(data, policy)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// savePolicy writes a policy to disk.
+func savePolicy(filename string, policy *Policy) error {
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that the policy is never left half-written
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
@@ -0,0 +1,168 @@
+package permission
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestAdminAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	persistFile := filepath.Join(dir, "policy.json")
+
+	config := `
+	permission local {
+		persist ` + persistFile + `
+	}
+	permission admin /.admin {
+		user ops s3cret
+		allow 192.0.2.0/24
+	}`
+	handler, next := newTestHandler(t, config)
+
+	admin := func(method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.SetBasicAuth("ops", "s3cret")
+		w := httptest.NewRecorder()
+		status, _ := handler.ServeHTTP(w, r)
+		if status == 0 {
+			status = w.Code
+		}
+		return status
+	}
+	request := func(method, path string) (int, bool) {
+		next.request = nil
+		r := httptest.NewRequest(method, path, nil)
+		r.SetBasicAuth("greg", "qwerty1")
+		status, _ := handler.ServeHTTP(httptest.NewRecorder(), r)
+		return status, next.request != nil
+	}
+
+	// admin API is protected
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/.admin/local", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated admin request to fail with 401, got %d", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/.admin/local", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.SetBasicAuth("ops", "s3cret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected admin request from other network to fail with 403, got %d", w.Code)
+	}
+
+	// grant access
+	if status := admin("PUT", "/.admin/local/users/greg", `{"Password": "qwerty1", "Groups": ["staff"], "Permissions": {"/tmp/": "rw"}, "TTL": 3600}`); status != http.StatusBadRequest {
+		t.Errorf("expected user with unknown group to be rejected, got %d", status)
+	}
+	if status := admin("PUT", "/.admin/local/groups/staff", `{"Permissions": {"/staff/": "rw"}, "Deny": ["/staff/secret/"]}`); status != http.StatusOK {
+		t.Errorf("failed to create group: %d", status)
+	}
+	if status := admin("PUT", "/.admin/local/users/greg", `{"Password": "qwerty1", "Groups": ["staff"], "Permissions": {"/tmp/": "rw"}, "TTL": 3600}`); status != http.StatusOK {
+		t.Errorf("failed to create user: %d", status)
+	}
+	for _, test := range []struct {
+		method  string
+		path    string
+		allowed bool
+	}{
+		{"PUT", "/tmp/file", true},
+		{"PUT", "/staff/file", true},
+		{"GET", "/staff/secret/file", false},
+		{"GET", "/other", false},
+	} {
+		if _, allowed := request(test.method, test.path); allowed != test.allowed {
+			t.Errorf("%s %s: expected allowed=%v", test.method, test.path, test.allowed)
+		}
+	}
+
+	// groups in use cannot be deleted
+	if status := admin("DELETE", "/.admin/local/groups/staff", ""); status != http.StatusBadRequest {
+		t.Errorf("expected deleting used group to fail, got %d", status)
+	}
+
+	// policy is persisted
+	persisted, _ := newTestHandler(t, config)
+	policy := unwrapBackend(persisted.Backends[0]).(Writable).Policy()
+	if user, ok := policy.Users["greg"]; !ok || user.PasswordHash == "" || user.ValidUntil == 0 {
+		t.Errorf("policy was not persisted correctly: %+v", policy)
+	}
+
+	// revoke access
+	if status := admin("DELETE", "/.admin/local/users/greg", ""); status != http.StatusOK {
+		t.Errorf("failed to delete user: %d", status)
+	}
+	if _, allowed := request("PUT", "/tmp/file"); allowed {
+		t.Error("expected deleted user to be denied")
+	}
+	if status := admin("DELETE", "/.admin/local/users/greg", ""); status != http.StatusNotFound {
+		t.Errorf("expected deleting missing user to fail with 404, got %d", status)
+	}
+
+	// the admin API cannot take over the whole site
+	for _, path := range []string{"/", "//", "admin"} {
+		if _, err := NewHandler(caddy.NewTestController("http", "permission admin "+path+" {\nuser ops s3cret\n}"), 0); err == nil {
+			t.Errorf("expected admin path %q to be rejected", path)
+		}
+	}
+}
+
+func TestLocalBackendSession(t *testing.T) {
+	handler, next := newTestHandler(t, `
+	permission login /.login {
+		secret 0123456789abcdef
+	}
+	permission local`)
+	backend := unwrapBackend(handler.Backends[0]).(*LocalBackend)
+	err := backend.UpdatePolicy(func(policy *Policy) error {
+		policy.Groups = map[string]*PolicyRules{"staff": {Permissions: map[string]string{"/staff/": "rw"}}}
+		user := &PolicyUser{Groups: []string{"staff"}}
+		policy.Users = map[string]*PolicyUser{"greg": user}
+		return user.SetPassword("qwerty1")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newLoginRequest(handler.LoginForm, url.Values{"username": {"greg"}, "password": {"qwerty1"}}))
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatalf("failed to login: %d", w.Code)
+	}
+	cookie := w.Result().Cookies()[0]
+	request := func() bool {
+		next.request = nil
+		r := httptest.NewRequest("PUT", "/staff/file", nil)
+		r.AddCookie(cookie)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return next.request != nil
+	}
+	if !request() {
+		t.Error("expected session to be accepted")
+	}
+
+	// sessions carry the groups of the login, the current user decides
+	err = backend.UpdatePolicy(func(policy *Policy) error {
+		delete(policy.Users, "greg")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request() {
+		t.Error("expected session of deleted user to be denied")
+	}
+}
@@ -0,0 +1,559 @@
+package permission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Effects of policy rules
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+
+	// expectNone is the expectation of policy tests where no rule matches.
+	expectNone = "none"
+)
+
+// maxCELCacheEntries limits the size of the decision cache. The cache is cleared when it is full.
+const maxCELCacheEntries = 10000
+
+// CELBackend is the policy backend. It decides requests with rules written in CEL (Common Expression Language).
+// The first rule whose condition is true decides. If no rule matches, the other backends decide.
+// If a condition fails to evaluate, Decide returns an error and the request is denied.
+type CELBackend struct {
+	CustomName string
+	File       string
+	Rules      []*CELRule
+	CacheTime  time.Duration
+
+	// usage records which inputs of the rules are not part of the cache key by default.
+	usage     *celUsage
+	cache     map[string]*celCacheEntry
+	cacheLock sync.Mutex
+}
+
+// CELRule is a rule of a CELBackend.
+type CELRule struct {
+	Name      string `yaml:"name"`
+	Effect    string `yaml:"effect"`
+	Condition string `yaml:"condition"`
+
+	program cel.Program
+	ast     *cel.Ast
+}
+
+// CELTest is a test case in a policy file.
+type CELTest struct {
+	User       string            `yaml:"user"`
+	Groups     []string          `yaml:"groups"`
+	Attributes map[string]string `yaml:"attributes"`
+	Method     string            `yaml:"method"`
+	Path       string            `yaml:"path"`
+	Headers    map[string]string `yaml:"headers"`
+	// Time is the time of the request in RFC 3339 format, the current time if empty.
+	Time string `yaml:"time"`
+	// Expect is EffectAllow, EffectDeny, or "none" if no rule should match.
+	Expect string `yaml:"expect"`
+}
+
+// celPolicyFile is the format of policy files.
+type celPolicyFile struct {
+	Rules []*CELRule `yaml:"rules"`
+	Tests []*CELTest `yaml:"tests"`
+}
+
+type celCacheEntry struct {
+	allowed    bool
+	rule       *Rule
+	validUntil time.Time
+}
+
+// newCELEnv creates the CEL environment of policy rules.
+func newCELEnv() (*cel.Env, error) {
+	return cel.NewEnv(cel.Declarations(
+		decls.NewIdent("method", decls.String, nil),
+		decls.NewIdent("path", decls.String, nil),
+		decls.NewIdent("authenticated", decls.Bool, nil),
+		decls.NewIdent("identity", decls.NewMapType(decls.String, decls.Dyn), nil),
+		decls.NewIdent("request", decls.NewMapType(decls.String, decls.Dyn), nil),
+		decls.NewIdent("now", decls.Timestamp, nil),
+	))
+}
+
+// compile compiles the condition of the rule.
+func (rule *CELRule) compile(env *cel.Env) error {
+	switch rule.Effect {
+	case EffectAllow, EffectDeny:
+	default:
+		return fmt.Errorf("rule %s: effect must be %s or %s", rule.Name, EffectAllow, EffectDeny)
+	}
+
+	ast, issues := env.Compile(rule.Condition)
+	if issues != nil && issues.Err() != nil {
+		return fmt.Errorf("rule %s: %s", rule.Name, issues.Err())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return fmt.Errorf("rule %s: %s", rule.Name, err)
+	}
+	rule.program = program
+	rule.ast = ast
+	return nil
+}
+
+// celUsage records the inputs of policy rules that are not part of the cache key by default: the time and headers.
+type celUsage struct {
+	now bool
+	// headers are the names of the headers the rules read, allHeaders is set if they cannot be told, eg. "X" in request.headers.
+	headers    map[string]bool
+	allHeaders bool
+}
+
+// cacheable returns whether decisions may be cached. Decisions that depend on the time or on unknown headers may not.
+func (usage *celUsage) cacheable() bool {
+	return usage != nil && !usage.now && !usage.allHeaders
+}
+
+// add records the inputs used by the expression.
+func (usage *celUsage) add(e *exprpb.Expr) {
+	if e == nil {
+		return
+	}
+	if celIsRequest(e) || celIsHeaders(e) {
+		// the request or headers are used as a whole
+		usage.allHeaders = true
+		return
+	}
+
+	switch kind := e.ExprKind.(type) {
+	case *exprpb.Expr_IdentExpr:
+		if kind.IdentExpr.Name == "now" {
+			usage.now = true
+		}
+	case *exprpb.Expr_SelectExpr:
+		operand := kind.SelectExpr.Operand
+		switch {
+		case celIsHeaders(operand):
+			usage.headers[kind.SelectExpr.Field] = true
+		case celIsRequest(operand):
+			// other fields of the request are part of the cache key
+		default:
+			usage.add(operand)
+		}
+	case *exprpb.Expr_CallExpr:
+		call := kind.CallExpr
+		if call.Function == "_[_]" && len(call.Args) == 2 {
+			name, constant := celString(call.Args[1])
+			switch {
+			case constant && celIsHeaders(call.Args[0]):
+				usage.headers[name] = true
+				return
+			case constant && celIsRequest(call.Args[0]):
+				return
+			}
+		}
+		usage.add(call.Target)
+		for _, arg := range call.Args {
+			usage.add(arg)
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, element := range kind.ListExpr.Elements {
+			usage.add(element)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range kind.StructExpr.Entries {
+			usage.add(entry.GetMapKey())
+			usage.add(entry.Value)
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		comprehension := kind.ComprehensionExpr
+		for _, part := range []*exprpb.Expr{comprehension.IterRange, comprehension.AccuInit, comprehension.LoopCondition, comprehension.LoopStep, comprehension.Result} {
+			usage.add(part)
+		}
+	}
+}
+
+// celIsRequest returns whether the expression is the request variable.
+func celIsRequest(e *exprpb.Expr) bool {
+	return e.GetIdentExpr().GetName() == "request"
+}
+
+// celIsHeaders returns whether the expression is the headers of the request, request.headers or request["headers"].
+func celIsHeaders(e *exprpb.Expr) bool {
+	if selectExpr := e.GetSelectExpr(); selectExpr != nil {
+		return selectExpr.Field == "headers" && celIsRequest(selectExpr.Operand)
+	}
+	if call := e.GetCallExpr(); call != nil && call.Function == "_[_]" && len(call.Args) == 2 {
+		name, ok := celString(call.Args[1])
+		return ok && name == "headers" && celIsRequest(call.Args[0])
+	}
+	return false
+}
+
+// celString returns the value of a string constant.
+func celString(e *exprpb.Expr) (string, bool) {
+	constant, ok := e.GetConstExpr().GetConstantKind().(*exprpb.Constant_StringValue)
+	if !ok {
+		return "", false
+	}
+	return constant.StringValue, true
+}
+
+// celInput creates the input of policy rules.
+func celInput(r *http.Request, identity *Identity, method, path string, now time.Time) (map[string]interface{}, error) {
+	timestamp, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	headers := make(map[string]string, len(r.Header))
+	for name := range r.Header {
+		headers[name] = r.Header.Get(name)
+	}
+	query := make(map[string]string)
+	if r.URL != nil {
+		for name, values := range r.URL.Query() {
+			query[name] = values[0]
+		}
+	}
+
+	identityInput := map[string]interface{}{
+		"username":   "",
+		"groups":     []string{},
+		"attributes": map[string]string{},
+		"source":     "",
+	}
+	if identity != nil {
+		identityInput["username"] = identity.Username
+		identityInput["source"] = identity.Source
+		if identity.Groups != nil {
+			identityInput["groups"] = identity.Groups
+		}
+		if identity.Attributes != nil {
+			identityInput["attributes"] = identity.Attributes
+		}
+	}
+
+	return map[string]interface{}{
+		"method":        method,
+		"path":          path,
+		"authenticated": identity != nil,
+		"identity":      identityInput,
+		"request": map[string]interface{}{
+			"host":      r.Host,
+			"remote_ip": remoteIP,
+			"headers":   headers,
+			"query":     query,
+		},
+		"now": timestamp,
+	}, nil
+}
+
+// evaluate evaluates the rules in order and returns the first matching rule, or nil.
+func (backend *CELBackend) evaluate(r *http.Request, identity *Identity, method, path string, now time.Time) (*CELRule, error) {
+	input, err := celInput(r, identity, method, path, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range backend.Rules {
+		value, _, err := rule.program.Eval(input)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", rule.Name, err)
+		}
+		matched, ok := value.(types.Bool)
+		if !ok {
+			return nil, fmt.Errorf("rule %s: condition must return a bool, got %s", rule.Name, value.Type().TypeName())
+		}
+		if matched {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// Decide evaluates the policy rules for the request.
+func (backend *CELBackend) Decide(ctx context.Context, r *http.Request, identity *Identity, method, path string) (bool, *Rule, error) {
+	cacheable := backend.CacheTime > 0 && backend.usage.cacheable()
+	var key string
+	if cacheable {
+		key = celCacheKey(r, identity, method, path, backend.usage)
+		backend.cacheLock.Lock()
+		entry, ok := backend.cache[key]
+		backend.cacheLock.Unlock()
+		if ok && time.Now().Before(entry.validUntil) {
+			countCache(backend.Name(), "decisions", cacheHit, 1)
+			return entry.allowed, entry.rule, nil
+		}
+		countCache(backend.Name(), "decisions", cacheMiss, 1)
+	}
+
+	policyRule, err := backend.evaluate(r, identity, method, path, time.Now())
+	if err != nil {
+		return false, nil, err
+	}
+
+	var allowed bool
+	var rule *Rule
+	if policyRule != nil {
+		allowed = policyRule.Effect == EffectAllow
+		rule = &Rule{
+			Name: policyRule.Name,
+			Path: path,
+		}
+		if allowed {
+			rule.Methods = []string{method}
+		}
+	}
+
+	if cacheable {
+		backend.cacheLock.Lock()
+		if len(backend.cache) >= maxCELCacheEntries {
+			countCache(backend.Name(), "decisions", cacheEviction, len(backend.cache))
+			backend.cache = make(map[string]*celCacheEntry)
+		}
+		backend.cache[key] = &celCacheEntry{
+			allowed:    allowed,
+			rule:       rule,
+			validUntil: time.Now().Add(backend.CacheTime),
+		}
+		backend.cacheLock.Unlock()
+	}
+
+	return allowed, rule, nil
+}
+
+// celCacheKey returns the cache key of a request. Of the headers, only those the rules read are part of the key.
+// Decisions that depend on the time are not cached.
+func celCacheKey(r *http.Request, identity *Identity, method, path string, usage *celUsage) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	parts := []string{method, path, r.Host, remoteIP}
+	if identity != nil {
+		parts = append(parts, identity.Source, identity.Username, strings.Join(identity.Groups, ","))
+		attributes := make([]string, 0, len(identity.Attributes))
+		for key, value := range identity.Attributes {
+			attributes = append(attributes, key+"="+value)
+		}
+		sort.Strings(attributes)
+		parts = append(parts, attributes...)
+	}
+	if r.URL != nil {
+		parts = append(parts, r.URL.RawQuery)
+	}
+	headers := make([]string, 0, len(usage.headers))
+	for name := range usage.headers {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+	for _, name := range headers {
+		// the rules see the first value of every header
+		var value string
+		if values := r.Header[name]; len(values) > 0 {
+			value = values[0]
+		}
+		parts = append(parts, name+"="+value)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// Authenticate does nothing, as CELBackend does not authenticate users.
+func (backend *CELBackend) Authenticate(ctx context.Context, r *http.Request) (*Identity, error) {
+	return nil, nil
+}
+
+// Authorize returns nothing, as CELBackend decides requests itself.
+func (backend *CELBackend) Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error) {
+	return nil, nil
+}
+
+// Login is not supported by CELBackend.
+func (backend *CELBackend) Login(w http.ResponseWriter, r *http.Request, realm string) (bool, int, error) {
+	return false, 0, nil
+}
+
+// Name returns the name of the backend.
+func (backend *CELBackend) Name() string {
+	if backend.CustomName != "" {
+		return fmt.Sprintf("%s:%s", BackendPolicyName, backend.CustomName)
+	}
+	return BackendPolicyName
+}
+
+// RunTests runs the test cases of a policy file and returns all failures.
+func (backend *CELBackend) RunTests(tests []*CELTest) []error {
+	var failures []error
+	for i, test := range tests {
+		err := backend.runTest(test)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("test %d (%s %s as %q): %s", i+1, test.Method, test.Path, test.User, err))
+		}
+	}
+	return failures
+}
+
+func (backend *CELBackend) runTest(test *CELTest) error {
+	r, err := NewSimulationRequest(context.Background(), &SimulationCase{
+		Method:  test.Method,
+		Path:    test.Path,
+		Headers: test.Headers,
+	})
+	if err != nil {
+		return err
+	}
+
+	var identity *Identity
+	if test.User != "" {
+		identity = NewIdentity(test.User, SimulationSource)
+		identity.Groups = test.Groups
+		identity.Attributes = test.Attributes
+	}
+
+	now := time.Now()
+	if test.Time != "" {
+		now, err = time.Parse(time.RFC3339, test.Time)
+		if err != nil {
+			return err
+		}
+	}
+
+	rule, err := backend.evaluate(r, identity, strings.ToUpper(r.Method), test.Path, now)
+	if err != nil {
+		return err
+	}
+	outcome := expectNone
+	if rule != nil {
+		outcome = rule.Effect
+	}
+	if outcome != test.Expect {
+		if rule != nil {
+			return fmt.Errorf("expected %s, got %s by rule %s", test.Expect, outcome, rule.Name)
+		}
+		return fmt.Errorf("expected %s, but no rule matched", test.Expect)
+	}
+	return nil
+}
+
+func init() {
+	RegisterBackendV2(BackendPolicyName, NewCELBackend)
+}
+
+// NewCELBackend creates a new CELBackend. The rules are compiled and the tests of the policy file are run.
+func NewCELBackend(c *caddy.Controller, now int64) (BackendV2, error) {
+
+	new := &CELBackend{
+		cache: make(map[string]*celCacheEntry),
+	}
+
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return nil, c.ArgErr()
+	}
+	new.File = args[0]
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "name":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.CustomName = c.Val()
+		case "cache":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			seconds, err := strconv.Atoi(c.Val())
+			if err != nil || seconds < 0 {
+				return nil, c.ArgErr()
+			}
+			new.CacheTime = time.Duration(seconds) * time.Second
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	data, err := ioutil.ReadFile(new.File)
+	if err != nil {
+		return nil, c.Errf("failed to load policy file of %s: %s", new.Name(), err)
+	}
+	tests, err := new.load(data)
+	if err != nil {
+		return nil, c.Errf("invalid policy file of %s: %s", new.Name(), err)
+	}
+	failures := new.RunTests(tests)
+	if len(failures) > 0 {
+		messages := make([]string, 0, len(failures))
+		for _, failure := range failures {
+			messages = append(messages, failure.Error())
+		}
+		return nil, c.Errf("policy tests of %s failed:\n%s", new.Name(), strings.Join(messages, "\n"))
+	}
+
+	return new, nil
+}
+
+// load parses and compiles a policy file and returns its tests.
+func (backend *CELBackend) load(data []byte) ([]*CELTest, error) {
+	file := &celPolicyFile{}
+	err := yaml.UnmarshalStrict(data, file)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+
+	env, err := newCELEnv()
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range file.Rules {
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i + 1)
+		}
+		err = rule.compile(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, test := range file.Tests {
+		test.Method = strings.ToUpper(test.Method)
+		switch test.Expect {
+		case EffectAllow, EffectDeny, expectNone:
+		default:
+			return nil, fmt.Errorf("expect of tests must be %s, %s or %s", EffectAllow, EffectDeny, expectNone)
+		}
+	}
+
+	usage := &celUsage{headers: make(map[string]bool)}
+	for _, rule := range file.Rules {
+		usage.add(rule.ast.Expr())
+	}
+
+	backend.Rules = file.Rules
+	backend.usage = usage
+	return file.Tests, nil
+}
@@ -0,0 +1,225 @@
+package permission
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+const testPolicyFile = `
+rules:
+  - name: team-delete-on-weekdays
+    effect: allow
+    condition: >
+      method == "DELETE" &&
+      path.startsWith("/teams/" + identity.attributes["team"] + "/") &&
+      now.getDayOfWeek("UTC") >= 1 && now.getDayOfWeek("UTC") <= 5
+  - name: no-delete
+    effect: deny
+    condition: method == "DELETE"
+  - name: staff-read
+    effect: allow
+    condition: '"staff" in identity.groups && method in ["GET", "HEAD"]'
+tests:
+  - user: greg
+    attributes: {team: blue}
+    method: DELETE
+    path: /teams/blue/item
+    time: 2019-07-01T12:00:00Z # Monday
+    expect: allow
+  - user: greg
+    attributes: {team: blue}
+    method: DELETE
+    path: /teams/blue/item
+    time: 2019-07-06T12:00:00Z # Saturday
+    expect: deny
+  - user: greg
+    attributes: {team: blue}
+    method: DELETE
+    path: /teams/red/item
+    time: 2019-07-01T12:00:00Z
+    expect: deny
+  - method: GET
+    path: /teams/blue/item
+    expect: none
+`
+
+func writeTestPolicy(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "caddy-permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyFile := filepath.Join(dir, "policy.yml")
+	err = ioutil.WriteFile(policyFile, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policyFile, func() { os.RemoveAll(dir) }
+}
+
+func TestCELBackend(t *testing.T) {
+	policyFile, cleanup := writeTestPolicy(t, testPolicyFile)
+	defer cleanup()
+
+	handler, next := newTestHandler(t, `
+	permission policy `+policyFile+` {
+		cache 60
+	}
+	permission basic {
+		public
+		ro /
+	}`)
+
+	weekday := time.Now().UTC().Weekday()
+	tests := []struct {
+		identity *Identity
+		method   string
+		path     string
+		allowed  bool
+		rule     string
+	}{
+		{&Identity{Username: "greg", Attributes: map[string]string{"team": "blue"}}, "DELETE", "/teams/blue/item", weekday >= time.Monday && weekday <= time.Friday, ""},
+		{&Identity{Username: "greg", Attributes: map[string]string{"team": "blue"}}, "DELETE", "/teams/red/item", false, "no-delete"},
+		{&Identity{Username: "greg", Groups: []string{"staff"}}, "GET", "/teams/red/item", true, "staff-read"},
+		{nil, "GET", "/teams/red/item", true, ""}, // public permit of basic
+		{nil, "DELETE", "/teams/red/item", false, "no-delete"},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 2; i++ { // second round comes from the cache, if the rules allow caching
+			r := httptest.NewRequest(test.method, test.path, nil)
+			decision, err := handler.Decide(r.Context(), r, test.identity)
+			if err != nil {
+				t.Fatalf("failed to decide: %s", err)
+			}
+			if decision.Allowed != test.allowed {
+				t.Errorf("%s %s: expected allowed=%v", test.method, test.path, test.allowed)
+			}
+			if test.rule != "" && (decision.Rule == nil || decision.Rule.Name != test.rule || decision.PermitType != PermitTypePolicy) {
+				t.Errorf("%s %s: expected decision by rule %s, got %+v", test.method, test.path, test.rule, decision.Rule)
+			}
+		}
+	}
+
+	// decisions of the policy backend are forwarded like all others
+	next.request = nil
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if next.request == nil {
+		t.Error("public request was not forwarded")
+	}
+}
+
+func TestCELBackendTests(t *testing.T) {
+	policyFile, cleanup := writeTestPolicy(t, strings.Replace(testPolicyFile, "path: /teams/red/item\n    time: 2019-07-01T12:00:00Z\n    expect: deny", "path: /teams/red/item\n    time: 2019-07-01T12:00:00Z\n    expect: allow", 1))
+	defer cleanup()
+
+	_, err := NewHandler(caddy.NewTestController("http", "permission policy "+policyFile), 0)
+	if err == nil || !strings.Contains(err.Error(), "test 3") {
+		t.Errorf("expected failing policy test 3, got %v", err)
+	}
+
+	policyFile, cleanup = writeTestPolicy(t, "rules:\n  - name: broken\n    effect: allow\n    condition: method ==\n")
+	defer cleanup()
+	_, err = NewHandler(caddy.NewTestController("http", "permission policy "+policyFile), 0)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected compile error of rule broken, got %v", err)
+	}
+}
+
+func TestCELCache(t *testing.T) {
+	env, err := newCELEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for condition, expected := range map[string]celUsage{
+		`method == "GET" && request.host == "example.com"`:         {},
+		`request.headers["X-Tenant"] == "acme"`:                    {headers: map[string]bool{"X-Tenant": true}},
+		`request["headers"]["X-Tenant"] == "acme"`:                 {headers: map[string]bool{"X-Tenant": true}},
+		`now.getDayOfWeek("UTC") == 1`:                             {now: true},
+		`"X-Tenant" in request.headers`:                            {allHeaders: true},
+		`request.headers[identity.attributes["header"]] == "acme"`: {allHeaders: true},
+		`request.headers.exists(name, name == "X-Tenant")`:         {allHeaders: true},
+		`request.size() > 0`:                                       {allHeaders: true},
+	} {
+		rule := &CELRule{Name: "test", Effect: EffectAllow, Condition: condition}
+		err := rule.compile(env)
+		if err != nil {
+			t.Fatalf("%s: %s", condition, err)
+		}
+		usage := &celUsage{headers: make(map[string]bool)}
+		usage.add(rule.ast.Expr())
+		if usage.now != expected.now || usage.allHeaders != expected.allHeaders || len(usage.headers) != len(expected.headers) {
+			t.Errorf("%s: unexpected usage %+v", condition, usage)
+		}
+		for name := range expected.headers {
+			if !usage.headers[name] {
+				t.Errorf("%s: expected header %s to be used", condition, name)
+			}
+		}
+	}
+
+	// decisions that depend on headers are cached per header value
+	policyFile, cleanup := writeTestPolicy(t, `
+rules:
+  - name: acme
+    effect: allow
+    condition: request.headers["X-Tenant"] == "acme"
+`)
+	defer cleanup()
+	handler, _ := newTestHandler(t, `
+	permission policy `+policyFile+` {
+		cache 60
+	}`)
+	for _, tenant := range []string{"acme", "other", "acme"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Tenant", tenant)
+		decision, _ := handler.Decide(r.Context(), r, nil)
+		if decision.Allowed != (tenant == "acme") {
+			t.Errorf("tenant %s: unexpected decision allowed=%v", tenant, decision.Allowed)
+		}
+	}
+	backend := unwrapBackend(handler.Backends[0]).(*CELBackend)
+	if len(backend.cache) != 2 {
+		t.Errorf("expected 2 cached decisions, got %d", len(backend.cache))
+	}
+
+	// decisions that depend on the time are not cached
+	backend.usage.now = true
+	r := httptest.NewRequest("GET", "/", nil)
+	handler.Decide(r.Context(), r, &Identity{Username: "greg"})
+	if len(backend.cache) != 2 {
+		t.Errorf("expected decision depending on the time not to be cached, got %d", len(backend.cache))
+	}
+}
+
+func TestCELBackendError(t *testing.T) {
+	policyFile, cleanup := writeTestPolicy(t, `
+rules:
+  - name: blocked
+    effect: deny
+    condition: request.headers["X-Blocked"] == "yes"
+`)
+	defer cleanup()
+	handler, _ := newTestHandler(t, `
+	permission policy `+policyFile+`
+	permission basic {
+		public
+		ro /
+	}`)
+
+	// leaving out the header must not skip the deny rule
+	r := httptest.NewRequest("GET", "/", nil)
+	decision, err := handler.Decide(r.Context(), r, nil)
+	if err != nil {
+		t.Fatalf("failed to decide: %s", err)
+	}
+	if decision.Allowed || decision.BackendName() != BackendPolicyName {
+		t.Errorf("expected denial by the failing policy, got allowed=%v backend=%s", decision.Allowed, decision.BackendName())
+	}
+}
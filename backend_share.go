@@ -0,0 +1,345 @@
+package permission
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+// Query parameters of share links
+const (
+	ShareParamPrefix    = "p"
+	ShareParamMethods   = "m"
+	ShareParamExpires   = "exp"
+	ShareParamCreator   = "by"
+	ShareParamSignature = "sig"
+)
+
+const (
+	defaultShareTTL     = 7 * 24 * 3600
+	defaultShareMethods = "ro"
+)
+
+// ShareBackend grants access to requests with a signed, expiring share link. It does not authenticate.
+// Links grant their methods on their path prefix to everyone who has them, on top of the permits of the other backends.
+// Prefixes ending with a slash grant access to everything below them, other prefixes only to the path itself.
+// Share backends are consulted before all other backends, regardless of their order.
+type ShareBackend struct {
+	CustomName string
+	Secret     []byte
+	// Path is the path of the endpoint that mints links for authenticated users, if set.
+	Path       string
+	DefaultTTL int64
+	MaxTTL     int64
+}
+
+// ShareLink is a link minted by the share endpoint.
+type ShareLink struct {
+	URL     string
+	Expires int64
+}
+
+// sign returns the signature of a link. Every field is prefixed with its length, so that no field can extend into the next.
+func (backend *ShareBackend) sign(prefix, methods, expires, creator string) string {
+	mac := hmac.New(sha256.New, backend.Secret)
+	for _, field := range []string{prefix, methods, expires, creator} {
+		fmt.Fprintf(mac, "%d:%s", len(field), field)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hasControlChars returns whether s contains ASCII control characters, such as newlines.
+func hasControlChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// Link returns a signed link that grants methods on the path prefix until expires.
+func (backend *ShareBackend) Link(prefix, methods string, expires int64, creator string) string {
+	exp := strconv.FormatInt(expires, 10)
+	query := url.Values{}
+	query.Set(ShareParamPrefix, prefix)
+	query.Set(ShareParamMethods, methods)
+	query.Set(ShareParamExpires, exp)
+	if creator != "" {
+		query.Set(ShareParamCreator, creator)
+	}
+	query.Set(ShareParamSignature, backend.sign(prefix, methods, exp, creator))
+	return (&url.URL{Path: prefix, RawQuery: query.Encode()}).String()
+}
+
+// rule returns the rule of the share link of the request, or nil if there is no valid link.
+func (backend *ShareBackend) rule(r *http.Request) *Rule {
+	if r.URL == nil {
+		return nil
+	}
+	query := r.URL.Query()
+	signature := query.Get(ShareParamSignature)
+	if signature == "" {
+		return nil
+	}
+
+	prefix := query.Get(ShareParamPrefix)
+	methods := query.Get(ShareParamMethods)
+	exp := query.Get(ShareParamExpires)
+	creator := query.Get(ShareParamCreator)
+	if !hmac.Equal([]byte(signature), []byte(backend.sign(prefix, methods, exp, creator))) {
+		return nil
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || expires <= time.Now().Unix() {
+		return nil
+	}
+
+	rule, err := NewRule(methods, prefix)
+	if err != nil {
+		return nil
+	}
+	rule.Name = "share link"
+	if creator != "" {
+		rule.Name += " by " + creator
+	}
+	return rule
+}
+
+// Decide allows requests with a valid share link for the path and method. Other requests are left to the other backends.
+func (backend *ShareBackend) Decide(ctx context.Context, r *http.Request, identity *Identity, method, path string) (bool, *Rule, error) {
+	rule := backend.rule(r)
+	if rule == nil {
+		return false, nil, nil
+	}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if !rule.MatchesPath(path) || !rule.MatchesMethod(method) {
+		return false, nil, nil
+	}
+	if !strings.HasSuffix(rule.Path, "/") && path != rule.Path {
+		return false, nil, nil
+	}
+	return true, rule, nil
+}
+
+// EndpointPath returns the path of the endpoint that mints links.
+func (backend *ShareBackend) EndpointPath() string {
+	return backend.Path
+}
+
+// ServeEndpoint mints a share link. The form values are the path prefix ("path"), the methods ("methods", default "ro") and the validity in seconds ("ttl").
+// The user must have rw access to the path and access with all methods of the link.
+func (backend *ShareBackend) ServeEndpoint(w http.ResponseWriter, r *http.Request, handler *Handler, identity *Identity) (int, error) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+	if identity == nil {
+		if ok, code, err := handler.Login(w, r); ok {
+			return code, err
+		}
+		return http.StatusUnauthorized, nil
+	}
+
+	prefix := r.FormValue("path")
+	if !strings.HasPrefix(prefix, "/") || hasControlChars(prefix) {
+		return writeJSON(w, http.StatusBadRequest, &adminError{Error: "path must start with / and must not contain control characters"})
+	}
+	if hasControlChars(identity.Username) {
+		return writeJSON(w, http.StatusForbidden, &adminError{Error: "users with control characters in their name cannot share"})
+	}
+	methods := r.FormValue("methods")
+	if methods == "" {
+		methods = defaultShareMethods
+	}
+	rule, err := NewRule(methods, prefix)
+	if err != nil || rule.MethodsAreBlacklist || len(rule.Methods) == 0 {
+		return writeJSON(w, http.StatusBadRequest, &adminError{Error: "methods must be a list of methods, eg. ro or GET,HEAD"})
+	}
+	ttl := backend.DefaultTTL
+	if value := r.FormValue("ttl"); value != "" {
+		ttl, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || ttl <= 0 || ttl > backend.MaxTTL {
+			return writeJSON(w, http.StatusBadRequest, &adminError{Error: fmt.Sprintf("ttl must be between 1 and %d seconds", backend.MaxTTL)})
+		}
+	}
+
+	// the conditions of policy backends cannot be checked for every path below a prefix, so only single paths may be shared
+	if strings.HasSuffix(prefix, "/") && handler.hasDeciders() {
+		return writeJSON(w, http.StatusForbidden, &adminError{Error: "folders cannot be shared together with policy backends"})
+	}
+
+	// users may only share what they can change, and never more than they have: this includes every path below the
+	// prefix that has a rule of its own, eg. a denied subfolder.
+	// The request is checked without its query, so that share links cannot be used to mint new ones.
+	checked := r.WithContext(r.Context())
+	checked.URL = &url.URL{Path: r.URL.Path}
+	paths, err := sharedPaths(r.Context(), checked, handler, identity, prefix)
+	if err != nil {
+		if printError || printDebug {
+			fmt.Printf("[permission] failed to get permits of %s to share %s: %s\n", identity.Username, prefix, err)
+		}
+		return writeJSON(w, http.StatusBadGateway, &adminError{Error: "failed to get permits"})
+	}
+	required := append(append([]string{}, aliases["rw"]...), rule.Methods...)
+	for _, path := range paths {
+		for _, method := range required {
+			decision := handler.CheckPermits(r.Context(), checked, identity, method, path, MethodIsRo(method))
+			if !decision.Allowed {
+				return writeJSON(w, http.StatusForbidden, &adminError{Error: fmt.Sprintf("%s on %s is not allowed", method, path)})
+			}
+		}
+	}
+
+	expires := time.Now().Unix() + ttl
+	return writeJSON(w, http.StatusOK, &ShareLink{
+		URL:     backend.Link(prefix, methods, expires, identity.Username),
+		Expires: expires,
+	})
+}
+
+// hasDeciders returns whether any backend other than share backends decides requests itself.
+func (handler *Handler) hasDeciders() bool {
+	for _, backend := range handler.Backends {
+		decider, ok := unwrapBackend(backend).(Decider)
+		if _, share := decider.(*ShareBackend); ok && !share {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedPaths returns the prefix and the paths below it that have rules in the permits of the user.
+func sharedPaths(ctx context.Context, r *http.Request, handler *Handler, identity *Identity, prefix string) ([]string, error) {
+	paths := []string{prefix}
+	if !strings.HasSuffix(prefix, "/") {
+		return paths, nil
+	}
+	seen := map[string]bool{prefix: true}
+	for _, backend := range handler.Backends {
+		if _, ok := unwrapBackend(backend).(Decider); ok {
+			continue
+		}
+		for _, permitType := range []uint8{PermitTypeUser, PermitTypeDefault, PermitTypePublic} {
+			permitIdentity := identity
+			if permitType == PermitTypePublic {
+				permitIdentity = nil
+			}
+			permit, err := backend.Authorize(ctx, r, permitIdentity, permitType)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", backend.Name(), err)
+			}
+			if permit == nil {
+				continue
+			}
+			for _, rule := range permit.Rules {
+				if strings.HasPrefix(rule.Path, prefix) && !seen[rule.Path] {
+					seen[rule.Path] = true
+					paths = append(paths, rule.Path)
+				}
+			}
+		}
+	}
+	return paths, nil
+}
+
+// Authenticate does nothing, share links do not identify users.
+func (backend *ShareBackend) Authenticate(ctx context.Context, r *http.Request) (*Identity, error) {
+	return nil, nil
+}
+
+// Authorize does nothing, share links are checked by Decide.
+func (backend *ShareBackend) Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error) {
+	return nil, nil
+}
+
+// Login is not supported.
+func (backend *ShareBackend) Login(w http.ResponseWriter, r *http.Request, realm string) (bool, int, error) {
+	return false, 0, nil
+}
+
+// Name returns the name of the backend.
+func (backend *ShareBackend) Name() string {
+	if backend.CustomName != "" {
+		return fmt.Sprintf("%s:%s", BackendShareName, backend.CustomName)
+	}
+	return BackendShareName
+}
+
+func init() {
+	RegisterBackendV2(BackendShareName, NewShareBackend)
+}
+
+// NewShareBackend creates a new ShareBackend.
+func NewShareBackend(c *caddy.Controller, now int64) (BackendV2, error) {
+
+	new := &ShareBackend{
+		DefaultTTL: defaultShareTTL,
+		MaxTTL:     defaultShareTTL,
+	}
+
+	args := c.RemainingArgs()
+	if len(args) != 0 {
+		return nil, c.ArgErr()
+	}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "name":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.CustomName = c.Val()
+		case "secret":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.Secret = []byte(c.Val())
+		case "endpoint":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.Path = c.Val()
+			if !strings.HasPrefix(new.Path, "/") {
+				return nil, c.Errf("endpoint of %s must start with /", new.Name())
+			}
+		case "ttl", "max_ttl":
+			option := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			i, err := strconv.ParseInt(c.Val(), 10, 64)
+			if err != nil || i <= 0 {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "ttl":
+				new.DefaultTTL = i
+			case "max_ttl":
+				new.MaxTTL = i
+			}
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	if len(new.Secret) < 16 {
+		return nil, c.Errf("%s requires a secret of at least 16 characters", new.Name())
+	}
+	if new.DefaultTTL > new.MaxTTL {
+		new.DefaultTTL = new.MaxTTL
+	}
+
+	return new, nil
+}
@@ -0,0 +1,191 @@
+package permission
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareLinks(t *testing.T) {
+	// share links are verified first, although the backend is declared last
+	handler, next := newTestHandler(t, `
+	permission basic {
+		user greg qwerty1
+		none /files/greg/private/
+		rw /files/greg/
+		ro /files/
+		user george qwerty2
+		none /files/
+	}
+	permission share {
+		secret 0123456789abcdef
+		endpoint /.share
+		max_ttl 3600
+	}`)
+	backend := unwrapBackend(handler.Backends[1]).(*ShareBackend)
+
+	mint := func(form url.Values) (int, *ShareLink) {
+		r := httptest.NewRequest("POST", "/.share", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("greg", "qwerty1")
+		w := httptest.NewRecorder()
+		status, _ := handler.ServeHTTP(w, r)
+		if status == 0 {
+			status = w.Code
+		}
+		link := &ShareLink{}
+		json.Unmarshal(w.Body.Bytes(), link)
+		return status, link
+	}
+	allowed := func(method, target string) bool {
+		next.request = nil
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, nil))
+		return next.request != nil
+	}
+	allowedFor := func(username, password, target string) bool {
+		next.request = nil
+		r := httptest.NewRequest("GET", target, nil)
+		r.SetBasicAuth(username, password)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return next.request != nil
+	}
+
+	// only paths with rw access can be shared
+	if status, _ := mint(url.Values{"path": {"/files/other/"}}); status != http.StatusForbidden {
+		t.Errorf("expected sharing read-only path to fail, got %d", status)
+	}
+	if status, _ := mint(url.Values{"path": {"/files/greg/"}, "ttl": {"7200"}}); status != http.StatusBadRequest {
+		t.Errorf("expected ttl above max_ttl to fail, got %d", status)
+	}
+	// folders with narrower rules below them cannot be shared
+	if status, _ := mint(url.Values{"path": {"/files/greg/"}}); status != http.StatusForbidden {
+		t.Errorf("expected sharing folder with denied subfolder to fail, got %d", status)
+	}
+	status, link := mint(url.Values{"path": {"/files/greg/holiday/"}, "methods": {"GET"}})
+	if status != http.StatusOK || link.URL == "" {
+		t.Fatalf("failed to mint link: %d", status)
+	}
+	if expires := link.Expires - time.Now().Unix(); expires < 3590 || expires > 3600 {
+		t.Errorf("expected link to expire after max_ttl, expires in %d", expires)
+	}
+
+	// anonymous request must be logged in to mint links
+	w := httptest.NewRecorder()
+	status, _ = handler.ServeHTTP(w, httptest.NewRequest("POST", "/.share", nil))
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected anonymous request to be asked to login, got %d", status)
+	}
+
+	query := link.URL[strings.Index(link.URL, "?"):]
+	for _, test := range []struct {
+		method  string
+		target  string
+		allowed bool
+	}{
+		{"GET", link.URL, true},
+		{"GET", "/files/greg/holiday/beach.jpg" + query, true},
+		{"HEAD", "/files/greg/holiday/beach.jpg" + query, false},
+		{"PUT", "/files/greg/holiday/beach.jpg" + query, false},
+		{"GET", "/files/greg/work/report.pdf" + query, false},
+		{"GET", "/files/greg/holiday/beach.jpg", false},
+		{"GET", "/files/greg/holiday/beach.jpg" + strings.Replace(query, "m=GET", "m=rw", 1), false},
+		{"GET", "/files/greg/" + strings.Replace(query, "p=%2Ffiles%2Fgreg%2Fholiday%2F", "p=%2Ffiles%2Fgreg%2F", 1), false},
+	} {
+		if allowed(test.method, test.target) != test.allowed {
+			t.Errorf("%s %s: expected allowed=%v", test.method, test.target, test.allowed)
+		}
+	}
+
+	// signatures of links are not logged
+	buf := &bytes.Buffer{}
+	handler.Audit = &AuditLog{SampleRate: 1, SecretParams: handler.secretParams(), writer: buf}
+	allowed("GET", link.URL)
+	if strings.Contains(buf.String(), link.URL[strings.Index(link.URL, "sig=")+4:]) || !strings.Contains(buf.String(), "sig=REDACTED") {
+		t.Errorf("expected signature to be redacted in the audit log: %s", buf.String())
+	}
+	handler.Audit = nil
+
+	// links also grant access to users whose permits deny it
+	if !allowedFor("george", "qwerty2", "/files/greg/holiday/beach.jpg"+query) {
+		t.Error("expected share link to be verified before the permits")
+	}
+
+	// prefixes without a trailing slash only share the path itself
+	status, link = mint(url.Values{"path": {"/files/greg/report"}})
+	if status != http.StatusOK {
+		t.Fatalf("failed to mint link: %d", status)
+	}
+	query = link.URL[strings.Index(link.URL, "?"):]
+	if !allowed("GET", link.URL) || allowed("GET", "/files/greg/report-other"+query) || allowed("GET", "/files/greg/report/file"+query) {
+		t.Error("expected link without trailing slash to only share the path itself")
+	}
+
+	// fields of the signature cannot extend into each other
+	if status, _ := mint(url.Values{"path": {"/files/greg/holiday/\nany\n99999999999\ngreg"}, "methods": {"GET"}}); status != http.StatusBadRequest {
+		t.Errorf("expected path with newlines to be rejected, got %d", status)
+	}
+	forged := url.Values{}
+	forged.Set(ShareParamPrefix, "/files/greg/")
+	forged.Set(ShareParamMethods, "any")
+	forged.Set(ShareParamExpires, "99999999999")
+	forged.Set(ShareParamCreator, "greg\nGET\n"+strconv.FormatInt(time.Now().Unix()+60, 10)+"\ngreg")
+	forged.Set(ShareParamSignature, backend.sign("/files/greg/\nany\n99999999999\ngreg", "GET", strconv.FormatInt(time.Now().Unix()+60, 10), "greg"))
+	if allowed("GET", "/files/greg/private/file?"+forged.Encode()) {
+		t.Error("forged link was accepted")
+	}
+
+	// expired links are rejected
+	expired := backend.Link("/files/greg/", "ro", time.Now().Unix()-1, "greg")
+	if allowed("GET", expired) {
+		t.Error("expired link was accepted")
+	}
+}
+
+func TestShareLinksWithPolicy(t *testing.T) {
+	policyFile, cleanup := writeTestPolicy(t, `
+rules:
+  - name: private
+    effect: deny
+    condition: path.startsWith("/docs/private/")
+`)
+	defer cleanup()
+	handler, _ := newTestHandler(t, `
+	permission policy `+policyFile+`
+	permission basic {
+		user greg qwerty1
+		rw /docs/
+	}
+	permission share {
+		secret 0123456789abcdef
+		endpoint /.share
+	}`)
+
+	mint := func(path string) int {
+		r := httptest.NewRequest("POST", "/.share", strings.NewReader(url.Values{"path": {path}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("greg", "qwerty1")
+		w := httptest.NewRecorder()
+		status, _ := handler.ServeHTTP(w, r)
+		if status == 0 {
+			status = w.Code
+		}
+		return status
+	}
+
+	// the policy cannot be checked for every path below the folder
+	if status := mint("/docs/"); status != http.StatusForbidden {
+		t.Errorf("expected sharing folder with policy backend to fail, got %d", status)
+	}
+	if status := mint("/docs/private/secret.txt"); status != http.StatusForbidden {
+		t.Errorf("expected sharing path denied by policy to fail, got %d", status)
+	}
+	if status := mint("/docs/report.pdf"); status != http.StatusOK {
+		t.Errorf("expected sharing single path to succeed, got %d", status)
+	}
+}
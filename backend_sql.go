@@ -0,0 +1,468 @@
+package permission
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"golang.org/x/crypto/bcrypt"
+
+	// database drivers
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// Default queries of the SQL backend. The placeholder is replaced with $1 for postgres.
+const (
+	defaultSQLUserQuery  = "SELECT password_hash FROM users WHERE username = ?"
+	defaultSQLRulesQuery = "SELECT methods, path FROM rules WHERE username = ? ORDER BY length(path) DESC"
+	// defaultSQLDefaultRulesQuery gets "default" or "public". They come from their own table, so that no account can provide or change them.
+	defaultSQLDefaultRulesQuery = "SELECT methods, path FROM default_rules WHERE permit = ? ORDER BY length(path) DESC"
+)
+
+// SQLBackend authenticates users and gets permits from a SQL database.
+type SQLBackend struct {
+	CustomName string
+
+	Driver            string
+	DataSource        string
+	UserQuery         string
+	RulesQuery        string
+	DefaultRulesQuery string
+
+	CacheTime int64
+	Cleanup   int64
+	Timeout   int64
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime int64
+
+	DB *sql.DB
+
+	// Store caches verified credentials, as bcrypt is slow by design, and permits.
+	Store     CacheStore
+	StoreType string
+	StoreArgs []string
+	// CacheSecret keys the hashes of credentials in the cache, so that a copy of the cache does not help to guess passwords.
+	// Random, unless configured, so that instances sharing a store only share permits.
+	CacheSecret []byte
+
+	stop chan struct{}
+}
+
+// Authenticate authenticates users with a password via HTTP Basic Authentication.
+func (backend *SQLBackend) Authenticate(ctx context.Context, r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok || reservedSQLUsername(username) {
+		return nil, nil
+	}
+	if backend.DB == nil || isSimulation(ctx) {
+		return nil, errNotStarted
+	}
+
+	// the key is a keyed hash, so that passwords are not kept in the cache
+	mac := hmac.New(sha256.New, backend.CacheSecret)
+	mac.Write([]byte(username + ":" + password))
+	key := "auth=" + hex.EncodeToString(mac.Sum(nil))
+	user, err := backend.Store.User(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if user != nil && user.Username == username && user.ValidUntil > time.Now().Unix() {
+		countCache(backend.Name(), "users", cacheHit, 1)
+		return user.Identity(backend.Name()), nil
+	}
+	countCache(backend.Name(), "users", cacheMiss, 1)
+
+	ctx, cancel := backend.context(ctx)
+	defer cancel()
+	passwordHash, user, err := backend.queryUser(ctx, username)
+	if user == nil || err != nil {
+		return nil, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	if err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	err = backend.Store.SetUser(key, user)
+	if err != nil {
+		return nil, err
+	}
+	return user.Identity(backend.Name()), nil
+}
+
+// Authorize returns the permit of the given type. Default and public permits are the rules of the default rules query.
+// Users of other backends without rules have no user permit, so that the default rules only apply to users of the database.
+func (backend *SQLBackend) Authorize(ctx context.Context, r *http.Request, identity *Identity, permitType uint8) (*Permit, error) {
+	if backend.DB == nil || isSimulation(ctx) {
+		return nil, errNotStarted
+	}
+	switch permitType {
+	case PermitTypeUser:
+		if reservedSQLUsername(identity.Username) {
+			return nil, nil
+		}
+		permit, err := backend.getPermit(ctx, identity.Username, backend.RulesQuery)
+		if err != nil || identity.Source == backend.Name() || len(permit.Rules) > 0 {
+			return permit, err
+		}
+		return nil, nil
+	case PermitTypeDefault:
+		return backend.getPermit(ctx, DefaultIdentifier, backend.DefaultRulesQuery)
+	case PermitTypePublic:
+		return backend.getPermit(ctx, PublicIdentifier, backend.DefaultRulesQuery)
+	}
+	return nil, nil
+}
+
+// reservedSQLUsername returns whether the username is the name of the default or public permit, which are no accounts.
+func reservedSQLUsername(username string) bool {
+	return username == DefaultIdentifier || username == PublicIdentifier
+}
+
+// getPermit returns the cached permit or loads it from the database with the query.
+func (backend *SQLBackend) getPermit(ctx context.Context, username, query string) (*Permit, error) {
+
+	permit, err := backend.Store.Permit(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if permit != nil && permit.ValidUntil > time.Now().Unix() {
+		countCache(backend.Name(), "permits", cacheHit, 1)
+		return permit, nil
+	}
+	countCache(backend.Name(), "permits", cacheMiss, 1)
+
+	ctx, cancel := backend.context(ctx)
+	defer cancel()
+	permit, err = backend.queryPermit(ctx, username, query)
+	if err != nil {
+		return nil, err
+	}
+
+	err = backend.Store.SetPermit(username, permit)
+	if err != nil {
+		return nil, err
+	}
+	return permit, nil
+}
+
+// queryUser returns the password hash and the user, if the user exists.
+// The first column of the user query is the password hash, the optional columns "groups" (comma separated), "display_name" and "email" are added to the user.
+func (backend *SQLBackend) queryUser(ctx context.Context, username string) (string, *User, error) {
+	rows, err := backend.DB.QueryContext(ctx, backend.UserQuery, username)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to query user: %s", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", nil, err
+	}
+	if !rows.Next() {
+		return "", nil, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	err = rows.Scan(pointers...)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read user: %s", err)
+	}
+	if !values[0].Valid || values[0].String == "" {
+		return "", nil, nil
+	}
+
+	user := NewUser(username, backend.CacheTime)
+	for i, column := range columns[1:] {
+		value := values[i+1].String
+		switch strings.ToLower(column) {
+		case "groups":
+			for _, group := range strings.Split(value, ",") {
+				if group = strings.TrimSpace(group); group != "" {
+					user.Groups = append(user.Groups, group)
+				}
+			}
+		case "display_name":
+			user.DisplayName = value
+		case "email":
+			user.Email = value
+		}
+	}
+	return values[0].String, user, nil
+}
+
+// queryPermit loads the rules of a user with the query, which returns the methods and the path of every rule, in order of evaluation.
+func (backend *SQLBackend) queryPermit(ctx context.Context, username, query string) (*Permit, error) {
+	rows, err := backend.DB.QueryContext(ctx, query, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rules: %s", err)
+	}
+	defer rows.Close()
+
+	permit := NewPermit(backend.CacheTime, 0)
+	for rows.Next() {
+		var methods, path string
+		err = rows.Scan(&methods, &path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rule: %s", err)
+		}
+		err = permit.AddRule(methods, path)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse permission of %s: %s", username, err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	permit.Finalize()
+	return permit, nil
+}
+
+// context returns a context that is cancelled after the configured timeout.
+func (backend *SQLBackend) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if backend.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(backend.Timeout)*time.Second)
+}
+
+// Login asks for HTTP Basic Authentication.
+func (backend *SQLBackend) Login(w http.ResponseWriter, r *http.Request, realm string) (bool, int, error) {
+	if realm == "" {
+		realm = "Restricted"
+	}
+	w.Header().Set("WWW-Authenticate", "Basic realm=\""+realm+"\"")
+	return true, http.StatusUnauthorized, nil
+}
+
+// Name returns the name of the backend.
+func (backend *SQLBackend) Name() string {
+	if backend.CustomName != "" {
+		return fmt.Sprintf("%s:%s", BackendSQLName, backend.CustomName)
+	}
+	return BackendSQLName
+}
+
+// Revoke removes the cached credentials and permit of a user, so that the next request is checked against the database again.
+// With a shared store, this applies to all nodes.
+func (backend *SQLBackend) Revoke(ctx context.Context, r *http.Request, username string) error {
+	return backend.Store.Invalidate(username)
+}
+
+// Cleaner periodically cleans up the SQLBackend until stop is closed.
+func (backend *SQLBackend) Cleaner(stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(backend.Cleanup) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			backend.clean(now.Unix())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// clean deletes all timed-out users and permits.
+func (backend *SQLBackend) clean(nowUnix int64) {
+	evictedUsers, evictedPermits := backend.Store.Clean(nowUnix)
+	countCache(backend.Name(), "users", cacheEviction, evictedUsers)
+	countCache(backend.Name(), "permits", cacheEviction, evictedPermits)
+}
+
+// Start opens the database and the cache store, if it is shared, and starts the cleaner.
+func (backend *SQLBackend) Start() error {
+	db, err := sql.Open(backend.Driver, backend.DataSource)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	db.SetMaxOpenConns(backend.MaxOpenConns)
+	db.SetMaxIdleConns(backend.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(backend.ConnMaxLifetime) * time.Second)
+	backend.DB = db
+
+	if backend.Store == nil {
+		store, err := NewCacheStore(backend.StoreType, backend.StoreArgs, "caddy-permission:"+backend.Name()+":")
+		if err != nil {
+			return err
+		}
+		backend.Store = store
+	}
+	backend.stop = make(chan struct{})
+	go backend.Cleaner(backend.stop)
+	return nil
+}
+
+// Close stops the cleaner and closes the cache store and the database connections.
+func (backend *SQLBackend) Close() error {
+	if backend.stop != nil {
+		close(backend.stop)
+		backend.stop = nil
+	}
+	if backend.Store != nil {
+		backend.Store.Close()
+	}
+	if backend.DB == nil {
+		return nil
+	}
+	err := backend.DB.Close()
+	backend.DB = nil
+	return err
+}
+
+func init() {
+	RegisterBackendV2(BackendSQLName, NewSQLBackend)
+}
+
+// NewSQLBackend creates a new SQLBackend.
+func NewSQLBackend(c *caddy.Controller, now int64) (BackendV2, error) {
+
+	new := &SQLBackend{
+		CacheTime:       60,
+		Cleanup:         3600,
+		Timeout:         10,
+		MaxOpenConns:    10,
+		MaxIdleConns:    2,
+		ConnMaxLifetime: 300,
+		StoreType:       StoreMemory,
+	}
+
+	args := c.RemainingArgs()
+	if len(args) != 2 {
+		return nil, c.ArgErr()
+	}
+	new.Driver = args[0]
+	new.DataSource = args[1]
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "name":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.CustomName = c.Val()
+		case "user_query":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.UserQuery = c.Val()
+		case "rules_query":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.RulesQuery = c.Val()
+		case "default_rules_query":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.DefaultRulesQuery = c.Val()
+		case "cache_secret":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.CacheSecret = []byte(c.Val())
+			if len(new.CacheSecret) < 16 {
+				return nil, c.Errf("cache_secret of %s must have at least 16 characters", new.Name())
+			}
+		case "store":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			new.StoreType = args[0]
+			new.StoreArgs = args[1:]
+		case "cache", "cleanup", "timeout", "max_open_conns", "max_idle_conns", "conn_max_lifetime":
+			option := c.Val()
+			// require argument
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			// parse integer
+			i, err := strconv.ParseInt(c.Val(), 10, 64)
+			if err != nil || i < 0 {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "cache":
+				new.CacheTime = i
+			case "cleanup":
+				if i == 0 {
+					return nil, c.ArgErr()
+				}
+				new.Cleanup = i
+			case "timeout":
+				new.Timeout = i
+			case "max_open_conns":
+				new.MaxOpenConns = int(i)
+			case "max_idle_conns":
+				new.MaxIdleConns = int(i)
+			case "conn_max_lifetime":
+				new.ConnMaxLifetime = i
+			}
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	if new.UserQuery == "" {
+		new.UserQuery = defaultSQLQuery(new.Driver, defaultSQLUserQuery)
+	}
+	if new.RulesQuery == "" {
+		new.RulesQuery = defaultSQLQuery(new.Driver, defaultSQLRulesQuery)
+	}
+	if new.DefaultRulesQuery == "" {
+		new.DefaultRulesQuery = defaultSQLQuery(new.Driver, defaultSQLDefaultRulesQuery)
+	}
+
+	if new.CacheSecret == nil {
+		new.CacheSecret = make([]byte, 32)
+		_, err := rand.Read(new.CacheSecret)
+		if err != nil {
+			return nil, c.Errf("failed to generate cache secret of %s: %s", new.Name(), err)
+		}
+	}
+
+	// shared stores are opened when the backend starts
+	err := checkCacheStore(new.StoreType, new.StoreArgs)
+	if err != nil {
+		return nil, c.Errf("store of %s: %s", new.Name(), err)
+	}
+	if new.StoreType == StoreMemory {
+		new.Store = NewMemoryStore()
+	}
+
+	// the database is opened when the backend starts
+	if !inList(new.Driver, sql.Drivers()) {
+		return nil, c.Errf("unknown database driver %s of %s", new.Driver, new.Name())
+	}
+
+	return new, nil
+}
+
+// defaultSQLQuery adapts a default query to the placeholder syntax of the driver.
+func defaultSQLQuery(driver, query string) string {
+	if driver == "postgres" {
+		return strings.Replace(query, "?", "$1", 1)
+	}
+	return query
+}
@@ -0,0 +1,149 @@
+package permission
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSQLBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "users.db")
+
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hash, err := bcrypt.GenerateFromPassword([]byte("qwerty1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		"CREATE TABLE users (username TEXT PRIMARY KEY, password_hash TEXT, groups TEXT, email TEXT)",
+		"CREATE TABLE rules (username TEXT, methods TEXT, path TEXT)",
+		"CREATE TABLE default_rules (permit TEXT, methods TEXT, path TEXT)",
+		"INSERT INTO users VALUES ('greg', '" + string(hash) + "', 'staff, ops', 'greg@example.com'), ('public', '" + string(hash) + "', '', '')",
+		"INSERT INTO rules VALUES ('greg', 'rw', '/tmp/'), ('greg', 'none', '/tmp/secret/'), ('public', 'rw', '/')",
+		"INSERT INTO default_rules VALUES ('default', 'ro', '/shared/'), ('public', 'ro', '/static/')",
+	} {
+		_, err = db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler, next := newTestHandler(t, `
+	permission sql sqlite3 `+dbFile+` {
+		user_query "SELECT password_hash, groups, email FROM users WHERE username = ?"
+		cache 60
+	}`)
+	err = handler.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	request := func(method, path, password string) bool {
+		next.request = nil
+		r := httptest.NewRequest(method, path, nil)
+		if password != "" {
+			r.SetBasicAuth("greg", password)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return next.request != nil
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		password string
+		allowed  bool
+	}{
+		{"PUT", "/tmp/file", "qwerty1", true},
+		{"GET", "/tmp/secret/file", "qwerty1", false},
+		{"GET", "/shared/file", "qwerty1", true},
+		{"PUT", "/shared/file", "qwerty1", false},
+		{"PUT", "/tmp/file", "wrong", false},
+		{"GET", "/static/file", "", true},
+		{"GET", "/tmp/file", "", false},
+		{"PUT", "/static/file", "", false}, // rules of the account "public" are ignored
+	}
+	for i := 0; i < 2; i++ { // second round is cached
+		for _, test := range tests {
+			if allowed := request(test.method, test.path, test.password); allowed != test.allowed {
+				t.Errorf("%s %s (password %q): expected allowed=%v", test.method, test.path, test.password, test.allowed)
+			}
+		}
+	}
+
+	// user attributes are read from additional columns
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	identity := handler.Authenticate(r.Context(), r)
+	if identity == nil {
+		t.Fatal("failed to authenticate")
+	}
+	if len(identity.Groups) != 2 || identity.Groups[1] != "ops" || identity.Attributes[AttributeEmail] != "greg@example.com" {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+
+	// accounts cannot be named like the default and public permits
+	r = httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("public", "qwerty1")
+	if identity := handler.Authenticate(r.Context(), r); identity != nil {
+		t.Errorf("expected account public to be rejected, got %+v", identity)
+	}
+
+	// rules are cached
+	_, err = db.Exec("DELETE FROM rules WHERE username = 'greg'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !request("PUT", "/tmp/file", "qwerty1") {
+		t.Error("expected cached rules to be used")
+	}
+
+	// logging out drops the cache
+	err = handler.RevokeUser(r.Context(), "greg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request("PUT", "/tmp/file", "qwerty1") {
+		t.Error("expected rules to be loaded again after logout")
+	}
+
+	// default rules only apply to users of the database
+	handler, next = newTestHandler(t, `
+	permission sql sqlite3 `+dbFile+` {
+		user_query "SELECT password_hash, groups, email FROM users WHERE username = ?"
+	}
+	permission basic {
+		user george qwerty2
+		ro /home/george/
+	}`)
+	err = handler.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+	for path, allowed := range map[string]bool{"/home/george/file": true, "/shared/file": false} {
+		next.request = nil
+		r := httptest.NewRequest("GET", path, nil)
+		r.SetBasicAuth("george", "qwerty2")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if (next.request != nil) != allowed {
+			t.Errorf("GET %s (basic user): expected allowed=%v", path, allowed)
+		}
+	}
+}
@@ -5,10 +5,22 @@ const (
 	BackendBasic uint8 = iota
 	BackendAPI
 	BackendTLS
+	BackendLocal
+	BackendFile
+	BackendPolicy
+	BackendSQL
+	BackendAPIKey
+	BackendShare
 
-	BackendBasicName = "basic"
-	BackendAPIName   = "api"
-	BackendTLSName   = "tls"
+	BackendBasicName  = "basic"
+	BackendAPIName    = "api"
+	BackendTLSName    = "tls"
+	BackendLocalName  = "local"
+	BackendFileName   = "file"
+	BackendPolicyName = "policy"
+	BackendSQLName    = "sql"
+	BackendAPIKeyName = "apikey"
+	BackendShareName  = "share"
 
 	DefaultIdentifier = "default"
 	PublicIdentifier  = "public"
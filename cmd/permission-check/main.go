@@ -0,0 +1,258 @@
+// Command permission-check evaluates test cases against the permission directives of a Caddyfile.
+//
+// Usage:
+//
+//	permission-check [-site address] [-failures] Caddyfile cases.yml [cases.csv ...]
+//	permission-check [-site address] -lint Caddyfile
+//
+// Likely mistakes in the configuration, such as unreachable rules, are always printed.
+// Cases are checked offline: the backends are not started and never contact external services.
+// The permits of backends that need them, such as the api and sql backends, are skipped, and these backends are listed before the results.
+// It exits with 1 if a case does not match its expectation (or, with -lint, if there are likely mistakes), and with 2 if the configuration or the cases are invalid.
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	permission "github.com/dhaavi/caddy-permission"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	site     string
+	failures bool
+	lint     bool
+)
+
+func init() {
+	flag.StringVar(&site, "site", "", "Address of the site to check, if the Caddyfile has more than one site with permission directives")
+	flag.BoolVar(&failures, "failures", false, "Only print cases that do not match their expectation")
+	flag.BoolVar(&lint, "lint", false, "Only check the configuration for likely mistakes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] Caddyfile cases.yml [cases.csv ...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] -lint Caddyfile\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if (lint && flag.NArg() != 1) || (!lint && flag.NArg() < 2) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	handler, err := loadConfig(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %s\n", err)
+		os.Exit(2)
+	}
+
+	for _, warning := range handler.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	if lint {
+		if len(handler.Warnings) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var cases []*permission.SimulationCase
+	for _, filename := range flag.Args()[1:] {
+		loaded, err := loadCases(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load cases: %s\n", err)
+			os.Exit(2)
+		}
+		cases = append(cases, loaded...)
+	}
+
+	for _, name := range handler.NotSimulated() {
+		fmt.Fprintf(os.Stderr, "note: the permits of %s are not simulated, it needs external services\n", name)
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tOUTCOME\tUSER\tMETHOD\tPATH\tDECIDED BY")
+	for _, simulationCase := range cases {
+		result := handler.Simulate(context.Background(), simulationCase)
+		if !result.Passed() {
+			failed++
+		} else if failures {
+			continue
+		}
+		printResult(w, result)
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d cases, %d failed\n", len(cases), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func loadConfig(filename string) (*permission.Handler, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return permission.ParseConfig(filename, file, site)
+}
+
+func printResult(w io.Writer, result *permission.SimulationResult) {
+	status := "-"
+	switch {
+	case !result.Passed():
+		status = "FAIL"
+	case result.Case.Expect != "":
+		status = "ok"
+	}
+
+	user := result.Case.User
+	if user == "" {
+		user = "(anonymous)"
+	}
+
+	decidedBy := "no matching rule"
+	switch {
+	case result.Error != nil:
+		decidedBy = "error: " + result.Error.Error()
+	case result.Decision.Rule != nil:
+		decidedBy = fmt.Sprintf("%s %s %s %s",
+			result.Decision.BackendName(),
+			permission.PermitTypeName(result.Decision.PermitType),
+			result.Decision.Rule.MethodString(),
+			result.Decision.Rule.Path,
+		)
+	}
+
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", status, result.Outcome(), user, result.Case.Method, result.Case.Path, decidedBy)
+}
+
+// loadCases loads cases from a YAML or CSV file.
+func loadCases(filename string) ([]*permission.SimulationCase, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var cases []*permission.SimulationCase
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yml", ".yaml":
+		cases, err = parseYAMLCases(data)
+	case ".csv":
+		cases, err = parseCSVCases(data)
+	default:
+		return nil, fmt.Errorf("%s: unknown file type, expected .yml, .yaml or .csv", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	for i, simulationCase := range cases {
+		if simulationCase.Method == "" || simulationCase.Path == "" {
+			return nil, fmt.Errorf("%s: case %d: method and path are required", filename, i+1)
+		}
+		simulationCase.Method = strings.ToUpper(simulationCase.Method)
+		simulationCase.Expect = strings.ToLower(simulationCase.Expect)
+		switch simulationCase.Expect {
+		case "", permission.ExpectAllow, permission.ExpectDeny:
+		default:
+			return nil, fmt.Errorf("%s: case %d: expect must be %s or %s", filename, i+1, permission.ExpectAllow, permission.ExpectDeny)
+		}
+	}
+	return cases, nil
+}
+
+// yamlCase is a case in a YAML file:
+//
+//	# one entry per case
+//	- user: greg
+//	  groups: [staff]
+//	  method: MOVE
+//	  path: /tmp/file
+//	  headers:
+//	    Location: /tmp/other
+//	  expect: allow
+type yamlCase struct {
+	User    string            `yaml:"user"`
+	Groups  []string          `yaml:"groups"`
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	Expect  string            `yaml:"expect"`
+}
+
+func parseYAMLCases(data []byte) ([]*permission.SimulationCase, error) {
+	var parsed []*yamlCase
+	err := yaml.UnmarshalStrict(data, &parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	cases := make([]*permission.SimulationCase, 0, len(parsed))
+	for _, c := range parsed {
+		cases = append(cases, &permission.SimulationCase{
+			User:    c.User,
+			Groups:  c.Groups,
+			Method:  c.Method,
+			Path:    c.Path,
+			Headers: c.Headers,
+			Expect:  c.Expect,
+		})
+	}
+	return cases, nil
+}
+
+// parseCSVCases parses cases in the format "user,method,path,expect[,Header: value ...]".
+// Lines starting with # are ignored, an empty user is anonymous.
+func parseCSVCases(data []byte) ([]*permission.SimulationCase, error) {
+	reader := csv.NewReader(strings.NewReader(string(data)))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	cases := make([]*permission.SimulationCase, 0, len(records))
+	for i, record := range records {
+		if len(record) < 3 {
+			return nil, fmt.Errorf("case %d: expected at least user, method and path", i+1)
+		}
+		c := &permission.SimulationCase{
+			User:   record[0],
+			Method: record[1],
+			Path:   record[2],
+		}
+		if len(record) > 3 {
+			c.Expect = record[3]
+		}
+		for j := 4; j < len(record); j++ {
+			header := record[j]
+			splitted := strings.SplitN(header, ":", 2)
+			if len(splitted) != 2 {
+				return nil, fmt.Errorf("case %d: invalid header %q, expected \"Name: value\"", i+1, header)
+			}
+			if c.Headers == nil {
+				c.Headers = make(map[string]string)
+			}
+			c.Headers[strings.TrimSpace(splitted[0])] = strings.TrimSpace(splitted[1])
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	permission "github.com/dhaavi/caddy-permission"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permission-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// cases are checked offline
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"Version": 2, "Permissions": {"/tmp/": "rw"}}`))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(dir, "api.cache")
+	err = ioutil.WriteFile(cacheFile, []byte("not a cache"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caddyfile := filepath.Join(dir, "Caddyfile")
+	err = ioutil.WriteFile(caddyfile, []byte(`
+example.com {
+	permission api {
+		user `+server.URL+`/caddyapi
+		permit `+server.URL+`/caddyapi/{{username}}
+		persist `+cacheFile+` s3cret
+	}
+	permission sql postgres "postgres://caddy@127.0.0.1:1/app"
+	permission basic {
+		user greg qwerty1
+		rw /tmp/
+	}
+}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := loadConfig(caddyfile)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	// checking the configuration must not touch persisted state
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Errorf("expected persisted cache to be left alone: %s", err)
+	}
+
+	result := handler.Simulate(context.Background(), &permission.SimulationCase{User: "greg", Method: "PUT", Path: "/tmp/file", Expect: permission.ExpectAllow})
+	if !result.Passed() {
+		t.Errorf("expected case to pass, got %s (%v)", result.Outcome(), result.Error)
+	}
+	if calls != 0 {
+		t.Errorf("expected the API not to be called, got %d requests", calls)
+	}
+	if skipped := handler.NotSimulated(); len(skipped) != 2 || skipped[0] != "api" || skipped[1] != "sql" {
+		t.Errorf("expected api and sql backends not to be simulated, got %v", skipped)
+	}
+}
+
+func TestLoadCases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "permission-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	yamlFile := filepath.Join(dir, "cases.yml")
+	err = ioutil.WriteFile(yamlFile, []byte(`
+- user: greg
+  groups: [staff]
+  method: move
+  path: /tmp/file
+  headers:
+    Location: /tmp/other
+  expect: Allow
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvFile := filepath.Join(dir, "cases.csv")
+	err = ioutil.WriteFile(csvFile, []byte("# user,method,path,expect\ngreg,PUT,/tmp/file,allow,Location: /tmp/other\n,GET,/static/style.css\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{yamlFile, csvFile} {
+		cases, err := loadCases(filename)
+		if err != nil {
+			t.Fatalf("%s: %s", filename, err)
+		}
+		if len(cases) == 0 || cases[0].User != "greg" || cases[0].Expect != permission.ExpectAllow || cases[0].Headers["Location"] != "/tmp/other" {
+			t.Errorf("%s: unexpected cases: %+v", filename, cases)
+		}
+	}
+
+	invalid := filepath.Join(dir, "invalid.csv")
+	err = ioutil.WriteFile(invalid, []byte("greg,PUT,/tmp/file,maybe\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCases(invalid); err == nil {
+		t.Error("expected invalid expectation to fail")
+	}
+}
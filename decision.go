@@ -0,0 +1,21 @@
+package permission
+
+// Decision describes the outcome of checking a request against the permits of all backends.
+type Decision struct {
+	Allowed bool
+	// Backend is the backend whose permit decided, or nil if no permit matched.
+	Backend    BackendV2
+	PermitType uint8
+	// Rule is the rule that decided, or nil if no permit matched or the backend failed to decide.
+	Rule *Rule
+	// MFARequired is set if the rule would allow the request, but requires a second factor the user has not passed.
+	MFARequired bool
+}
+
+// BackendName returns the name of the deciding backend, or an empty string.
+func (decision *Decision) BackendName() string {
+	if decision.Backend == nil {
+		return ""
+	}
+	return decision.Backend.Name()
+}
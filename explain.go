@@ -0,0 +1,241 @@
+package permission
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Explain endpoints, relative to the configured path
+const (
+	explainWhoami  = "/whoami"
+	explainExplain = "/explain"
+)
+
+// errTracePermit replaces the error of a backend that failed to provide a permit in traces.
+const errTracePermit = "failed to get permit"
+
+// Trace records every permit that was consulted to reach a decision.
+type Trace struct {
+	Checks []*TraceCheck `json:"checks"`
+}
+
+// TraceCheck records a single permission check. Special methods (MOVE, COPY, ...) need more than one check.
+type TraceCheck struct {
+	Method    string         `json:"method"`
+	Path      string         `json:"path"`
+	Permits   []*TracePermit `json:"permits"`
+	Allowed   bool           `json:"allowed"`
+	DecidedBy *TracePermit   `json:"decided_by,omitempty"`
+	// MFARequired is set if the deciding rule requires a second factor the user has not passed.
+	MFARequired bool `json:"mfa_required,omitempty"`
+}
+
+// TracePermit records a consulted permit.
+type TracePermit struct {
+	Backend    string           `json:"backend"`
+	PermitType string           `json:"permit_type"`
+	Rules      int              `json:"rules"`
+	Matched    bool             `json:"matched"`
+	Allowed    bool             `json:"allowed"`
+	Rule       *RuleExplanation `json:"rule,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// RuleExplanation describes a rule.
+type RuleExplanation struct {
+	Name    string `json:"name,omitempty"`
+	Path    string `json:"path"`
+	Methods string `json:"methods"`
+	Rate    string `json:"rate,omitempty"`
+}
+
+// IdentityExplanation describes an identity.
+type IdentityExplanation struct {
+	Username   string            `json:"username"`
+	Groups     []string          `json:"groups,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Source     string            `json:"source"`
+}
+
+// WhoamiResponse is returned by the whoami endpoint.
+type WhoamiResponse struct {
+	Authenticated bool                 `json:"authenticated"`
+	Identity      *IdentityExplanation `json:"identity,omitempty"`
+}
+
+// ExplainResponse is returned by the explain endpoint.
+type ExplainResponse struct {
+	Identity *IdentityExplanation `json:"identity,omitempty"`
+	Method   string               `json:"method"`
+	Path     string               `json:"path"`
+	Allowed  bool                 `json:"allowed"`
+	Error    string               `json:"error,omitempty"`
+	Checks   []*TraceCheck        `json:"checks"`
+}
+
+// AddCheck adds a new check to the trace. It is safe to call AddCheck on a nil Trace.
+func (trace *Trace) AddCheck(method, path string) *TraceCheck {
+	if trace == nil {
+		return nil
+	}
+	check := &TraceCheck{
+		Method:  method,
+		Path:    path,
+		Permits: []*TracePermit{},
+	}
+	trace.Checks = append(trace.Checks, check)
+	return check
+}
+
+// AddPermit records a consulted permit. It is safe to call AddPermit on a nil TraceCheck.
+func (check *TraceCheck) AddPermit(backend BackendV2, permitType uint8, permit *Permit, allowed bool, rule *Rule, err error) {
+	if check == nil {
+		return
+	}
+	consulted := &TracePermit{
+		Backend:    backend.Name(),
+		PermitType: PermitTypeName(permitType),
+		Matched:    rule != nil,
+		Allowed:    allowed,
+	}
+	if permit != nil {
+		consulted.Rules = len(permit.Rules)
+	}
+	if rule != nil {
+		consulted.Rule = explainRule(rule)
+	}
+	if err != nil {
+		// backend errors may contain internal details, they are printed with -error-permission
+		consulted.Error = errTracePermit
+	}
+	check.Permits = append(check.Permits, consulted)
+}
+
+// Decide records the decision of the check and returns it. It is safe to call Decide on a nil TraceCheck.
+func (check *TraceCheck) Decide(decision *Decision) *Decision {
+	if check == nil {
+		return decision
+	}
+	check.Allowed = decision.Allowed
+	check.MFARequired = decision.MFARequired
+	if (decision.Rule != nil || decision.Backend != nil) && len(check.Permits) > 0 {
+		check.DecidedBy = check.Permits[len(check.Permits)-1]
+	}
+	return decision
+}
+
+func explainRule(rule *Rule) *RuleExplanation {
+	explanation := &RuleExplanation{
+		Name:    rule.Name,
+		Path:    rule.Path,
+		Methods: rule.MethodString(),
+	}
+	if rule.Rate != nil {
+		explanation.Rate = rule.Rate.String()
+	}
+	return explanation
+}
+
+func explainIdentity(identity *Identity) *IdentityExplanation {
+	if identity == nil {
+		return nil
+	}
+	return &IdentityExplanation{
+		Username:   identity.Username,
+		Groups:     identity.Groups,
+		Attributes: identity.Attributes,
+		Source:     identity.Source,
+	}
+}
+
+// Explain checks the permissions of a request like ServeHTTP and explains how the decision was reached.
+func (handler *Handler) Explain(ctx context.Context, r *http.Request, identity *Identity) *ExplainResponse {
+	trace := &Trace{}
+	decision, err := handler.decide(ctx, r, identity, trace)
+
+	response := &ExplainResponse{
+		Identity: explainIdentity(identity),
+		Method:   r.Method,
+		Path:     r.RequestURI,
+		Allowed:  err == nil && decision.Allowed,
+		Checks:   trace.Checks,
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response
+}
+
+// serveExplain serves the whoami and explain endpoints.
+func (handler *Handler) serveExplain(w http.ResponseWriter, r *http.Request, identity *Identity) (int, error) {
+	switch strings.TrimPrefix(r.URL.Path, handler.ExplainPath) {
+	case explainWhoami:
+		return writeJSON(w, http.StatusOK, &WhoamiResponse{
+			Authenticated: identity != nil,
+			Identity:      explainIdentity(identity),
+		})
+	case explainExplain:
+		explainRequest, err := newExplainRequest(r)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		return writeJSON(w, http.StatusOK, handler.Explain(r.Context(), explainRequest, identity))
+	}
+	return http.StatusNotFound, nil
+}
+
+// newExplainRequest creates the request to explain from the query parameters "method", "path" and "destination".
+func newExplainRequest(r *http.Request) (*http.Request, error) {
+	query := r.URL.Query()
+
+	path := query.Get("path")
+	if path == "" {
+		path = "/"
+	}
+	requestURL, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+
+	explainRequest := &http.Request{
+		Method:     strings.ToUpper(query.Get("method")),
+		URL:        requestURL,
+		RequestURI: path,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		TLS:        r.TLS,
+		Header:     make(http.Header),
+	}
+	switch explainRequest.Method {
+	case "":
+		explainRequest.Method = "GET"
+	case "WEBSOCKET":
+		explainRequest.Method = "GET"
+		explainRequest.Header.Set("Upgrade", "websocket")
+	}
+	if destination := query.Get("destination"); destination != "" {
+		explainRequest.Header.Set("Location", destination)
+		explainRequest.Header.Set("Destination", destination)
+		if query.Get("action") != "" {
+			explainRequest.Header.Set("Action", query.Get("action"))
+		}
+	}
+
+	return explainRequest.WithContext(r.Context()), nil
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) (int, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(data)
+	return 0, nil
+}
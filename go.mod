@@ -1,11 +1,23 @@
 module github.com/dhaavi/caddy-permission
 
-go 1.12
+go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.9.0
 	github.com/caddyserver/caddy v1.0.1
+	github.com/go-redis/redis v6.15.2+incompatible
+	github.com/go-sql-driver/mysql v1.4.1
+	github.com/golang/protobuf v1.3.2
+	github.com/google/cel-go v0.4.1
 	github.com/google/uuid v1.1.1
 	github.com/klauspost/cpuid v1.2.1
+	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/mholt/certmagic v0.6.2-0.20190624175158-6a42ef9fe8c2
+	github.com/naoina/toml v0.1.1
+	github.com/prometheus/client_golang v1.1.0
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+	gopkg.in/yaml.v2 v2.2.2
 )
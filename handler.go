@@ -1,9 +1,11 @@
 package permission
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -15,7 +17,7 @@ import (
 type Handler struct {
 	Next httpserver.Handler
 
-	Backends []Backend
+	Backends []BackendV2
 
 	ReadParentPath bool
 	RemovePrefix   string
@@ -23,63 +25,206 @@ type Handler struct {
 
 	SetBasicAuth string
 	SetCookies   [][]string
+
+	Audit       *AuditLog
+	MetricsPath string
+	ExplainPath string
+
+	// ReportOnly forwards denied requests instead of denying them.
+	ReportOnly bool
+
+	// Admin serves the admin API, if configured.
+	Admin *AdminAPI
+
+	// LoginForm serves a login page and manages session cookies, if configured.
+	LoginForm *LoginForm
+	// Logout serves a path that ends sessions, if configured.
+	Logout *Logout
+	// MFA asks for a second factor on rules that require it, if configured.
+	MFA *MFA
+	// Lockout slows down guessing passwords, if configured.
+	Lockout *Lockout
+	// RateLimiter enforces the rate limits of rules.
+	RateLimiter *RateLimiter
+
+	// Strict fails on likely mistakes in the configuration instead of warning about them.
+	Strict bool
+	// Warnings are the likely mistakes found in the configuration.
+	Warnings []*LintWarning
 }
 
+// Enforcement modes
+const (
+	ModeEnforce    = "enforce"
+	ModeReportOnly = "report_only"
+)
+
+// identityHeaderPrefix starts the names of the headers the plugin sets on forwarded requests.
+const identityHeaderPrefix = "Caddy-Auth-"
+
+// WouldDenyHeader is set on requests that are forwarded in report only mode, although they would have been denied.
+const WouldDenyHeader = "Caddy-Auth-Would-Deny"
+
 // ServeHTTP implements the httpserver.Handler interface.
 func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 
-	var username string
-	var userSource string
+	start := time.Now()
+	ctx := r.Context()
+	r.Header.Del(WouldDenyHeader)
 
-	var authSuccess bool
-	var err error
+	// the admin API has its own credentials
+	if handler.Admin != nil && (r.URL.Path == handler.Admin.Path || strings.HasPrefix(r.URL.Path, handler.Admin.Path+"/")) {
+		return handler.Admin.ServeHTTP(w, r, handler)
+	}
 
-	// First get username
-	for _, backend := range handler.Backends {
+	if handler.Logout != nil && r.URL.Path == handler.Logout.Path {
+		return handler.Logout.ServeHTTP(w, r, handler)
+	}
 
-		username, authSuccess, err = backend.GetUsername(r)
-		if err != nil {
-			if printError || printDebug {
-				fmt.Printf("[permission] failed to get user from %s: %s\n", backend.Name(), err)
+	// the login form authenticates with the backends itself
+	if handler.LoginForm != nil && handler.LoginForm.Serves(r.URL.Path) {
+		return handler.LoginForm.ServeHTTP(w, r, handler)
+	}
+
+	// First get identity, from the session or the backends
+	var identity *Identity
+	if handler.LoginForm != nil {
+		if session := handler.LoginForm.Resume(w, r); session != nil {
+			identity = session.Identity
+		}
+	}
+	if identity == nil {
+		username, _, hasPassword := r.BasicAuth()
+		if hasPassword {
+			if wait := handler.Lockout.Check(handler.Lockout.clientIP(r), username); wait > 0 {
+				return handler.lockedOut(w, r, username, wait, start)
 			}
-			username = ""
-			continue
 		}
-		if !authSuccess {
-			username = ""
-			continue
+		var rejected bool
+		var err error
+		identity, rejected, err = handler.authenticate(ctx, r)
+		switch {
+		case !hasPassword:
+		case identity == nil && (rejected || err == nil):
+			// only count credentials that were rejected, not backends that failed
+			handler.failedLogin(r, username, start)
+		case identity != nil && identity.Username == username:
+			handler.Lockout.Succeed(username)
+		}
+	}
+	if handler.MFA != nil {
+		if r.URL.Path == handler.MFA.Path {
+			return handler.MFA.ServeHTTP(w, r, handler, identity)
+		}
+		handler.MFA.Resume(r, identity)
+	}
+
+	// Serve endpoints of backends
+	for _, backend := range handler.Backends {
+		if endpoint, ok := unwrapBackend(backend).(Endpoint); ok && endpoint.EndpointPath() == r.URL.Path {
+			return endpoint.ServeEndpoint(w, r, handler, identity)
+		}
+	}
+
+	decision, err := handler.Decide(ctx, r, identity)
+	if err != nil && handler.ReportOnly {
+		return handler.reportDenied(w, r, identity, decision, start)
+	}
+	if err != nil {
+		countDecision(decision, OutcomeDenied)
+		handler.Audit.Log(r, identity, decision, OutcomeDenied, start)
+		return http.StatusForbidden, err
+	}
+
+	if decision.Allowed && !handler.rateLimit(w, r, identity, decision) {
+		return handler.rateLimited(w, r, identity, decision, start)
+	}
+
+	if decision.Allowed {
+		countDecision(decision, OutcomeAllowed)
+		handler.Audit.Log(r, identity, decision, OutcomeAllowed, start)
+		if handler.MetricsPath != "" && r.URL.Path == handler.MetricsPath {
+			return ServeMetrics(w, r)
+		}
+		if handler.ExplainPath != "" && strings.HasPrefix(r.URL.Path, handler.ExplainPath+"/") {
+			return handler.serveExplain(w, r, identity)
+		}
+		return handler.Forward(w, r, identity, decision)
+	}
+
+	if handler.ReportOnly {
+		return handler.reportDenied(w, r, identity, decision, start)
+	}
+
+	// Ask for the second factor, if the rule requires it
+	if decision.MFARequired && handler.MFA != nil && handler.MFA.Challenge(w, r, identity) {
+		countDecision(decision, OutcomeLogin)
+		handler.Audit.Log(r, identity, decision, OutcomeLogin, start)
+		return 0, nil
+	}
+
+	// Execute login (redirection) procedure, if available
+	if identity == nil {
+		if ok, code, err := handler.Login(w, r); ok {
+			countDecision(decision, OutcomeLogin)
+			handler.Audit.Log(r, identity, decision, OutcomeLogin, start)
+			return code, err
 		}
+	}
 
-		// we got the username, now check permissions
-		userSource = backend.Name()
-		break
+	countDecision(decision, OutcomeDenied)
+	handler.Audit.Log(r, identity, decision, OutcomeDenied, start)
+	return Forbidden(w, r, identity, decision)
+}
 
+// Login handles the login of an anonymous request. Browsers are sent to the login form, if configured.
+// Otherwise the backends are asked in order, the first backend that supports login handles it.
+func (handler *Handler) Login(w http.ResponseWriter, r *http.Request) (ok bool, code int, err error) {
+	if handler.LoginForm != nil && handler.LoginForm.Redirect(w, r) {
+		metricLogins.WithLabelValues("form").Inc()
+		return true, 0, nil
 	}
+	for _, backend := range handler.Backends {
+		ok, code, err := backend.Login(w, r, handler.Realm)
+		if ok {
+			metricLogins.WithLabelValues(backend.Name()).Inc()
+			return true, code, err
+		}
+	}
+	return false, 0, nil
+}
+
+// Decide checks the permissions of a request, handling the special methods.
+func (handler *Handler) Decide(ctx context.Context, r *http.Request, identity *Identity) (*Decision, error) {
+	return handler.decide(ctx, r, identity, nil)
+}
 
-	var allowed bool
-	var backend Backend
+// decide checks the permissions of a request and records all checks in trace, if not nil.
+func (handler *Handler) decide(ctx context.Context, r *http.Request, identity *Identity, trace *Trace) (*Decision, error) {
+
+	var decision *Decision
 
 	switch r.Method {
 	// handle MOVE
 	case "MOVE":
-		allowed, backend = handler.CheckPermits(username, "DELETE", r.RequestURI, false)
-		if allowed {
+		decision = handler.checkPermits(ctx, r, identity, "DELETE", r.RequestURI, false, trace)
+		if decision.Allowed {
 			location := r.Header.Get("Location")
 			if location != "" {
-				allowed, backend = handler.CheckPermits(username, "PUT", location, false)
+				decision = handler.checkPermits(ctx, r, identity, "PUT", location, false, trace)
 			} else {
-				return http.StatusForbidden, errors.New("Failed to check permission: cannot MOVE without Location Header")
+				return &Decision{}, errors.New("Failed to check permission: cannot MOVE without Location Header")
 			}
 		}
 	// handle COPY
 	case "COPY":
-		allowed, backend = handler.CheckPermits(username, "GET", r.RequestURI, false)
-		if allowed {
+		decision = handler.checkPermits(ctx, r, identity, "GET", r.RequestURI, false, trace)
+		if decision.Allowed {
 			location := r.Header.Get("Location")
 			if location != "" {
-				allowed, backend = handler.CheckPermits(username, "PUT", location, false)
+				decision = handler.checkPermits(ctx, r, identity, "PUT", location, false, trace)
 			} else {
-				return http.StatusForbidden, errors.New("Failed to check permission: cannot COPY without Location Header")
+				return &Decision{}, errors.New("Failed to check permission: cannot COPY without Location Header")
 			}
 		}
 	// handle PATCH
@@ -87,117 +232,250 @@ func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int,
 		dest := r.Header.Get("Destination")
 		if dest != "" {
 			if strings.ToLower(r.Header.Get("Action")) == "copy" {
-				allowed, backend = handler.CheckPermits(username, "GET", r.RequestURI, false)
+				decision = handler.checkPermits(ctx, r, identity, "GET", r.RequestURI, false, trace)
 			} else {
-				allowed, backend = handler.CheckPermits(username, "DELETE", r.RequestURI, false)
+				decision = handler.checkPermits(ctx, r, identity, "DELETE", r.RequestURI, false, trace)
 			}
-			if allowed {
-				allowed, backend = handler.CheckPermits(username, "PUT", dest, false)
+			if decision.Allowed {
+				decision = handler.checkPermits(ctx, r, identity, "PUT", dest, false, trace)
 			}
 		} else {
-			allowed, backend = handler.CheckPermits(username, r.Method, r.RequestURI, false)
+			decision = handler.checkPermits(ctx, r, identity, r.Method, r.RequestURI, false, trace)
 		}
 	default:
 		// handle websocket upgrades
 		if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
-			allowed, backend = handler.CheckPermits(username, "WEBSOCKET", r.RequestURI, false)
+			decision = handler.checkPermits(ctx, r, identity, "WEBSOCKET", r.RequestURI, false, trace)
 			// handle everything else
 		} else {
 			ro := MethodIsRo(r.Method)
-			allowed, backend = handler.CheckPermits(username, r.Method, r.RequestURI, ro)
+			decision = handler.checkPermits(ctx, r, identity, r.Method, r.RequestURI, ro, trace)
 		}
 	}
 
-	if allowed {
-		return handler.Forward(w, r, username, userSource, backend, PermitTypeUser)
+	return decision, nil
+}
+
+// reportDenied forwards a denied request in report only mode and tags it with the Caddy-Auth-Would-Deny header.
+func (handler *Handler) reportDenied(w http.ResponseWriter, r *http.Request, identity *Identity, decision *Decision, start time.Time) (int, error) {
+	reason := "forbidden"
+	if identity == nil {
+		reason = "unauthenticated"
 	}
 
-	// Execute login (redirection) procedure, if available
-	if username == "" {
-		for _, backend := range handler.Backends {
-			ok, code, err := backend.Login(w, r, handler.Realm)
-			if ok {
-				return code, err
+	if printDebug {
+		fmt.Printf("[permission] %s%swould deny access: %s %s\n", getUserForPrinting(identity), getPermitBackendForPrinting(decision.Backend, decision.PermitType), r.Method, r.RequestURI)
+	}
+	countDecision(decision, OutcomeWouldDeny)
+	handler.Audit.Log(r, identity, decision, OutcomeWouldDeny, start)
+
+	r.Header.Set(WouldDenyHeader, reason)
+	return handler.Forward(w, r, identity, decision)
+}
+
+// Authenticate asks all backends in order to authenticate the request and returns the first identity, or nil.
+func (handler *Handler) Authenticate(ctx context.Context, r *http.Request) *Identity {
+	identity, _, _ := handler.authenticate(ctx, r)
+	return identity
+}
+
+// authenticate asks all backends in order to authenticate the request and returns the first identity.
+// If no backend authenticated the request, it returns the error of the first backend that failed, if any,
+// and whether a backend that checks passwords rejected the request, so that rejected credentials can be told apart from unavailable backends.
+func (handler *Handler) authenticate(ctx context.Context, r *http.Request) (*Identity, bool, error) {
+	var firstErr error
+	var rejected bool
+	for _, backend := range handler.Backends {
+
+		backendStart := time.Now()
+		identity, err := backend.Authenticate(ctx, r)
+		observeBackendDuration(backend, operationAuthenticate, backendStart)
+		if err != nil {
+			if printError || printDebug {
+				fmt.Printf("[permission] failed to get user from %s: %s\n", backend.Name(), err)
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to get user from %s: %s", backend.Name(), err)
 			}
+			continue
+		}
+		if identity == nil {
+			rejected = rejected || checksPasswords(backend)
+			continue
 		}
+
+		// we got the user, now check permissions
+		if identity.Source == "" {
+			identity.Source = backend.Name()
+		}
+		return identity, false, nil
+
 	}
+	return nil, rejected, firstErr
+}
 
-	return Forbidden(w, r, username, userSource, nil, PermitTypeNo)
+// checksPasswords returns whether the backend may authenticate users with a password. Backends of other packages are assumed to.
+func checksPasswords(backend BackendV2) bool {
+	switch unwrapBackend(backend).(type) {
+	case *TLSBackend, *APIKeyBackend, *ShareBackend, *CELBackend:
+		return false
+	}
+	return true
 }
 
 // CheckPermits checks permissions of a request
-func (handler *Handler) CheckPermits(username, method, path string, ro bool) (bool, Backend) {
+func (handler *Handler) CheckPermits(ctx context.Context, r *http.Request, identity *Identity, method, path string, ro bool) *Decision {
+	return handler.checkPermits(ctx, r, identity, method, path, ro, nil)
+}
 
-	var permit *Permit
-	var err error
+// checkPermits checks permissions of a request and records every consulted permit in trace, if not nil.
+// Rules that require a second factor only allow the request if the user passed one.
+func (handler *Handler) checkPermits(ctx context.Context, r *http.Request, identity *Identity, method, path string, ro bool, trace *Trace) *Decision {
+	check := trace.AddCheck(method, path)
+	decision := handler.matchPermits(ctx, r, identity, method, path, ro, check)
+	if decision.Allowed && decision.Rule != nil && decision.Rule.MFA && !identity.HasMFA() {
+		decision.Allowed = false
+		decision.MFARequired = true
+		check.Decide(decision)
+	}
+	return decision
+}
 
-	// Then get user/default permits
-	if username != "" {
-		for _, backend := range handler.Backends {
+// matchPermits returns the decision of the first permit with a matching rule.
+func (handler *Handler) matchPermits(ctx context.Context, r *http.Request, identity *Identity, method, path string, ro bool, check *TraceCheck) *Decision {
 
-			permit, err = backend.GetPermit(username)
-			if err != nil {
-				if printError || printDebug {
-					fmt.Printf("[permission] failed to get user permit from %s: %s\n", backend.Name(), err)
-				}
-				continue
+	// First verify share links, they grant access regardless of the permits
+	for _, backend := range handler.Backends {
+		if share, ok := unwrapBackend(backend).(*ShareBackend); ok {
+			if decision := handler.consultDecider(ctx, r, identity, method, path, backend, share, check); decision != nil {
+				return decision
 			}
-			if permit == nil {
+		}
+	}
+
+	// Then get user/default permits
+	if identity != nil {
+		for _, backend := range handler.Backends {
+			if _, ok := unwrapBackend(backend).(*ShareBackend); ok {
 				continue
 			}
-			allowed, matched := permit.Check(handler, method, path, ro)
-			if matched {
-				return allowed, backend
-			}
-
-			permit, err = backend.GetDefaultPermit()
-			if err != nil {
-				if printError || printDebug {
-					fmt.Printf("[permission] failed to get default permit from %s: %s\n", backend.Name(), err)
+			if decider, ok := unwrapBackend(backend).(Decider); ok {
+				if decision := handler.consultDecider(ctx, r, identity, method, path, backend, decider, check); decision != nil {
+					return decision
 				}
 				continue
 			}
-			if permit != nil {
-				allowed, matched = permit.Check(handler, method, path, ro)
-				if matched {
-					return allowed, backend
+			for _, permitType := range []uint8{PermitTypeUser, PermitTypeDefault} {
+
+				backendStart := time.Now()
+				permit, err := backend.Authorize(ctx, r, identity, permitType)
+				observeBackendDuration(backend, operationAuthorize, backendStart)
+				if err != nil {
+					if printError || printDebug {
+						fmt.Printf("[permission] failed to get %s permit from %s: %s\n", PermitTypeName(permitType), backend.Name(), err)
+					}
+					check.AddPermit(backend, permitType, nil, false, nil, err)
+					break
+				}
+				if permit == nil {
+					if permitType == PermitTypeUser {
+						// default permits only apply to users known to the backend
+						break
+					}
+					continue
+				}
+				allowed, rule := permit.Match(handler, method, path, ro)
+				check.AddPermit(backend, permitType, permit, allowed, rule, nil)
+				if rule != nil {
+					return check.Decide(&Decision{
+						Allowed:    allowed,
+						Backend:    backend,
+						PermitType: permitType,
+						Rule:       rule,
+					})
 				}
-			}
 
+			}
 		}
 	}
 
 	// Lastly, check all public permits
 	for _, backend := range handler.Backends {
+		if decider, ok := unwrapBackend(backend).(Decider); ok {
+			// deciders were already consulted for authenticated requests, share links first
+			if _, share := decider.(*ShareBackend); !share && identity == nil {
+				if decision := handler.consultDecider(ctx, r, identity, method, path, backend, decider, check); decision != nil {
+					return decision
+				}
+			}
+			continue
+		}
 
-		permit, err := backend.GetPublicPermit()
+		backendStart := time.Now()
+		permit, err := backend.Authorize(ctx, r, nil, PermitTypePublic)
+		observeBackendDuration(backend, operationAuthorize, backendStart)
 		if err != nil {
 			if printError || printDebug {
 				fmt.Printf("[permission] failed to get public permit from %s: %s\n", backend.Name(), err)
 			}
+			check.AddPermit(backend, PermitTypePublic, nil, false, nil, err)
 			continue
 		}
 		if permit == nil {
 			continue
 		}
-		allowed, matched := permit.Check(handler, method, path, ro)
-		if matched {
-			return allowed, backend
+		allowed, rule := permit.Match(handler, method, path, ro)
+		check.AddPermit(backend, PermitTypePublic, permit, allowed, rule, nil)
+		if rule != nil {
+			return check.Decide(&Decision{
+				Allowed:    allowed,
+				Backend:    backend,
+				PermitType: PermitTypePublic,
+				Rule:       rule,
+			})
 		}
 
 	}
 
-	return false, nil
+	return check.Decide(&Decision{})
+}
+
+// consultDecider asks a backend that implements Decider to decide the request, and returns the decision or nil.
+// If the backend fails to decide, the request is denied, as one of its deny rules might have matched.
+func (handler *Handler) consultDecider(ctx context.Context, r *http.Request, identity *Identity, method, path string, backend BackendV2, decider Decider, check *TraceCheck) *Decision {
+	backendStart := time.Now()
+	allowed, rule, err := decider.Decide(ctx, r, identity, method, path)
+	observeBackendDuration(backend, operationAuthorize, backendStart)
+	if err != nil {
+		if printError || printDebug {
+			fmt.Printf("[permission] failed to get decision from %s: %s\n", backend.Name(), err)
+		}
+		check.AddPermit(backend, PermitTypePolicy, nil, false, nil, err)
+		return check.Decide(&Decision{
+			Backend:    backend,
+			PermitType: PermitTypePolicy,
+		})
+	}
+	check.AddPermit(backend, PermitTypePolicy, nil, allowed, rule, nil)
+	if rule == nil {
+		return nil
+	}
+	return check.Decide(&Decision{
+		Allowed:    allowed,
+		Backend:    backend,
+		PermitType: PermitTypePolicy,
+		Rule:       rule,
+	})
 }
 
-func getUserForPrinting(username, userSource string) string {
-	if username == "" {
+func getUserForPrinting(identity *Identity) string {
+	if identity == nil {
 		return ""
 	}
-	return fmt.Sprintf("[%s: %s] ", userSource, username)
+	return fmt.Sprintf("[%s: %s] ", identity.Source, identity.Username)
 }
 
-func getPermitBackendForPrinting(backend Backend, permitType uint8) string {
+func getPermitBackendForPrinting(backend BackendV2, permitType uint8) string {
 	if backend == nil {
 		return ""
 	}
@@ -211,22 +489,58 @@ func getPermitBackendForPrinting(backend Backend, permitType uint8) string {
 	}
 }
 
+// setIdentityHeaders adds information about the identity to the request.
+func setIdentityHeaders(r *http.Request, identity *Identity) {
+	for _, name := range []string{"Caddy-Auth-User", "Caddy-Auth-Source", "Caddy-Auth-Groups", "Caddy-Auth-Name", "Caddy-Auth-Email"} {
+		r.Header.Del(name)
+	}
+
+	if identity == nil {
+		return
+	}
+
+	// custom headers come first and may not replace the headers of the plugin
+	for name, value := range identity.Headers {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), identityHeaderPrefix) {
+			continue
+		}
+		r.Header.Set(name, value)
+	}
+
+	r.Header.Set("Caddy-Auth-User", identity.Username)
+	r.Header.Set("Caddy-Auth-Source", identity.Source)
+	if len(identity.Groups) > 0 {
+		r.Header.Set("Caddy-Auth-Groups", strings.Join(identity.Groups, ","))
+	}
+	if name := identity.Attributes[AttributeDisplayName]; name != "" {
+		r.Header.Set("Caddy-Auth-Name", name)
+	}
+	if email := identity.Attributes[AttributeEmail]; email != "" {
+		r.Header.Set("Caddy-Auth-Email", email)
+	}
+}
+
 // Forward hands the request to the next middleware and adds some headers for information
-func (handler *Handler) Forward(w http.ResponseWriter, r *http.Request, username, userSource string, backend Backend, permitType uint8) (int, error) {
+func (handler *Handler) Forward(w http.ResponseWriter, r *http.Request, identity *Identity, decision *Decision) (int, error) {
 
 	// log
-	printablePermit := getPermitBackendForPrinting(backend, permitType)
+	printablePermit := getPermitBackendForPrinting(decision.Backend, decision.PermitType)
 	if printDebug {
-		fmt.Printf("[permission] %s%sgranted access: %s %s\n", getUserForPrinting(username, userSource), printablePermit, r.Method, r.RequestURI)
+		fmt.Printf("[permission] %s%sgranted access: %s %s\n", getUserForPrinting(identity), printablePermit, r.Method, r.RequestURI)
 	}
 
-	// set username
-	if username != "" {
-		r.Header.Set("Caddy-Auth-User", username)
-		r.Header.Set("Caddy-Auth-Source", userSource)
-	} else {
-		r.Header.Del("Caddy-Auth-User")
-		r.Header.Del("Caddy-Auth-Source")
+	// set user
+	setIdentityHeaders(r, identity)
+
+	// API keys are credentials of the client, too
+	removeAPIKeys(r, handler.Backends, identity)
+
+	// the cookies of the login form are credentials of the user, upstreams get the identity headers instead
+	if handler.LoginForm != nil {
+		removeCookies(r, handler.LoginForm.Cookie, handler.LoginForm.Cookie+csrfCookieSuffix)
+	}
+	if handler.MFA != nil {
+		removeCookies(r, handler.MFA.Cookie)
 	}
 
 	if printablePermit != "" {
@@ -252,12 +566,105 @@ func (handler *Handler) Forward(w http.ResponseWriter, r *http.Request, username
 	return handler.Next.ServeHTTP(w, r)
 }
 
+// removeCookies removes the named cookies from the request and keeps all others.
+func removeCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		removed := false
+		for _, name := range names {
+			if cookie.Name == name {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// removeAPIKeys removes the header, the bearer token and the query parameter of the API key backend that authenticated the request, if any.
+func removeAPIKeys(r *http.Request, backends []BackendV2, identity *Identity) {
+	if identity == nil {
+		return
+	}
+	for _, backend := range backends {
+		apiKey, ok := unwrapBackend(backend).(*APIKeyBackend)
+		if !ok || backend.Name() != identity.Source {
+			continue
+		}
+		r.Header.Del(apiKey.Header)
+		if authorization := r.Header.Get("Authorization"); !apiKey.NoBearer && len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+			r.Header.Del("Authorization")
+		}
+		if apiKey.QueryParam != "" {
+			r.URL.RawQuery = strings.TrimPrefix(rewriteQuery("?"+r.URL.RawQuery, []string{apiKey.QueryParam}, false), "?")
+			r.RequestURI = rewriteQuery(r.RequestURI, []string{apiKey.QueryParam}, false)
+		}
+	}
+}
+
+// rewriteQuery redacts the values of the given query parameters of a request URI, or removes the parameters.
+// All other parameters are kept as they are.
+func rewriteQuery(requestURI string, params []string, redact bool) string {
+	i := strings.IndexByte(requestURI, '?')
+	if i < 0 || len(params) == 0 {
+		return requestURI
+	}
+	parts := strings.Split(requestURI[i+1:], "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		name := part
+		if j := strings.IndexByte(part, '='); j >= 0 {
+			name = part[:j]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		secret := false
+		for _, param := range params {
+			if name == param {
+				secret = true
+				break
+			}
+		}
+		switch {
+		case !secret:
+			kept = append(kept, part)
+		case redact:
+			kept = append(kept, url.QueryEscape(name)+"=REDACTED")
+		}
+	}
+	if len(kept) == 0 {
+		return requestURI[:i]
+	}
+	return requestURI[:i+1] + strings.Join(kept, "&")
+}
+
+// secretParams returns the query parameters that carry credentials of the configured backends.
+func (handler *Handler) secretParams() []string {
+	var params []string
+	for _, backend := range handler.Backends {
+		switch backend := unwrapBackend(backend).(type) {
+		case *APIKeyBackend:
+			if backend.QueryParam != "" {
+				params = append(params, backend.QueryParam)
+			}
+		case *ShareBackend:
+			params = append(params, ShareParamSignature)
+		}
+	}
+	return params
+}
+
 // Forbidden logs why this request was forbidden and returns http.StatusForbidden
-func Forbidden(w http.ResponseWriter, r *http.Request, username, userSource string, backend Backend, permitType uint8) (int, error) {
+func Forbidden(w http.ResponseWriter, r *http.Request, identity *Identity, decision *Decision) (int, error) {
+	printablePermit := getPermitBackendForPrinting(decision.Backend, decision.PermitType)
 	if printDebug {
-		fmt.Printf("[permission] %s%sdenied access: %s %s\n", getUserForPrinting(username, userSource), getPermitBackendForPrinting(backend, permitType), r.Method, r.RequestURI)
+		fmt.Printf("[permission] %s%sdenied access: %s %s\n", getUserForPrinting(identity), printablePermit, r.Method, r.RequestURI)
 	}
-	return http.StatusForbidden, fmt.Errorf("[permission] %s%sdenied access: %s %s", getUserForPrinting(username, userSource), getPermitBackendForPrinting(backend, permitType), r.Method, r.RequestURI)
+	return http.StatusForbidden, fmt.Errorf("[permission] %s%sdenied access: %s %s", getUserForPrinting(identity), printablePermit, r.Method, r.RequestURI)
 }
 
 // NewHandler creates a new Handler from configuration
@@ -266,7 +673,9 @@ func NewHandler(c *caddy.Controller, now int64) (*Handler, error) {
 		now = time.Now().Unix()
 	}
 
-	new := Handler{}
+	new := Handler{
+		RateLimiter: NewRateLimiter(),
+	}
 	// cfg := httpserver.GetConfig(c)
 	// var err error
 
@@ -302,9 +711,72 @@ func NewHandler(c *caddy.Controller, now int64) (*Handler, error) {
 				return nil, c.ArgErr()
 			}
 			new.SetCookies = append(new.SetCookies, []string{args[0], args[1]})
+		case "metrics":
+			// require argument
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.MetricsPath = c.Val()
+		case "explain":
+			// require argument
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.ExplainPath = strings.TrimRight(c.Val(), "/")
+		case "strict":
+			new.Strict = true
+		case "mode":
+			// require argument
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch c.Val() {
+			case ModeEnforce:
+				new.ReportOnly = false
+			case ModeReportOnly:
+				new.ReportOnly = true
+			default:
+				return nil, c.Errf("unknown permission mode \"%s\", expected \"%s\" or \"%s\"", c.Val(), ModeEnforce, ModeReportOnly)
+			}
+		case "admin":
+			admin, err := NewAdminAPI(c)
+			if err != nil {
+				return nil, err
+			}
+			new.Admin = admin
+		case "login":
+			form, err := NewLoginForm(c)
+			if err != nil {
+				return nil, err
+			}
+			new.LoginForm = form
+		case "logout":
+			logout, err := NewLogout(c)
+			if err != nil {
+				return nil, err
+			}
+			new.Logout = logout
+		case "mfa":
+			mfa, err := NewMFA(c)
+			if err != nil {
+				return nil, err
+			}
+			new.MFA = mfa
+		case "lockout":
+			lockout, err := NewLockout(c)
+			if err != nil {
+				return nil, err
+			}
+			new.Lockout = lockout
+		case "audit":
+			audit, err := NewAuditLog(c)
+			if err != nil {
+				return nil, err
+			}
+			new.Audit = audit
 		default:
 			// get factory
-			factory := GetFactory(c.Val())
+			factory := GetFactoryV2(c.Val())
 			if factory == nil {
 				return nil, fmt.Errorf("unknown permission backend \"%s\" (line %d), did you maybe forget to include this plug in the build?", c.Val(), c.Line())
 			}
@@ -319,5 +791,25 @@ func NewHandler(c *caddy.Controller, now int64) (*Handler, error) {
 
 	}
 
+	if new.MFA != nil {
+		if new.LoginForm == nil {
+			return nil, errors.New("permission mfa requires the login form (permission login)")
+		}
+		new.MFA.setLoginForm(new.LoginForm)
+	}
+
+	if new.Audit != nil {
+		new.Audit.SecretParams = new.secretParams()
+	}
+
+	new.Warnings = new.Lint()
+	if new.Strict && len(new.Warnings) > 0 {
+		messages := make([]string, 0, len(new.Warnings))
+		for _, warning := range new.Warnings {
+			messages = append(messages, warning.String())
+		}
+		return nil, fmt.Errorf("permission configuration has likely mistakes:\n%s", strings.Join(messages, "\n"))
+	}
+
 	return &new, nil
 }
@@ -1,8 +1,14 @@
 package permission
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -37,8 +43,8 @@ func TestConfigParsing(t *testing.T) {
 			}`,
 			true,
 			&Handler{
-				Backends: []Backend{
-					&BasicBackend{
+				Backends: []BackendV2{
+					AdaptBackend(&BasicBackend{
 						Users: map[string]string{
 							"YWRtaW46cGFzc3dvcmQ=": "admin",
 						},
@@ -117,10 +123,11 @@ func TestConfigParsing(t *testing.T) {
 							},
 							ValidUntil: testTimestamp,
 						},
-					},
+					}),
 				},
 				ReadParentPath: true,
 				RemovePrefix:   "/files",
+				RateLimiter:    NewRateLimiter(),
 			},
 		},
 	}
@@ -160,10 +167,12 @@ func TestConfigOptions(t *testing.T) {
 		rw /tmp/ # he may read and write to /tmp/!
 
 		user george # This is george, he does not have a password, another backend will have to authenticate him
+		rate 10/s # limit all rules of george without their own limit
 		rw /admin/
 
 		default # applies to all logged-in users
 		rw /api/users/0 #
+		rw /api/search rate 100/m # 100 requests per minute and user
 
 		public # applies to everyone, also anonymous users
 		ro /static # everyone may read stuff in the static folder
@@ -174,17 +183,535 @@ func TestConfigOptions(t *testing.T) {
 		user http://localhost:8080/caddyapi # main authentication api
 		permit http://localhost:8080/caddyapi/{{username}} # refetch a permit of a user
 		login http://localhost:8080/login?next={{resource}} # redirect here for logging in (resource is original URL)
+		logout http://localhost:8080/caddyapi/logout/{{username}} # notify the api of logouts
 		add_prefix /api/resource /files # add prefixes to returned paths
 		add_without_prefix # if add_prefix is used, but you still want to also add the original paths
 		cache 600 # how to long to cache authenticated users
 		cleanup 3600 # when to clean out authenticated users
+		store memory # where to cache users and permits
+		tls_client_cert test/certs/greg.crt test/certs/greg.key # authenticate to the api with a client certificate
+		tls_ca test/certs/clientCA.crt # verify the api server certificate
+		sign_secret s3cret # sign requests to the api
+		bearer_token t0ken # authorize requests to the api
+		proxy none # do not use a proxy, even if configured in the environment
+		max_idle_conns 100 # idle connections to keep open
+		max_idle_conns_per_host 10 # idle connections to keep open per host
+		idle_timeout 90 # when to close idle connections
+		timeout 10 # timeout for api requests
+		no_http2 # only use HTTP/1.1
+		forward_headers Accept-Language # forward headers to the user endpoint
+		forward_cookies session # only forward these cookies to the user endpoint
+	}
+	permission api {
+		name Socket
+		user unix:/run/auth.sock:/caddyapi # use a unix socket
+		permit unix:/run/auth.sock:/caddyapi/{{username}}
+	}
+	permission local {
+		name ops # name to manage it in the admin API
+		persist /var/lib/caddy/permission-ops.json # keep changes across restarts
+	}
+	permission sql postgres "postgres://caddy@localhost/app?sslmode=disable" {
+		name app
+		user_query "SELECT password_hash, groups FROM users WHERE login = $1 AND active" # password hash first, optional groups, display_name and email
+		rules_query "SELECT methods, path FROM rules WHERE login = $1 ORDER BY priority"
+		default_rules_query "SELECT methods, path FROM default_rules WHERE permit = $1 ORDER BY priority" # gets "default" or "public"
+		cache 60 # cache users and permits for 60 seconds
+		cleanup 3600
+		store memory # or redis, shared with other instances
+		timeout 5
+		max_open_conns 10
+		max_idle_conns 2
+		conn_max_lifetime 300
+	}
+	permission apikey {
+		name bots
+		header X-API-Key # header to read keys from (default)
+		query api_key # also read keys from this query parameter
+		no_bearer # do not read keys from "Authorization: Bearer"
+		key ci-build sha256:a2bd5e3b5a6df3e8a6d7fbb4a84e35c5ea6c8e1ec2b2ee3e2a0ab6dc4b6b4e41 expires 2030-01-01 from 10.0.0.0/8 # service user, key hash and restrictions
+		rw /artifacts/
+		key deploy sha256:5d865deae06f6a5f2fa8b5a6c0a7d39ee9e15b9df7af34c6bc1ef17dd4ea2b1e
+		rw /deploy/ rate 10/m # limit requests with this key
+	}
+	permission share {
+		name files
+		secret 0123456789abcdef # key to sign share links with
+		endpoint /.share # mint share links here
+		ttl 86400 # validity of minted links
+		max_ttl 604800 # longest validity users may request
+	}
+	permission login /.login { # login form for browsers
+		secret 0123456789abcdef # key to encrypt session cookies with
+		cookie caddy_session # name of the session cookie
+		logout /.logout # log out here (default: /.login/logout)
+		idle 1800 # end sessions after 30 minutes without requests
+		lifetime 43200 # end sessions after 12 hours
+		title "Example Site" # title of the login page (default: realm)
+		secure # always set the secure flag on cookies, eg. behind a TLS terminating proxy
+	}
+	permission mfa { # second factor for rules with the mfa flag
+		user greg JBSWY3DPEHPK3PXP # base32 encoded TOTP secret
+		remember 2592000 # remember devices for 30 days
+		cookie caddy_mfa # name of the remember device cookie
+		at_login # ask right after logging in
+	}
+	permission lockout { # slow down guessing passwords
+		user_threshold 5 # failed attempts per username
+		ip_threshold 20 # failed attempts per client IP
+		delay 1 # first lockout in seconds, doubled with every failure
+		max_delay 900 # longest lockout
+		reset 3600 # forget failures after an hour
+		trusted_proxies 10.0.0.0/8 127.0.0.1 # take the client IP from X-Forwarded-For of these proxies
+	}
+	permission logout /logout { # end sessions here
+		redirect / # go here afterwards
+		clear_cookie PHPSESSID # also clear these cookies
+	}
+	permission admin /.admin { # manage local backends at runtime
+		user ops s3cret # admin credentials
+		allow 10.0.0.0/8 192.168.0.0/16 # only allow these networks
 	}
 	permission set_basicauth admin admin # set basic auth on forwarded request (ie use tls client certs as a front for a simple password based service)
 	permission set_cookie token secret # set cookie on forwarded request
 	permission set_cookie language en
+	permission mode enforce # deny requests (default)
+	permission strict # fail on likely mistakes in the configuration
+	permission audit stdout { # log access decisions
+		sample 0.5 # log half of the allowed requests
+	}
 	`
 	_, err := NewHandler(caddy.NewTestController("http", input), testTimestamp)
 	if err != nil {
 		t.Errorf("failed to parse config: %s", err)
 	}
 }
+
+type testNext struct {
+	request *http.Request
+}
+
+func (next *testNext) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	next.request = r
+	return http.StatusOK, nil
+}
+
+func newTestHandler(t *testing.T, input string) (*Handler, *testNext) {
+	handler, err := NewHandler(caddy.NewTestController("http", input), 0)
+	if err != nil {
+		t.Fatalf("failed to create Handler: %s", err)
+	}
+	next := &testNext{}
+	handler.Next = next
+	return handler, next
+}
+
+func TestServeHTTP(t *testing.T) {
+	handler, next := newTestHandler(t, `
+	permission basic {
+		user greg qwerty1
+		rw /tmp/
+
+		user george
+		rw /admin/
+
+		default
+		rw /shared/
+
+		public
+		ro /static
+	}`)
+
+	tests := []struct {
+		method   string
+		path     string
+		user     string
+		password string
+		status   int
+	}{
+		{"GET", "/static/file", "", "", http.StatusOK},
+		{"PUT", "/static/file", "", "", http.StatusUnauthorized},
+		{"PUT", "/tmp/file", "greg", "qwerty1", http.StatusOK},
+		{"PUT", "/tmp/file", "greg", "wrong", http.StatusUnauthorized},
+		{"PUT", "/shared/file", "greg", "qwerty1", http.StatusOK},
+		{"PUT", "/admin/file", "greg", "qwerty1", http.StatusForbidden},
+		{"GET", "/static/file", "greg", "qwerty1", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		next.request = nil
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		status, _ := handler.ServeHTTP(httptest.NewRecorder(), r)
+		if status != test.status {
+			t.Errorf("%s %s as %q: expected status %d, got %d", test.method, test.path, test.user, test.status, status)
+		}
+		if status == http.StatusOK {
+			if next.request == nil {
+				t.Errorf("%s %s as %q: request was not forwarded", test.method, test.path, test.user)
+			} else if next.request.Header.Get("Caddy-Auth-User") != test.user {
+				t.Errorf("%s %s as %q: unexpected Caddy-Auth-User header %q", test.method, test.path, test.user, next.request.Header.Get("Caddy-Auth-User"))
+			}
+		}
+	}
+}
+
+func TestDefaultPermitOfOtherBackend(t *testing.T) {
+	handler, _ := newTestHandler(t, `
+	permission basic {
+		user greg qwerty1
+		rw /tmp/
+	}
+	permission basic {
+		user george
+		rw /admin/
+
+		default
+		rw /internal/
+	}`)
+
+	r := httptest.NewRequest("PUT", "/internal/file", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	status, _ := handler.ServeHTTP(httptest.NewRecorder(), r)
+	if status != http.StatusForbidden {
+		t.Errorf("default permit of another backend was applied: expected status %d, got %d", http.StatusForbidden, status)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	handler, _ := newTestHandler(t, `
+	permission audit stdout {
+		sample 0
+	}
+	permission basic {
+		user greg qwerty1
+		rw /tmp/
+	}`)
+	buf := &bytes.Buffer{}
+	handler.Audit.writer = buf
+
+	r := httptest.NewRequest("PUT", "/tmp/file", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if buf.Len() != 0 {
+		t.Errorf("allowed request was logged with sample rate 0: %s", buf.String())
+	}
+
+	r = httptest.NewRequest("PUT", "/other/file", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	entry := &AuditEntry{}
+	err := json.Unmarshal(buf.Bytes(), entry)
+	if err != nil {
+		t.Fatalf("failed to parse audit log entry %q: %s", buf.String(), err)
+	}
+	if entry.Outcome != OutcomeDenied || entry.User != "greg" || entry.Source != "basic" || entry.Method != "PUT" || entry.Path != "/other/file" {
+		t.Errorf("unexpected audit log entry: %+v", entry)
+	}
+
+	buf.Reset()
+	handler.Audit.SampleRate = 1
+	r = httptest.NewRequest("PUT", "/tmp/file", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	entry = &AuditEntry{}
+	err = json.Unmarshal(buf.Bytes(), entry)
+	if err != nil {
+		t.Fatalf("failed to parse audit log entry %q: %s", buf.String(), err)
+	}
+	if entry.Outcome != OutcomeAllowed || entry.Backend != "basic" || entry.PermitType != "user" || entry.RulePath != "/tmp/" {
+		t.Errorf("unexpected audit log entry: %+v", entry)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	handler, next := newTestHandler(t, `
+	permission metrics /metrics
+	permission basic {
+		public
+		GET /metrics
+	}`)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/other", nil))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if next.request != nil {
+		t.Error("metrics request was forwarded")
+	}
+	body := recorder.Body.String()
+	for _, metric := range []string{
+		`caddy_permission_decisions_total{backend="",outcome="login",permit_type=""}`,
+		`caddy_permission_backend_duration_seconds_count{backend="basic",operation="authenticate"}`,
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("metric %s missing in:\n%s", metric, body)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	handler, _ := newTestHandler(t, `
+	permission explain /.permission
+	permission basic {
+		user greg qwerty1
+		rw /tmp/
+		ro /
+
+		public
+		ro /static
+	}`)
+
+	r := httptest.NewRequest("GET", "/.permission/whoami", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	whoami := &WhoamiResponse{}
+	err := json.Unmarshal(recorder.Body.Bytes(), whoami)
+	if err != nil {
+		t.Fatalf("failed to parse whoami response: %s", err)
+	}
+	if !whoami.Authenticated || whoami.Identity.Username != "greg" || whoami.Identity.Source != "basic" {
+		t.Errorf("unexpected whoami response: %s", recorder.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/.permission/explain?method=PUT&path=/other", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	explain := &ExplainResponse{}
+	err = json.Unmarshal(recorder.Body.Bytes(), explain)
+	if err != nil {
+		t.Fatalf("failed to parse explain response: %s", err)
+	}
+	if explain.Allowed || len(explain.Checks) != 1 {
+		t.Fatalf("unexpected explain response: %s", recorder.Body.String())
+	}
+	decidedBy := explain.Checks[0].DecidedBy
+	if decidedBy == nil || decidedBy.PermitType != "user" || decidedBy.Rule.Path != "/" || decidedBy.Rule.Methods != "GET,HEAD,PROPFIND,OPTIONS,LOCK,UNLOCK" {
+		t.Errorf("unexpected explain response: %s", recorder.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/.permission/explain?method=MOVE&path=/tmp/a&destination=/tmp/b", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	explain = &ExplainResponse{}
+	err = json.Unmarshal(recorder.Body.Bytes(), explain)
+	if err != nil {
+		t.Fatalf("failed to parse explain response: %s", err)
+	}
+	if !explain.Allowed || len(explain.Checks) != 2 || explain.Checks[0].Method != "DELETE" || explain.Checks[1].Method != "PUT" {
+		t.Errorf("unexpected explain response: %s", recorder.Body.String())
+	}
+
+	// the endpoints are subject to the rules
+	r = httptest.NewRequest("GET", "/.permission/explain?path=/tmp/", nil)
+	recorder = httptest.NewRecorder()
+	status, _ := handler.ServeHTTP(recorder, r)
+	if status != http.StatusUnauthorized || recorder.Body.Len() != 0 {
+		t.Errorf("expected anonymous explain request to be denied, got %d: %s", status, recorder.Body.String())
+	}
+
+	// errors of backends are not revealed
+	check := (&Trace{}).AddCheck("GET", "/")
+	check.AddPermit(handler.Backends[0], PermitTypeUser, nil, false, nil, errors.New("dial tcp 10.0.0.1:5432: connection refused"))
+	if check.Permits[0].Error != errTracePermit {
+		t.Errorf("unexpected error in trace: %s", check.Permits[0].Error)
+	}
+}
+
+func TestReportOnly(t *testing.T) {
+	handler, next := newTestHandler(t, `
+	permission mode report_only
+	permission basic {
+		user greg qwerty1
+		rw /tmp/
+	}`)
+
+	tests := []struct {
+		method    string
+		path      string
+		user      string
+		wouldDeny string
+	}{
+		{"PUT", "/tmp/file", "greg", ""},
+		{"PUT", "/other/file", "greg", "forbidden"},
+		{"GET", "/tmp/file", "", "unauthenticated"},
+	}
+
+	for _, test := range tests {
+		next.request = nil
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set(WouldDenyHeader, "spoofed")
+		if test.user != "" {
+			r.SetBasicAuth(test.user, "qwerty1")
+		}
+		status, _ := handler.ServeHTTP(httptest.NewRecorder(), r)
+		if status != http.StatusOK || next.request == nil {
+			t.Errorf("%s %s as %q: request was not forwarded (status %d)", test.method, test.path, test.user, status)
+			continue
+		}
+		if next.request.Header.Get(WouldDenyHeader) != test.wouldDeny {
+			t.Errorf("%s %s as %q: expected %s header %q, got %q", test.method, test.path, test.user, WouldDenyHeader, test.wouldDeny, next.request.Header.Get(WouldDenyHeader))
+		}
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	caddyfile := `
+	example.com {
+		root /srv
+		permission basic {
+			user greg qwerty1
+			rw /tmp/
+			public
+			ro /static
+		}
+	}
+	other.example.com {
+		root /srv
+	}`
+
+	handler, err := ParseConfig("Caddyfile", strings.NewReader(caddyfile), "")
+	if err != nil {
+		t.Fatalf("failed to parse config: %s", err)
+	}
+	_, err = ParseConfig("Caddyfile", strings.NewReader(caddyfile), "other.example.com")
+	if err == nil {
+		t.Error("site without permission directives should fail")
+	}
+
+	cases := []*SimulationCase{
+		{User: "greg", Method: "PUT", Path: "/tmp/file", Expect: ExpectAllow},
+		{Method: "GET", Path: "/static/style.css", Expect: ExpectAllow},
+		{Method: "PUT", Path: "/static/style.css", Expect: ExpectDeny},
+		{User: "greg", Method: "MOVE", Path: "/tmp/file", Headers: map[string]string{"Location": "/static/file"}, Expect: ExpectDeny},
+		{User: "greg", Method: "MOVE", Path: "/tmp/file", Expect: ExpectDeny},
+	}
+	for _, simulationCase := range cases {
+		result := handler.Simulate(context.Background(), simulationCase)
+		if !result.Passed() {
+			t.Errorf("%s %s as %q: expected %s, got %s", simulationCase.Method, simulationCase.Path, simulationCase.User, simulationCase.Expect, result.Outcome())
+		}
+	}
+
+	result := handler.Simulate(context.Background(), cases[0])
+	if result.Decision.Rule == nil || result.Decision.Rule.Path != "/tmp/" || result.Decision.PermitType != PermitTypeUser {
+		t.Errorf("unexpected deciding rule: %+v", result.Decision)
+	}
+}
+
+func TestLint(t *testing.T) {
+	input := `
+	permission basic {
+		user greg qwerty1
+		get /static
+		any,GET /other
+		MOVE /move
+		ro /
+		rw /tmp/
+
+		user george
+		ro /
+
+		user greg qwerty2
+		rw /tmp/
+		rw /tmp/
+
+		public
+		~ /
+	}`
+
+	handler, err := NewHandler(caddy.NewTestController("http", input), 0)
+	if err != nil {
+		t.Fatalf("failed to create Handler: %s", err)
+	}
+
+	expected := []int{4, 5, 6, 8, 13, 15, 10}
+	if len(handler.Warnings) != len(expected) {
+		for _, warning := range handler.Warnings {
+			t.Log(warning)
+		}
+		t.Fatalf("expected %d warnings, got %d", len(expected), len(handler.Warnings))
+	}
+	for i, warning := range handler.Warnings {
+		if warning.Line != expected[i] {
+			t.Errorf("expected warning %d in line %d, got %s", i, expected[i], warning)
+		}
+	}
+
+	// another backend may authenticate george
+	handler, err = NewHandler(caddy.NewTestController("http", input+"\npermission tls"), 0)
+	if err != nil {
+		t.Fatalf("failed to create Handler: %s", err)
+	}
+	if len(handler.Warnings) != len(expected)-1 {
+		t.Errorf("expected %d warnings, got %d", len(expected)-1, len(handler.Warnings))
+	}
+
+	// share links and API keys do not authenticate users by name
+	handler, err = NewHandler(caddy.NewTestController("http", input+"\npermission share {\nsecret 0123456789abcdef\n}\npermission apikey {\nkey george "+HashAPIKey("s3cret")+"\n}"), 0)
+	if err != nil {
+		t.Fatalf("failed to create Handler: %s", err)
+	}
+	if len(handler.Warnings) != len(expected) {
+		t.Errorf("expected %d warnings, got %d", len(expected), len(handler.Warnings))
+	}
+
+	_, err = NewHandler(caddy.NewTestController("http", "permission strict\n"+input), 0)
+	if err == nil {
+		t.Error("strict mode should fail on warnings")
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	identity := NewIdentity("greg", "api")
+	identity.Headers = map[string]string{
+		"X-Tenant":          "acme",
+		"caddy-auth-user":   "admin",
+		"Caddy-Auth-Groups": "admins",
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Caddy-Auth-Groups", "forged")
+	setIdentityHeaders(r, identity)
+
+	if r.Header.Get("X-Tenant") != "acme" || r.Header.Get("Caddy-Auth-User") != "greg" || r.Header.Get("Caddy-Auth-Source") != "api" {
+		t.Errorf("unexpected headers: %v", r.Header)
+	}
+	if _, ok := r.Header["Caddy-Auth-Groups"]; ok {
+		t.Errorf("custom header replaced plugin header: %v", r.Header)
+	}
+}
+
+type userInfoTestBackend struct {
+	BasicBackend
+}
+
+func (backend *userInfoTestBackend) GetUserInfo(username string) *User {
+	return &User{Groups: []string{"staff"}, Email: username + "@example.com"}
+}
+
+func TestLegacyBackend(t *testing.T) {
+	backend := AdaptBackend(&userInfoTestBackend{BasicBackend{
+		Users: map[string]string{compileBasicAuthCreds("greg", "qwerty1"): "greg"},
+	}})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("greg", "qwerty1")
+	identity, err := backend.Authenticate(context.Background(), r)
+	if err != nil || identity == nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	if identity.Username != "greg" || len(identity.Groups) != 1 || identity.Attributes[AttributeEmail] != "greg@example.com" {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+
+	if GetFactory(BackendBasicName) == nil || GetFactoryV2(BackendBasicName) == nil {
+		t.Error("expected factories of basic backend")
+	}
+	if GetFactory(BackendShareName) != nil || GetFactoryV2(BackendShareName) == nil {
+		t.Error("expected only a BackendV2 factory of the share backend")
+	}
+}
@@ -0,0 +1,63 @@
+package permission
+
+// Identity attributes set by the included backends.
+const (
+	AttributeDisplayName = "name"
+	AttributeEmail       = "email"
+	AttributeKeyID       = "key_id"
+	// AttributeMFA is the second factor the user passed, eg. "totp".
+	AttributeMFA = "mfa"
+)
+
+// Identity describes an authenticated user.
+type Identity struct {
+	Username   string
+	Groups     []string
+	Attributes map[string]string
+	// Headers are added to allowed requests of this identity.
+	Headers map[string]string
+	// Source is the name of the backend that authenticated the user.
+	Source string
+}
+
+// NewIdentity creates a new Identity with the given username and source.
+func NewIdentity(username, source string) *Identity {
+	return &Identity{
+		Username: username,
+		Source:   source,
+	}
+}
+
+// InGroup returns whether the identity is a member of the given group.
+func (identity *Identity) InGroup(group string) bool {
+	for _, g := range identity.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAttribute sets an attribute of the identity.
+func (identity *Identity) SetAttribute(key, value string) {
+	if identity.Attributes == nil {
+		identity.Attributes = make(map[string]string)
+	}
+	identity.Attributes[key] = value
+}
+
+// withAttribute returns a copy of the identity with the attribute set.
+func (identity *Identity) withAttribute(key, value string) *Identity {
+	copied := *identity
+	copied.Attributes = make(map[string]string, len(identity.Attributes)+1)
+	for k, v := range identity.Attributes {
+		copied.Attributes[k] = v
+	}
+	copied.Attributes[key] = value
+	return &copied
+}
+
+// HasMFA returns whether the user passed a second factor.
+func (identity *Identity) HasMFA() bool {
+	return identity != nil && identity.Attributes[AttributeMFA] != ""
+}
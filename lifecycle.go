@@ -0,0 +1,103 @@
+package permission
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	predecessors     = make(map[string]*Handler)
+	predecessorsLock sync.Mutex
+)
+
+// errNotStarted is returned by backends that need resources which are only opened when the backend starts, and in simulations.
+var errNotStarted = errors.New("backend is not started")
+
+// Start starts all backends that implement Starter.
+// If a backend fails to start, the handler is closed again, so that the backends started before release their resources.
+func (handler *Handler) Start() error {
+	for _, backend := range handler.Backends {
+		if starter, ok := unwrapBackend(backend).(Starter); ok {
+			err := starter.Start()
+			if err != nil {
+				handler.Close()
+				return fmt.Errorf("failed to start permission backend %s: %s", backend.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes all backends that implement Closer and the audit log.
+func (handler *Handler) Close() error {
+	var lastErr error
+	for _, backend := range handler.Backends {
+		if closer, ok := unwrapBackend(backend).(Closer); ok {
+			err := closer.Close()
+			if err != nil {
+				lastErr = fmt.Errorf("failed to close permission backend %s: %s", backend.Name(), err)
+				if printError || printDebug {
+					fmt.Printf("[permission] %s\n", lastErr)
+				}
+			}
+		}
+	}
+	err := handler.Audit.Close()
+	if err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
+
+// TakeOver hands the state of the backends of the predecessor over to the backends of this handler with the same name.
+// Logged out sessions of the login form stay invalid.
+func (handler *Handler) TakeOver(predecessor *Handler) error {
+	if handler.LoginForm != nil && predecessor.LoginForm != nil {
+		handler.LoginForm.takeOver(predecessor.LoginForm)
+	}
+	if predecessor.RateLimiter != nil {
+		handler.RateLimiter = predecessor.RateLimiter
+	}
+	for _, backend := range handler.Backends {
+		successor, ok := unwrapBackend(backend).(Successor)
+		if !ok {
+			continue
+		}
+		for _, old := range predecessor.Backends {
+			if old.Name() == backend.Name() {
+				err := successor.TakeOver(unwrapBackend(old))
+				if err != nil {
+					return fmt.Errorf("permission backend %s failed to take over state: %s", backend.Name(), err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// registerPredecessor marks the handler of a site as being replaced by a reload.
+func registerPredecessor(key string, handler *Handler) {
+	predecessorsLock.Lock()
+	defer predecessorsLock.Unlock()
+	predecessors[key] = handler
+}
+
+// unregisterPredecessor removes the handler of a site, if it is still registered.
+func unregisterPredecessor(key string, handler *Handler) {
+	predecessorsLock.Lock()
+	defer predecessorsLock.Unlock()
+	if predecessors[key] == handler {
+		delete(predecessors, key)
+	}
+}
+
+// takePredecessor returns and removes the handler that is being replaced for the given site.
+func takePredecessor(key string) *Handler {
+	predecessorsLock.Lock()
+	defer predecessorsLock.Unlock()
+	handler := predecessors[key]
+	delete(predecessors, key)
+	return handler
+}
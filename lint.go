@@ -0,0 +1,115 @@
+package permission
+
+import (
+	"fmt"
+	"strings"
+)
+
+// knownMethods are the methods that rules are checked against. MOVE and COPY are not included, as they are checked as DELETE/GET on the source and PUT on the destination.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "CONNECT": true, "OPTIONS": true, "TRACE": true, "PATCH": true,
+	"PROPFIND": true, "PROPPATCH": true, "MKCOL": true, "LOCK": true, "UNLOCK": true,
+	"WEBSOCKET": true,
+}
+
+// LintWarning describes a likely mistake in the configuration.
+type LintWarning struct {
+	File    string
+	Line    int
+	Backend string
+	Message string
+}
+
+func (warning *LintWarning) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", warning.File, warning.Line, warning.Backend, warning.Message)
+}
+
+// Lint checks the configuration of all backends that implement Linter for likely mistakes.
+func (handler *Handler) Lint() []*LintWarning {
+	var warnings []*LintWarning
+	passwordUsers := make(map[string]bool)
+	var passwordless []*basicUser
+	otherAuthenticators := false
+
+	for _, backend := range handler.Backends {
+		original := unwrapBackend(backend)
+		if linter, ok := original.(Linter); ok {
+			warnings = append(warnings, linter.Lint()...)
+		}
+
+		switch original := original.(type) {
+		case *BasicBackend:
+			for _, username := range original.Users {
+				passwordUsers[username] = true
+			}
+			passwordless = append(passwordless, original.passwordless...)
+		case *APIBackend, *SQLBackend, *LocalBackend, *FileBackend, *TLSBackend:
+			otherAuthenticators = true
+		default:
+			// backends of other plugins may authenticate users by name, API keys, share links and policies do not
+			if _, legacy := backend.(*LegacyBackend); legacy {
+				otherAuthenticators = true
+			}
+		}
+	}
+
+	// users without a password need another backend to authenticate them
+	if !otherAuthenticators {
+		for _, user := range passwordless {
+			if !passwordUsers[user.name] {
+				warnings = append(warnings, &LintWarning{
+					File:    user.file,
+					Line:    user.line,
+					Backend: BackendBasicName,
+					Message: fmt.Sprintf("user %s has no password and there is no other backend to authenticate them", user.name),
+				})
+			}
+		}
+	}
+
+	return warnings
+}
+
+// LintMethods checks a method string of a rule for unknown methods and misused aliases.
+func LintMethods(methods string) []string {
+	methods, _ = splitRuleOptions(methods)
+	methods, _ = trimMFAFlag(methods)
+	switch methods {
+	case blacklistChar, "none", "any":
+		return nil
+	}
+
+	var messages []string
+	for _, method := range strings.Split(strings.TrimPrefix(methods, blacklistChar), ",") {
+		method = strings.TrimSpace(method)
+		if _, ok := aliases[method]; ok || knownMethods[method] {
+			continue
+		}
+		switch {
+		case method == "any" || method == "none" || method == blacklistChar:
+			messages = append(messages, fmt.Sprintf("\"%s\" cannot be combined with other methods and is taken as a method name in \"%s\"", method, methods))
+		case method == "MOVE":
+			messages = append(messages, "MOVE is never checked directly, it is checked as DELETE on the source and PUT on the destination")
+		case method == "COPY":
+			messages = append(messages, "COPY is never checked directly, it is checked as GET on the source and PUT on the destination")
+		case knownMethods[strings.ToUpper(method)] || aliases[strings.ToLower(method)] != nil:
+			messages = append(messages, fmt.Sprintf("methods are case sensitive, \"%s\" never matches", method))
+		default:
+			messages = append(messages, fmt.Sprintf(errUnknownMethod, method))
+		}
+	}
+	return messages
+}
+
+// LintRule checks whether a rule is shadowed by one of the preceding rules of the same permit. As the first matching rule decides, a rule is unreachable if a preceding rule matches all of its paths.
+func LintRule(preceding []*Rule, rule *Rule) []string {
+	for _, previous := range preceding {
+		if rule.Path == previous.Path {
+			return []string{fmt.Sprintf("rule \"%s %s\" is unreachable, a previous rule for the same path matches first", rule.MethodString(), rule.Path)}
+		}
+		if previous.MatchesPath(rule.Path) {
+			return []string{fmt.Sprintf("rule \"%s %s\" is unreachable, the previous rule \"%s %s\" matches first", rule.MethodString(), rule.Path, previous.MethodString(), previous.Path)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package permission
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+const (
+	defaultLockoutUserThreshold = 5
+	defaultLockoutIPThreshold   = 20
+	defaultLockoutDelay         = 1
+	defaultLockoutMaxDelay      = 15 * 60
+	defaultLockoutReset         = 3600
+
+	// lockoutPruneInterval is the minimum time between removing forgotten failures.
+	lockoutPruneInterval = 60
+)
+
+// Lockout slows down guessing passwords. Failed attempts are counted per client IP and per username.
+// Once a threshold is reached, further attempts are rejected for a delay that doubles with every failure.
+type Lockout struct {
+	UserThreshold int
+	IPThreshold   int
+	// Delay is the first lockout in seconds, MaxDelay the longest.
+	Delay    int64
+	MaxDelay int64
+	// Reset is the time in seconds without failures after which failures are forgotten.
+	Reset int64
+	// TrustedProxies are the networks of reverse proxies whose X-Forwarded-For header tells the client IP.
+	TrustedProxies []*net.IPNet
+
+	lock      sync.Mutex
+	users     map[string]*failedAttempts
+	ips       map[string]*failedAttempts
+	lastPrune int64
+}
+
+// failedAttempts records the failed attempts of a client IP or username.
+type failedAttempts struct {
+	Failures    int
+	Last        int64
+	LockedUntil int64
+}
+
+// Check returns the seconds to wait before the next attempt of the client IP for the username, or 0 if it may try now.
+// It is safe to call Check on a nil Lockout.
+func (lockout *Lockout) Check(ip, username string) int64 {
+	if lockout == nil {
+		return 0
+	}
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	now := time.Now().Unix()
+	var wait int64
+	for _, attempts := range []*failedAttempts{lockout.ips[ip], lockout.users[username]} {
+		if attempts != nil && attempts.LockedUntil-now > wait {
+			wait = attempts.LockedUntil - now
+		}
+	}
+	return wait
+}
+
+// Fail records a failed attempt of the client IP for the username.
+func (lockout *Lockout) Fail(ip, username string) {
+	if lockout == nil {
+		return
+	}
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+
+	now := time.Now().Unix()
+	lockout.prune(now)
+	if lockout.ips == nil {
+		lockout.ips = make(map[string]*failedAttempts)
+		lockout.users = make(map[string]*failedAttempts)
+	}
+	lockout.fail(lockout.ips, ip, lockout.IPThreshold, now)
+	if username != "" {
+		lockout.fail(lockout.users, username, lockout.UserThreshold, now)
+	}
+}
+
+func (lockout *Lockout) fail(attemptsByKey map[string]*failedAttempts, key string, threshold int, now int64) {
+	attempts, ok := attemptsByKey[key]
+	if !ok || now-attempts.Last > lockout.Reset {
+		attempts = &failedAttempts{}
+		attemptsByKey[key] = attempts
+	}
+	attempts.Failures++
+	attempts.Last = now
+	if attempts.Failures < threshold {
+		return
+	}
+
+	delay := lockout.Delay
+	for i := threshold; i < attempts.Failures && delay < lockout.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > lockout.MaxDelay {
+		delay = lockout.MaxDelay
+	}
+	attempts.LockedUntil = now + delay
+}
+
+// Succeed forgets the failed attempts for the username. Failures of the client IP are kept, so that a single valid account cannot be used to guess others.
+func (lockout *Lockout) Succeed(username string) {
+	if lockout == nil {
+		return
+	}
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+	delete(lockout.users, username)
+}
+
+// prune removes failures that are forgotten. The caller must hold the lock.
+func (lockout *Lockout) prune(now int64) {
+	if now-lockout.lastPrune < lockoutPruneInterval {
+		return
+	}
+	lockout.lastPrune = now
+	for _, attemptsByKey := range []map[string]*failedAttempts{lockout.ips, lockout.users} {
+		for key, attempts := range attemptsByKey {
+			if now-attempts.Last > lockout.Reset && attempts.LockedUntil < now {
+				delete(attemptsByKey, key)
+			}
+		}
+	}
+}
+
+// lockedOut rejects an attempt during a lockout with 429 Too Many Requests.
+func (handler *Handler) lockedOut(w http.ResponseWriter, r *http.Request, username string, wait int64, start time.Time) (int, error) {
+	metricLockouts.Inc()
+	handler.Audit.LogAttempt(r, username, OutcomeLockedOut, start)
+	if printDebug {
+		fmt.Printf("[permission] rejected attempt for %s from %s, locked out for %ds\n", username, r.RemoteAddr, wait)
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+	return http.StatusTooManyRequests, nil
+}
+
+// failedLogin records a failed attempt to log in as username.
+func (handler *Handler) failedLogin(r *http.Request, username string, start time.Time) {
+	metricFailedLogins.Inc()
+	handler.Audit.LogAttempt(r, username, OutcomeFailedLogin, start)
+	handler.Lockout.Fail(handler.Lockout.clientIP(r), username)
+}
+
+// clientIP returns the IP address of the client of the request. Behind trusted proxies, it is the last address in the
+// X-Forwarded-For header that is not a trusted proxy. It is safe to call clientIP on a nil Lockout.
+func (lockout *Lockout) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if lockout == nil || !lockout.trusted(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !lockout.trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// trusted returns whether the IP address is a trusted proxy.
+func (lockout *Lockout) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range lockout.TrustedProxies {
+		if parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the client of the request.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// NewLockout creates a new Lockout from configuration.
+func NewLockout(c *caddy.Controller) (*Lockout, error) {
+	new := &Lockout{
+		UserThreshold: defaultLockoutUserThreshold,
+		IPThreshold:   defaultLockoutIPThreshold,
+		Delay:         defaultLockoutDelay,
+		MaxDelay:      defaultLockoutMaxDelay,
+		Reset:         defaultLockoutReset,
+	}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "user_threshold", "ip_threshold", "delay", "max_delay", "reset":
+			option := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			i, err := strconv.ParseInt(c.Val(), 10, 64)
+			if err != nil || i <= 0 {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "user_threshold":
+				new.UserThreshold = int(i)
+			case "ip_threshold":
+				new.IPThreshold = int(i)
+			case "delay":
+				new.Delay = i
+			case "max_delay":
+				new.MaxDelay = i
+			case "reset":
+				new.Reset = i
+			}
+		case "trusted_proxies":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, arg := range args {
+				network, err := parseNetwork(arg)
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				new.TrustedProxies = append(new.TrustedProxies, network)
+			}
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	if new.Delay > new.MaxDelay {
+		return nil, c.Errf("permission > lockout: delay may not be longer than max_delay")
+	}
+
+	return new, nil
+}
@@ -0,0 +1,204 @@
+package permission
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestLockoutBackoff(t *testing.T) {
+	lockout := &Lockout{
+		UserThreshold: 3,
+		IPThreshold:   5,
+		Delay:         2,
+		MaxDelay:      8,
+		Reset:         3600,
+	}
+
+	for i, expected := range []int64{0, 0, 2, 4, 8, 8} {
+		lockout.Fail("192.0.2.1", "greg")
+		if wait := lockout.Check("192.0.2.2", "greg"); wait != expected {
+			t.Errorf("failure %d: expected to wait %d seconds, got %d", i+1, expected, wait)
+		}
+	}
+
+	// success forgets the failures of the user, but not of the client
+	lockout.Succeed("greg")
+	if wait := lockout.Check("192.0.2.2", "greg"); wait != 0 {
+		t.Errorf("expected user to be unlocked, got %d", wait)
+	}
+	if wait := lockout.Check("192.0.2.1", "george"); wait == 0 {
+		t.Error("expected client to stay locked out")
+	}
+
+	// nil lockouts never lock out
+	var disabled *Lockout
+	disabled.Fail("192.0.2.1", "greg")
+	if disabled.Check("192.0.2.1", "greg") != 0 {
+		t.Error("disabled lockout locked out")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	handler, next := newTestHandler(t, `
+	permission lockout {
+		user_threshold 2
+		delay 60
+	}
+	permission audit stdout
+	permission login /.login {
+		secret 0123456789abcdef
+	}
+	permission basic {
+		user greg qwerty1
+		user george qwerty2
+		rw /
+	}`)
+	buf := &bytes.Buffer{}
+	handler.Audit.writer = buf
+
+	request := func(username, password string) *httptest.ResponseRecorder {
+		next.request = nil
+		r := httptest.NewRequest("GET", "/file", nil)
+		r.SetBasicAuth(username, password)
+		w := httptest.NewRecorder()
+		status, _ := handler.ServeHTTP(w, r)
+		if status != 0 {
+			w.Code = status
+		}
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("greg", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected wrong password to be rejected, got %d", w.Code)
+		}
+	}
+	w := request("greg", "qwerty1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" || next.request != nil {
+		t.Errorf("expected user to be locked out, got %d (Retry-After %q)", w.Code, w.Header().Get("Retry-After"))
+	}
+	if request("george", "qwerty2"); next.request == nil {
+		t.Error("expected other user to be allowed")
+	}
+
+	// the login form is locked out as well
+	body := url.Values{"username": {"greg"}, "password": {"qwerty1"}}
+	r := newLoginRequest(handler.LoginForm, body)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests || len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected login form to be locked out, got %d", w.Code)
+	}
+
+	outcomes := make(map[string]int)
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		err := json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			t.Fatalf("failed to parse audit log entry %q: %s", scanner.Text(), err)
+		}
+		if entry.Outcome == OutcomeFailedLogin || entry.Outcome == OutcomeLockedOut {
+			if entry.Attempt != "greg" || entry.User != "" {
+				t.Errorf("unexpected audit log entry: %+v", entry)
+			}
+			outcomes[entry.Outcome]++
+		}
+	}
+	if outcomes[OutcomeFailedLogin] != 2 || outcomes[OutcomeLockedOut] != 2 {
+		t.Errorf("unexpected audit log entries: %v", outcomes)
+	}
+}
+
+func TestLockoutBackendErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	handler, _ := newTestHandler(t, `
+	permission lockout {
+		user_threshold 1
+		ip_threshold 1
+	}
+	permission login /.login {
+		secret 0123456789abcdef
+	}
+	permission api {
+		user `+server.URL+`
+		permit `+server.URL+`/{{username}}
+	}`)
+
+	// failing backends do not reject credentials
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/file", nil)
+		r.SetBasicAuth("greg", "qwerty1")
+		w := httptest.NewRecorder()
+		if status, _ := handler.ServeHTTP(w, r); status == http.StatusTooManyRequests {
+			t.Fatal("expected backend errors not to lock out users")
+		}
+	}
+	body := url.Values{"username": {"greg"}, "password": {"qwerty1"}}
+	r := newLoginRequest(handler.LoginForm, body)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected login form to be unavailable, got %d", w.Code)
+	}
+	if wait := handler.Lockout.Check("192.0.2.1", "greg"); wait != 0 {
+		t.Errorf("expected no lockout, got %d", wait)
+	}
+
+	// credentials rejected by another backend are counted, although a backend fails
+	handler, _ = newTestHandler(t, `
+	permission lockout {
+		user_threshold 2
+	}
+	permission login /.login {
+		secret 0123456789abcdef
+	}
+	permission api {
+		user `+server.URL+`
+		permit `+server.URL+`/{{username}}
+	}
+	permission basic {
+		user greg qwerty1
+		rw /
+	}`)
+	r = httptest.NewRequest("GET", "/file", nil)
+	r.SetBasicAuth("greg", "wrong")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	r = newLoginRequest(handler.LoginForm, url.Values{"username": {"greg"}, "password": {"wrong"}})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected login form to reject the credentials, got %d", w.Code)
+	}
+	if wait := handler.Lockout.Check("192.0.2.1", "greg"); wait == 0 {
+		t.Error("expected rejected credentials to lock out the user")
+	}
+}
+
+func TestLockoutClientIP(t *testing.T) {
+	lockout := &Lockout{}
+	proxy, _ := parseNetwork("10.0.0.0/8")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7, 10.0.0.2")
+
+	if ip := lockout.clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("expected untrusted header to be ignored, got %s", ip)
+	}
+	lockout.TrustedProxies = append(lockout.TrustedProxies, proxy)
+	if ip := lockout.clientIP(r); ip != "198.51.100.7" {
+		t.Errorf("expected last untrusted address, got %s", ip)
+	}
+	r.RemoteAddr = "192.0.2.1:1234"
+	if ip := lockout.clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("expected header of untrusted client to be ignored, got %s", ip)
+	}
+}
@@ -0,0 +1,528 @@
+package permission
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+const (
+	defaultSessionCookie   = "caddy_session"
+	defaultSessionIdle     = 30 * 60
+	defaultSessionLifetime = 12 * 3600
+
+	// csrfCookieSuffix is appended to the name of the session cookie for the cookie that binds the login form to the browser.
+	csrfCookieSuffix = "_csrf"
+	csrfField        = "csrf"
+
+	// sessionRefreshInterval is the minimum time between updates of the last activity of a session, to avoid setting the cookie on every request.
+	sessionRefreshInterval = 60
+)
+
+// LoginForm serves a login page and authenticates browsers with an encrypted session cookie.
+// Credentials are checked by the backends that support HTTP Basic Authentication.
+type LoginForm struct {
+	Path       string
+	LogoutPath string
+	Cookie     string
+	// Idle and Lifetime are the idle and absolute timeouts of sessions in seconds.
+	Idle     int64
+	Lifetime int64
+	// Secure sets the Secure flag of the cookie, even if the request was not received via TLS, eg. behind a proxy.
+	Secure bool
+	// Title is the title of the login page, the realm by default.
+	Title string
+
+	key []byte
+	// remember is how long the second factor remembers devices, revocations of users are kept at least as long.
+	remember int64
+
+	// revocations are kept in memory of this instance only, other nodes keep accepting the sessions, even with a shared redis store.
+	revokedLock sync.Mutex
+	// revokedUsers holds the time of the last "log out everywhere" of users, sessions issued until then are invalid.
+	revokedUsers map[string]int64
+	// revokedSessions holds the IDs of logged out sessions and when they would have expired.
+	revokedSessions map[string]int64
+}
+
+// Session is the content of a session cookie.
+type Session struct {
+	ID       string
+	Identity *Identity
+	Issued   int64
+	LastSeen int64
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; }
+form { max-width: 20em; margin: 10vh auto; padding: 2em; background: #fff; border-radius: 4px; box-shadow: 0 1px 4px rgba(0,0,0,.2); }
+label, input { display: block; width: 100%; box-sizing: border-box; }
+input { margin: .3em 0 1em; padding: .5em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label for="username">Username</label>
+<input id="username" name="username" value="{{.Username}}" autocomplete="username" autofocus required>
+<label for="password">Password</label>
+<input id="password" name="password" type="password" autocomplete="current-password" required>
+<input type="submit" value="Log in">
+</form>
+</body>
+</html>
+`))
+
+type loginPage struct {
+	Title    string
+	Action   string
+	Next     string
+	CSRF     string
+	Username string
+	Error    string
+}
+
+// Serves returns whether the path is served by the login form.
+func (form *LoginForm) Serves(path string) bool {
+	return path == form.Path || path == form.LogoutPath
+}
+
+// ServeHTTP serves the login page, logs users in and out.
+func (form *LoginForm) ServeHTTP(w http.ResponseWriter, r *http.Request, handler *Handler) (int, error) {
+	if r.URL.Path == form.LogoutPath {
+		var cookies []string
+		if handler.Logout != nil {
+			cookies = handler.Logout.Cookies
+		}
+		handler.logOut(w, r, cookies, logoutEverywhere(r))
+		http.Redirect(w, r, form.Path, http.StatusSeeOther)
+		return 0, nil
+	}
+
+	page := &loginPage{
+		Title:  form.Title,
+		Action: form.Path,
+		Next:   localRedirect(r.FormValue("next")),
+	}
+	if page.Title == "" {
+		page.Title = handler.Realm
+	}
+	if page.Title == "" {
+		page.Title = "Login"
+	}
+	page.CSRF = form.prepareCSRF(w, r)
+
+	switch r.Method {
+	case "GET", "HEAD":
+		return form.render(w, loginTemplate, http.StatusOK, page)
+	case "POST":
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	start := time.Now()
+	page.Username = r.PostFormValue("username")
+	if !form.checkCSRF(r) {
+		page.Error = "The login page has expired, please try again."
+		return form.render(w, loginTemplate, http.StatusForbidden, page)
+	}
+	if wait := handler.Lockout.Check(handler.Lockout.clientIP(r), page.Username); wait > 0 {
+		handler.lockedOut(w, r, page.Username, wait, start)
+		page.Error = fmt.Sprintf("Too many failed attempts, please try again in %d seconds.", wait)
+		return form.render(w, loginTemplate, http.StatusTooManyRequests, page)
+	}
+	identity, rejected, err := handler.verifyPassword(r.Context(), r, page.Username, r.PostFormValue("password"))
+	if identity == nil && !rejected && err != nil {
+		page.Error = "Login is currently not available, please try again later."
+		return form.render(w, loginTemplate, http.StatusServiceUnavailable, page)
+	}
+	if identity == nil {
+		handler.failedLogin(r, page.Username, start)
+		page.Error = "Invalid username or password."
+		return form.render(w, loginTemplate, http.StatusUnauthorized, page)
+	}
+	handler.Lockout.Succeed(page.Username)
+
+	err = form.setCookie(w, r, form.NewSession(identity))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// ask for the second factor right away, if configured
+	if mfa := handler.MFA; mfa != nil && mfa.AtLogin && mfa.Enrolled(identity.Username) && !mfa.Remembered(r, identity.Username) {
+		http.Redirect(w, r, mfa.Path+"?next="+url.QueryEscape(page.Next), http.StatusSeeOther)
+		return 0, nil
+	}
+	http.Redirect(w, r, page.Next, http.StatusSeeOther)
+	return 0, nil
+}
+
+// prepareCSRF returns the token of the login page. It is bound to a random value in a cookie, which is set if the browser does not have it yet,
+// so that other sites cannot log browsers into an account of their choice.
+func (form *LoginForm) prepareCSRF(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(form.Cookie + csrfCookieSuffix); err == nil && cookie.Value != "" {
+		return form.csrfToken(cookie.Value)
+	}
+	nonce := make([]byte, 16)
+	io.ReadFull(rand.Reader, nonce)
+	value := hex.EncodeToString(nonce)
+	http.SetCookie(w, &http.Cookie{
+		Name:     form.Cookie + csrfCookieSuffix,
+		Value:    value,
+		Path:     form.Path,
+		Secure:   form.Secure || r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return form.csrfToken(value)
+}
+
+// checkCSRF returns whether the login request has the token of its cookie.
+func (form *LoginForm) checkCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(form.Cookie + csrfCookieSuffix)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return hmac.Equal([]byte(r.PostFormValue(csrfField)), []byte(form.csrfToken(cookie.Value)))
+}
+
+// csrfToken returns the token of the login page for the value of the cookie.
+func (form *LoginForm) csrfToken(value string) string {
+	mac := hmac.New(sha256.New, form.key)
+	fmt.Fprintf(mac, "csrf\n%s", value)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (form *LoginForm) render(w http.ResponseWriter, tmpl *template.Template, status int, page interface{}) (int, error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	err := tmpl.Execute(w, page)
+	return 0, err
+}
+
+// Redirect sends browsers to the login page, so that they return to the requested resource afterwards.
+// It returns false for other clients, which are left to the login of the backends.
+func (form *LoginForm) Redirect(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	http.Redirect(w, r, form.Path+"?next="+url.QueryEscape(r.RequestURI), http.StatusFound)
+	return true
+}
+
+// NewSession creates a new session for the identity.
+func (form *LoginForm) NewSession(identity *Identity) *Session {
+	id := make([]byte, 16)
+	io.ReadFull(rand.Reader, id)
+	now := time.Now().Unix()
+	return &Session{
+		ID:       hex.EncodeToString(id),
+		Identity: identity,
+		Issued:   now,
+		LastSeen: now,
+	}
+}
+
+// Resume returns the session of the request, if it has a valid session cookie, and records the activity.
+func (form *LoginForm) Resume(w http.ResponseWriter, r *http.Request) *Session {
+	session, valid := form.session(r)
+	if session == nil {
+		return nil
+	}
+	if !valid {
+		form.clearCookie(w, r)
+		return nil
+	}
+	now := time.Now().Unix()
+	if now-session.LastSeen >= sessionRefreshInterval {
+		session.LastSeen = now
+		form.setCookie(w, r, session)
+	}
+	return session
+}
+
+// session returns the session of the request's cookie, if any, and whether it is still valid.
+func (form *LoginForm) session(r *http.Request) (*Session, bool) {
+	cookie, err := r.Cookie(form.Cookie)
+	if err != nil {
+		return nil, false
+	}
+	session, err := form.decode(cookie.Value)
+	if err != nil {
+		if printDebug {
+			fmt.Printf("[permission] ignoring invalid session cookie: %s\n", err)
+		}
+		return nil, false
+	}
+
+	now := time.Now().Unix()
+	if now-session.LastSeen > form.Idle || now-session.Issued > form.Lifetime {
+		return session, false
+	}
+	return session, !form.revoked(session)
+}
+
+// revoked returns whether the session was logged out.
+func (form *LoginForm) revoked(session *Session) bool {
+	form.revokedLock.Lock()
+	defer form.revokedLock.Unlock()
+	if _, ok := form.revokedSessions[session.ID]; ok {
+		return true
+	}
+	revokedAt, ok := form.revokedUsers[session.Identity.Username]
+	return ok && session.Issued <= revokedAt
+}
+
+// revokedUser returns whether the user was logged out everywhere since issued.
+func (form *LoginForm) revokedUser(username string, issued int64) bool {
+	form.revokedLock.Lock()
+	defer form.revokedLock.Unlock()
+	revokedAt, ok := form.revokedUsers[username]
+	return ok && issued <= revokedAt
+}
+
+// RevokeSession invalidates a session, even if its cookie is kept.
+func (form *LoginForm) RevokeSession(session *Session) {
+	form.revokedLock.Lock()
+	defer form.revokedLock.Unlock()
+	form.pruneRevoked(time.Now().Unix())
+	if form.revokedSessions == nil {
+		form.revokedSessions = make(map[string]int64)
+	}
+	form.revokedSessions[session.ID] = session.Issued + form.Lifetime
+}
+
+// RevokeUser invalidates all sessions of a user issued until now.
+func (form *LoginForm) RevokeUser(username string) {
+	form.revokedLock.Lock()
+	defer form.revokedLock.Unlock()
+	now := time.Now().Unix()
+	form.pruneRevoked(now)
+	if form.revokedUsers == nil {
+		form.revokedUsers = make(map[string]int64)
+	}
+	form.revokedUsers[username] = now
+}
+
+// pruneRevoked forgets revocations of sessions that have expired anyway. The caller must hold revokedLock.
+func (form *LoginForm) pruneRevoked(now int64) {
+	for id, expires := range form.revokedSessions {
+		if expires < now {
+			delete(form.revokedSessions, id)
+		}
+	}
+	keep := form.Lifetime
+	if form.remember > keep {
+		keep = form.remember
+	}
+	for username, revokedAt := range form.revokedUsers {
+		if revokedAt+keep < now {
+			delete(form.revokedUsers, username)
+		}
+	}
+}
+
+// takeOver copies the revocations of the login form this one replaces, so that logged out sessions stay invalid after a reload.
+func (form *LoginForm) takeOver(predecessor *LoginForm) {
+	predecessor.revokedLock.Lock()
+	defer predecessor.revokedLock.Unlock()
+	form.revokedLock.Lock()
+	defer form.revokedLock.Unlock()
+	if len(predecessor.revokedSessions) > 0 && form.revokedSessions == nil {
+		form.revokedSessions = make(map[string]int64)
+	}
+	for id, expires := range predecessor.revokedSessions {
+		form.revokedSessions[id] = expires
+	}
+	if len(predecessor.revokedUsers) > 0 && form.revokedUsers == nil {
+		form.revokedUsers = make(map[string]int64)
+	}
+	for username, revokedAt := range predecessor.revokedUsers {
+		form.revokedUsers[username] = revokedAt
+	}
+}
+
+func (form *LoginForm) setCookie(w http.ResponseWriter, r *http.Request, session *Session) error {
+	value, err := form.encode(session)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     form.Cookie,
+		Value:    value,
+		Path:     "/",
+		Secure:   form.Secure || r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (form *LoginForm) clearCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     form.Cookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   form.Secure || r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// encode encrypts and authenticates a session with AES-GCM.
+func (form *LoginForm) encode(session *Session) (string, error) {
+	plaintext, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(form.key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, []byte(form.Cookie))), nil
+}
+
+func (form *LoginForm) decode(value string) (*Session, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(form.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("cookie too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(form.Cookie))
+	if err != nil {
+		return nil, errors.New("could not decrypt cookie")
+	}
+	session := &Session{}
+	err = json.Unmarshal(plaintext, session)
+	if err != nil || session.Identity == nil {
+		return nil, errors.New("invalid session")
+	}
+	return session, nil
+}
+
+// verifyPassword checks the credentials with the backends that support HTTP Basic Authentication and returns the identity, if successful.
+// Only the credentials of the original request are passed on, so that the user is not authenticated by other means, such as a client certificate.
+// An error is returned if no backend accepted the credentials and a backend failed, rejected reports whether a backend rejected them.
+func (handler *Handler) verifyPassword(ctx context.Context, r *http.Request, username, password string) (identity *Identity, rejected bool, err error) {
+	if username == "" || password == "" {
+		return nil, false, nil
+	}
+	check := new(http.Request)
+	*check = *r
+	check.Header = make(http.Header)
+	check.TLS = nil
+	check.SetBasicAuth(username, password)
+	return handler.authenticate(ctx, check.WithContext(ctx))
+}
+
+// localRedirect returns the target if it is a path on this site, or / otherwise.
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+// NewLoginForm creates a new LoginForm from configuration.
+func NewLoginForm(c *caddy.Controller) (*LoginForm, error) {
+	new := &LoginForm{
+		Cookie:   defaultSessionCookie,
+		Idle:     defaultSessionIdle,
+		Lifetime: defaultSessionLifetime,
+	}
+
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	new.Path = strings.TrimRight(c.Val(), "/")
+	new.LogoutPath = new.Path + "/logout"
+
+	var secret string
+	for c.NextBlock() {
+		switch c.Val() {
+		case "secret", "cookie", "logout", "title":
+			option := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "secret":
+				secret = c.Val()
+			case "cookie":
+				new.Cookie = c.Val()
+			case "logout":
+				new.LogoutPath = c.Val()
+			case "title":
+				new.Title = c.Val()
+			}
+		case "idle", "lifetime":
+			option := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			i, err := strconv.ParseInt(c.Val(), 10, 64)
+			if err != nil || i <= 0 {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "idle":
+				new.Idle = i
+			case "lifetime":
+				new.Lifetime = i
+			}
+		case "secure":
+			new.Secure = true
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	if len(secret) < 16 {
+		return nil, c.Errf("permission > login needs a secret of at least 16 characters")
+	}
+	key := sha256.Sum256([]byte(secret))
+	new.key = key[:]
+
+	return new, nil
+}
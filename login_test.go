@@ -0,0 +1,144 @@
+package permission
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLoginRequest returns a POST of the login form with a valid CSRF token.
+func newLoginRequest(form *LoginForm, body url.Values) *http.Request {
+	body.Set(csrfField, form.csrfToken("test"))
+	r := httptest.NewRequest("POST", form.Path, strings.NewReader(body.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: form.Cookie + csrfCookieSuffix, Value: "test"})
+	return r
+}
+
+func TestLoginForm(t *testing.T) {
+	handler, next := newTestHandler(t, `
+	permission login /.login {
+		secret 0123456789abcdef
+		idle 600
+		lifetime 3600
+	}
+	permission basic {
+		user greg qwerty1
+		rw /private/
+	}`)
+	form := handler.LoginForm
+
+	login := func(username, password, target string) *httptest.ResponseRecorder {
+		r := newLoginRequest(form, url.Values{"username": {username}, "password": {password}, "next": {target}})
+		w := httptest.NewRecorder()
+		status, _ := handler.ServeHTTP(w, r)
+		if status != 0 {
+			w.Code = status
+		}
+		return w
+	}
+	request := func(cookie *http.Cookie) (bool, *httptest.ResponseRecorder) {
+		next.request = nil
+		r := httptest.NewRequest("GET", "/private/file", nil)
+		r.Header.Set("Accept", "text/html,application/xhtml+xml")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return next.request != nil, w
+	}
+
+	// browsers are sent to the login form, other clients get the basic auth challenge
+	if allowed, w := request(nil); allowed || w.Code != http.StatusFound || w.Header().Get("Location") != "/.login?next=%2Fprivate%2Ffile" {
+		t.Errorf("expected redirect to login form, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	w := httptest.NewRecorder()
+	if status, _ := handler.ServeHTTP(w, httptest.NewRequest("GET", "/private/file", nil)); status != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected basic auth challenge, got %d", status)
+	}
+
+	// login page
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/.login?next=%2Fprivate%2Ffile", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="next" value="/private/file"`) {
+		t.Errorf("unexpected login page: %d %s", w.Code, w.Body.String())
+	}
+	csrfCookie := w.Result().Cookies()
+	if len(csrfCookie) != 1 || !strings.Contains(w.Body.String(), `name="csrf" value="`+form.csrfToken(csrfCookie[0].Value)+`"`) {
+		t.Errorf("expected login page to set CSRF cookie and token, got %v", csrfCookie)
+	}
+
+	// logins without the token of the cookie are rejected
+	for _, token := range []string{"", form.csrfToken("other")} {
+		r := newLoginRequest(form, url.Values{"username": {"greg"}, "password": {"qwerty1"}})
+		r.ParseForm()
+		r.PostForm.Set(csrfField, token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden || len(w.Result().Cookies()) != 0 {
+			t.Errorf("expected login with CSRF token %q to fail, got %d", token, w.Code)
+		}
+	}
+
+	if w := login("greg", "wrong", "/private/file"); w.Code != http.StatusUnauthorized || len(w.Result().Cookies()) != 0 {
+		t.Errorf("expected login with wrong password to fail, got %d", w.Code)
+	}
+	w = login("greg", "qwerty1", "/private/file")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/private/file" || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("failed to login: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cookie := w.Result().Cookies()[0]
+	if !cookie.HttpOnly || cookie.Name != defaultSessionCookie {
+		t.Errorf("unexpected cookie: %+v", cookie)
+	}
+	if allowed, _ := request(cookie); !allowed || next.request.Header.Get("Caddy-Auth-User") != "greg" {
+		t.Error("expected session to be accepted")
+	}
+
+	// the session cookie is not forwarded, other cookies are
+	next.request = nil
+	r := httptest.NewRequest("GET", "/private/file", nil)
+	r.AddCookie(cookie)
+	r.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if next.request == nil || next.request.Header.Get("Cookie") != "app=1" {
+		t.Errorf("expected only other cookies to be forwarded, got %v", next.request)
+	}
+
+	// only local redirects
+	if w := login("greg", "qwerty1", "//example.com/"); w.Header().Get("Location") != "/" {
+		t.Errorf("expected redirect to /, got %s", w.Header().Get("Location"))
+	}
+
+	// timeouts
+	now := time.Now().Unix()
+	for _, session := range []*Session{
+		{ID: "idle", Identity: NewIdentity("greg", "basic"), Issued: now - 700, LastSeen: now - 601},
+		{ID: "lifetime", Identity: NewIdentity("greg", "basic"), Issued: now - 3601, LastSeen: now},
+	} {
+		value, _ := form.encode(session)
+		if allowed, w := request(&http.Cookie{Name: defaultSessionCookie, Value: value}); allowed || len(w.Result().Cookies()) != 1 || w.Result().Cookies()[0].MaxAge >= 0 {
+			t.Errorf("%s: expected expired session to be rejected and removed", session.ID)
+		}
+	}
+	value, _ := form.encode(&Session{ID: "active", Identity: NewIdentity("greg", "basic"), Issued: now - 700, LastSeen: now - 120})
+	if allowed, w := request(&http.Cookie{Name: defaultSessionCookie, Value: value}); !allowed || len(w.Result().Cookies()) != 1 {
+		t.Error("expected active session to be accepted and refreshed")
+	}
+
+	// tampered cookies are ignored
+	if allowed, _ := request(&http.Cookie{Name: defaultSessionCookie, Value: cookie.Value[:len(cookie.Value)-2] + "AA"}); allowed {
+		t.Error("tampered session was accepted")
+	}
+
+	// logout
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/.login/logout", nil))
+	if w.Code != http.StatusSeeOther || len(w.Result().Cookies()) != 1 || w.Result().Cookies()[0].MaxAge >= 0 {
+		t.Error("expected logout to remove the cookie")
+	}
+}
@@ -0,0 +1,174 @@
+package permission
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+)
+
+// Logout serves a path that ends the session of the request.
+// The session cookie of the login form and the configured cookies are cleared and the backends are asked to revoke the user.
+// POST requests with the form value "everywhere" from a page of the same host end all sessions of the user.
+type Logout struct {
+	Path string
+	// Redirect is where users are sent afterwards, unless the request has a local "next" target.
+	Redirect string
+	// Cookies are the names of further cookies to clear, eg. those of an application behind Caddy.
+	Cookies []string
+}
+
+// ServeHTTP logs the user of the request out and redirects.
+func (logout *Logout) ServeHTTP(w http.ResponseWriter, r *http.Request, handler *Handler) (int, error) {
+	switch r.Method {
+	case "GET", "HEAD", "POST":
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	handler.logOut(w, r, logout.Cookies, logoutEverywhere(r))
+
+	target := logout.Redirect
+	if next := r.FormValue("next"); next != "" {
+		target = localRedirect(next)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+	return 0, nil
+}
+
+// logOut ends the session of the request, or all sessions of its user if everywhere is set, and returns the user, if known.
+func (handler *Handler) logOut(w http.ResponseWriter, r *http.Request, cookies []string, everywhere bool) *Identity {
+	ctx := r.Context()
+
+	var identity *Identity
+	if handler.LoginForm != nil {
+		if session, _ := handler.LoginForm.session(r); session != nil {
+			identity = session.Identity
+			handler.LoginForm.RevokeSession(session)
+		}
+		handler.LoginForm.clearCookie(w, r)
+	}
+	for _, name := range cookies {
+		http.SetCookie(w, &http.Cookie{
+			Name:   name,
+			Value:  "",
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+
+	if identity == nil {
+		identity = handler.Authenticate(ctx, r)
+	}
+	if identity == nil {
+		return nil
+	}
+
+	metricLogouts.WithLabelValues(logoutScope(everywhere)).Inc()
+	if printDebug {
+		fmt.Printf("[permission] %slogged out (%s)\n", getUserForPrinting(identity), logoutScope(everywhere))
+	}
+
+	if everywhere {
+		handler.RevokeUser(ctx, identity.Username)
+		return identity
+	}
+	for _, backend := range handler.Backends {
+		if revoker, ok := unwrapBackend(backend).(Revoker); ok {
+			err := revoker.Revoke(ctx, r, identity.Username)
+			if err != nil && (printError || printDebug) {
+				fmt.Printf("[permission] failed to log out %s from %s: %s\n", identity.Username, backend.Name(), err)
+			}
+		}
+	}
+	return identity
+}
+
+// RevokeUser ends all sessions of a user: sessions of the login form become invalid and all backends are asked to revoke the user.
+// Every backend is asked, even if one fails. The last error is returned.
+func (handler *Handler) RevokeUser(ctx context.Context, username string) error {
+	if handler.LoginForm != nil {
+		handler.LoginForm.RevokeUser(username)
+	}
+
+	var lastErr error
+	for _, backend := range handler.Backends {
+		if revoker, ok := unwrapBackend(backend).(Revoker); ok {
+			err := revoker.Revoke(ctx, nil, username)
+			if err != nil {
+				lastErr = fmt.Errorf("failed to log out %s from %s: %s", username, backend.Name(), err)
+				if printError || printDebug {
+					fmt.Printf("[permission] %s\n", lastErr)
+				}
+			}
+		}
+	}
+	return lastErr
+}
+
+// logoutEverywhere returns whether the request asks to end all sessions of the user.
+// Other sites could embed a link or submit a form, which carries the cached credentials of the browser,
+// so only POST requests whose Origin or Referer is the host of the request are accepted.
+func logoutEverywhere(r *http.Request) bool {
+	if r.Method != "POST" || r.PostFormValue("everywhere") == "" {
+		return false
+	}
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+	origin, err := url.Parse(source)
+	if err != nil || origin.Host == "" || origin.Host != r.Host {
+		if printDebug {
+			fmt.Printf("[permission] refusing to log out everywhere for request from %q\n", source)
+		}
+		return false
+	}
+	return true
+}
+
+func logoutScope(everywhere bool) string {
+	if everywhere {
+		return "everywhere"
+	}
+	return "session"
+}
+
+// NewLogout creates a new Logout from configuration.
+func NewLogout(c *caddy.Controller) (*Logout, error) {
+	new := &Logout{
+		Redirect: "/",
+	}
+
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	new.Path = c.Val()
+	if !strings.HasPrefix(new.Path, "/") {
+		return nil, c.Errf("permission > logout: path must start with /")
+	}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "redirect":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			new.Redirect = c.Val()
+		case "clear_cookie":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			new.Cookies = append(new.Cookies, args...)
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	return new, nil
+}
@@ -0,0 +1,117 @@
+package permission
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogout(t *testing.T) {
+	config := `
+	permission login /.login {
+		secret 0123456789abcdef
+	}
+	permission logout /.logout {
+		redirect /bye
+		clear_cookie app_session
+	}
+	permission admin /.admin {
+		user ops s3cret
+	}
+	permission basic {
+		user greg qwerty1
+		rw /private/
+	}`
+	handler, next := newTestHandler(t, config)
+	form := handler.LoginForm
+
+	sessionCookie := func(username string) *http.Cookie {
+		value, err := form.encode(form.NewSession(NewIdentity(username, "basic")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: defaultSessionCookie, Value: value}
+	}
+	allowed := func(cookie *http.Cookie) bool {
+		next.request = nil
+		r := httptest.NewRequest("GET", "/private/file", nil)
+		r.AddCookie(cookie)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		return next.request != nil
+	}
+	logout := func(method string, cookie *http.Cookie, everywhere bool, origin string) *httptest.ResponseRecorder {
+		body := url.Values{}
+		if everywhere {
+			body.Set("everywhere", "1")
+		}
+		r := httptest.NewRequest(method, "/.logout?"+body.Encode(), strings.NewReader(body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// logging out clears the cookies and invalidates the session, even if the cookie is kept
+	first, second := sessionCookie("greg"), sessionCookie("greg")
+	w := logout("GET", first, false, "")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/bye" {
+		t.Errorf("expected redirect to /bye, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	cleared := make(map[string]bool)
+	for _, cookie := range w.Result().Cookies() {
+		cleared[cookie.Name] = cookie.MaxAge < 0
+	}
+	if !cleared[defaultSessionCookie] || !cleared["app_session"] {
+		t.Errorf("expected session cookies to be cleared, got %v", cleared)
+	}
+	if allowed(first) {
+		t.Error("logged out session was accepted")
+	}
+	if !allowed(second) {
+		t.Error("expected other session to stay valid")
+	}
+
+	// logging out everywhere requires POST from the same site
+	logout("GET", sessionCookie("greg"), true, "http://example.com")
+	logout("POST", sessionCookie("greg"), true, "")
+	logout("POST", sessionCookie("greg"), true, "https://evil.example")
+	if !allowed(second) {
+		t.Error("expected logging out everywhere to require POST from the same site")
+	}
+	third := sessionCookie("greg")
+	logout("POST", second, true, "http://example.com")
+	if allowed(third) {
+		t.Error("expected all sessions to be logged out")
+	}
+
+	// sessions stay logged out after a reload
+	successor, _ := newTestHandler(t, config)
+	successor.TakeOver(handler)
+	if session, valid := successor.LoginForm.session(func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(third)
+		return r
+	}()); session == nil || valid {
+		t.Error("expected successor to reject logged out session")
+	}
+
+	// admin API logs users out everywhere
+	old := &Session{ID: "old", Identity: NewIdentity("ann", "basic"), Issued: time.Now().Unix() - 10, LastSeen: time.Now().Unix()}
+	r := httptest.NewRequest("DELETE", "/.admin/sessions/ann", nil)
+	r.SetBasicAuth("ops", "s3cret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected admin logout to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if !form.revoked(old) {
+		t.Error("expected session of ann to be revoked")
+	}
+}
@@ -0,0 +1,132 @@
+package permission
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "permission"
+)
+
+// Metrics are registered with the default Prometheus registry, so that they are also exposed by other Prometheus plugins.
+var (
+	metricDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "decisions_total",
+		Help:      "Access decisions by outcome, deciding backend and permit type.",
+	}, []string{"outcome", "backend", "permit_type"})
+
+	metricBackendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "backend_duration_seconds",
+		Help:      "Time backends take to authenticate requests and to provide permits.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"backend", "operation"})
+
+	metricAPIResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "api_responses_total",
+		Help:      "Responses of the API backend endpoints by status code.",
+	}, []string{"backend", "endpoint", "code"})
+
+	metricCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cache_operations_total",
+		Help:      "Cache hits, misses and evictions of backend caches.",
+	}, []string{"backend", "cache", "result"})
+
+	metricLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "logins_total",
+		Help:      "Login procedures (redirects, challenges) issued by backend.",
+	}, []string{"backend"})
+
+	metricLogouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "logouts_total",
+		Help:      "Logouts of known users by scope (session, everywhere).",
+	}, []string{"scope"})
+
+	metricFailedLogins = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "failed_logins_total",
+		Help:      "Failed attempts to log in with a password or second factor.",
+	})
+
+	metricLockouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "lockouts_total",
+		Help:      "Login attempts rejected because of too many failed attempts.",
+	})
+)
+
+// Operations for metricBackendDuration
+const (
+	operationAuthenticate = "authenticate"
+	operationAuthorize    = "authorize"
+)
+
+// Results for metricCache
+const (
+	cacheHit      = "hit"
+	cacheMiss     = "miss"
+	cacheEviction = "eviction"
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricDecisions,
+		metricBackendDuration,
+		metricAPIResponses,
+		metricCache,
+		metricLogins,
+		metricLogouts,
+		metricFailedLogins,
+		metricLockouts,
+	)
+}
+
+// observeBackendDuration records the time a backend operation took.
+func observeBackendDuration(backend BackendV2, operation string, start time.Time) {
+	metricBackendDuration.WithLabelValues(backend.Name(), operation).Observe(time.Since(start).Seconds())
+}
+
+// countDecision records an access decision.
+func countDecision(decision *Decision, outcome string) {
+	metricDecisions.WithLabelValues(outcome, decision.BackendName(), PermitTypeName(decision.PermitType)).Inc()
+}
+
+// countAPIResponse records the status code of an API response.
+func countAPIResponse(backend *APIBackend, endpoint string, code int) {
+	metricAPIResponses.WithLabelValues(backend.Name(), endpoint, strconv.Itoa(code)).Inc()
+}
+
+// countCache records cache operations.
+func countCache(backend string, cache string, result string, count int) {
+	if count > 0 {
+		metricCache.WithLabelValues(backend, cache, result).Add(float64(count))
+	}
+}
+
+// metricsHandler serves the metrics of the default registry.
+var metricsHandler = promhttp.Handler()
+
+// ServeMetrics serves the Prometheus metrics.
+func ServeMetrics(w http.ResponseWriter, r *http.Request) (int, error) {
+	metricsHandler.ServeHTTP(w, r)
+	return 0, nil
+}
@@ -0,0 +1,398 @@
+package permission
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+const (
+	defaultMFACookie   = "caddy_mfa"
+	defaultMFARemember = 30 * 24 * 3600
+
+	// totpPeriod is the time step of TOTP codes in seconds.
+	totpPeriod = 30
+	// totpDigits is the length of TOTP codes.
+	totpDigits = 6
+	// totpSkew is the number of time steps codes may be off, to allow for clock drift.
+	totpSkew = 1
+
+	// MFAMethodTOTP is the value of AttributeMFA for users that passed a TOTP challenge.
+	MFAMethodTOTP = "totp"
+)
+
+// MFA asks users for a TOTP code after they authenticated with a first factor, such as a password.
+// The challenge page is part of the login form, passing it upgrades the session of the user.
+type MFA struct {
+	// Path is the path of the challenge page, below the path of the login form.
+	Path string
+	// Secrets holds the TOTP secrets of users.
+	Secrets map[string][]byte
+	File    string
+	// Remember is the time in seconds a device is remembered after passing the challenge, 0 disables remembering devices.
+	Remember int64
+	Cookie   string
+	// AtLogin asks users with a secret for their code right after logging in with the login form, instead of when a rule requires it.
+	AtLogin bool
+
+	form *LoginForm
+
+	usedLock sync.Mutex
+	// used holds the last used time step of users, so that codes cannot be replayed.
+	used map[string]int64
+}
+
+// mfaFile is the format of secret files.
+type mfaFile struct {
+	Users map[string]string
+}
+
+// rememberedDevice is the content of the remember device cookie.
+type rememberedDevice struct {
+	Username string
+	Issued   int64
+	Expires  int64
+}
+
+var mfaTemplate = template.Must(template.New("mfa").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; }
+form { max-width: 20em; margin: 10vh auto; padding: 2em; background: #fff; border-radius: 4px; box-shadow: 0 1px 4px rgba(0,0,0,.2); }
+label, input { display: block; width: 100%; box-sizing: border-box; }
+input { margin: .3em 0 1em; padding: .5em; }
+input[type=checkbox] { display: inline; width: auto; margin: 0 .5em 1em 0; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="next" value="{{.Next}}">
+<label for="code">Code of your authenticator app for {{.Username}}</label>
+<input id="code" name="code" inputmode="numeric" pattern="[0-9]*" autocomplete="one-time-code" autofocus required>
+{{if .Remember}}<label><input type="checkbox" name="remember" value="1">Remember this device</label>{{end}}
+<input type="submit" value="Verify">
+</form>
+</body>
+</html>
+`))
+
+type mfaPage struct {
+	Title    string
+	Action   string
+	Next     string
+	Username string
+	Remember bool
+	Error    string
+}
+
+// TOTPCode returns the TOTP code (RFC 6238, HMAC-SHA1, 30 second steps, 6 digits) of the secret at time t.
+func TOTPCode(secret []byte, t time.Time) string {
+	return totpCode(secret, t.Unix()/totpPeriod)
+}
+
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := strconv.FormatUint(uint64(value%1000000), 10)
+	return strings.Repeat("0", totpDigits-len(code)) + code
+}
+
+// DecodeTOTPSecret decodes a base32 encoded TOTP secret, as shown by authenticator apps.
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(decoded) < 10 {
+		return nil, errors.New("invalid TOTP secret, expected at least 16 base32 characters")
+	}
+	return decoded, nil
+}
+
+// Enrolled returns whether the user has a TOTP secret.
+func (mfa *MFA) Enrolled(username string) bool {
+	_, ok := mfa.Secrets[username]
+	return ok
+}
+
+// Verify checks a TOTP code of a user. Every code is only accepted once.
+func (mfa *MFA) Verify(username, code string) bool {
+	secret, ok := mfa.Secrets[username]
+	if !ok || len(code) != totpDigits {
+		return false
+	}
+
+	mfa.usedLock.Lock()
+	defer mfa.usedLock.Unlock()
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= mfa.used[username] {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			if mfa.used == nil {
+				mfa.used = make(map[string]int64)
+			}
+			mfa.used[username] = step
+			return true
+		}
+	}
+	return false
+}
+
+// Resume marks the identity as having passed the second factor, if the request comes from a remembered device of the user.
+func (mfa *MFA) Resume(r *http.Request, identity *Identity) {
+	if identity != nil && !identity.HasMFA() && mfa.Remembered(r, identity.Username) {
+		identity.SetAttribute(AttributeMFA, MFAMethodTOTP)
+	}
+}
+
+// Challenge sends browsers of enrolled users to the challenge page, so that they return to the requested resource afterwards.
+// It returns false for other clients and users without a secret.
+func (mfa *MFA) Challenge(w http.ResponseWriter, r *http.Request, identity *Identity) bool {
+	if identity == nil || !mfa.Enrolled(identity.Username) || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	http.Redirect(w, r, mfa.Path+"?next="+url.QueryEscape(r.RequestURI), http.StatusFound)
+	return true
+}
+
+// ServeHTTP serves the challenge page and upgrades the session of users that enter a valid code.
+func (mfa *MFA) ServeHTTP(w http.ResponseWriter, r *http.Request, handler *Handler, identity *Identity) (int, error) {
+	page := &mfaPage{
+		Title:    mfa.form.Title,
+		Action:   mfa.Path,
+		Next:     localRedirect(r.FormValue("next")),
+		Remember: mfa.Remember > 0,
+	}
+	if page.Title == "" {
+		page.Title = handler.Realm
+	}
+	if page.Title == "" {
+		page.Title = "Login"
+	}
+
+	if identity == nil {
+		http.Redirect(w, r, mfa.form.Path+"?next="+url.QueryEscape(page.Next), http.StatusSeeOther)
+		return 0, nil
+	}
+	page.Username = identity.Username
+	if !mfa.Enrolled(identity.Username) {
+		page.Error = "No second factor is set up for your account."
+		return mfa.form.render(w, mfaTemplate, http.StatusForbidden, page)
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		return mfa.form.render(w, mfaTemplate, http.StatusOK, page)
+	case "POST":
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	start := time.Now()
+	if wait := handler.Lockout.Check(handler.Lockout.clientIP(r), identity.Username); wait > 0 {
+		handler.lockedOut(w, r, identity.Username, wait, start)
+		page.Error = fmt.Sprintf("Too many failed attempts, please try again in %d seconds.", wait)
+		return mfa.form.render(w, mfaTemplate, http.StatusTooManyRequests, page)
+	}
+	if !mfa.Verify(identity.Username, strings.TrimSpace(r.PostFormValue("code"))) {
+		handler.failedLogin(r, identity.Username, start)
+		page.Error = "Invalid code."
+		return mfa.form.render(w, mfaTemplate, http.StatusUnauthorized, page)
+	}
+	handler.Lockout.Succeed(identity.Username)
+
+	// the session keeps its original lifetime, the session without the second factor ends
+	session := mfa.form.NewSession(identity.withAttribute(AttributeMFA, MFAMethodTOTP))
+	if old, valid := mfa.form.session(r); old != nil && valid {
+		session.Issued = old.Issued
+		mfa.form.RevokeSession(old)
+	}
+	err := mfa.form.setCookie(w, r, session)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if mfa.Remember > 0 && r.PostFormValue("remember") != "" {
+		err = mfa.rememberDevice(w, r, identity.Username)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	http.Redirect(w, r, page.Next, http.StatusSeeOther)
+	return 0, nil
+}
+
+// Remembered returns whether the request comes from a device the user chose to remember.
+// Devices are forgotten when the user is logged out everywhere.
+func (mfa *MFA) Remembered(r *http.Request, username string) bool {
+	if mfa.Remember <= 0 {
+		return false
+	}
+	cookie, err := r.Cookie(mfa.Cookie)
+	if err != nil {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return false
+	}
+	gcm, err := newGCM(mfa.form.key)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return false
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(mfa.Cookie))
+	if err != nil {
+		return false
+	}
+	device := &rememberedDevice{}
+	err = json.Unmarshal(plaintext, device)
+	if err != nil || device.Username != username || device.Expires <= time.Now().Unix() {
+		return false
+	}
+	return !mfa.form.revokedUser(username, device.Issued)
+}
+
+// rememberDevice sets the cookie that lets the user skip the challenge on this device.
+func (mfa *MFA) rememberDevice(w http.ResponseWriter, r *http.Request, username string) error {
+	now := time.Now().Unix()
+	expires := now + mfa.Remember
+	plaintext, err := json.Marshal(&rememberedDevice{Username: username, Issued: now, Expires: expires})
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(mfa.form.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     mfa.Cookie,
+		Value:    base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, []byte(mfa.Cookie))),
+		Path:     "/",
+		Expires:  time.Unix(expires, 0),
+		Secure:   mfa.form.Secure || r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// setLoginForm attaches the challenge page to the login form.
+func (mfa *MFA) setLoginForm(form *LoginForm) {
+	mfa.form = form
+	mfa.Path = form.Path + "/mfa"
+	form.remember = mfa.Remember
+}
+
+// NewMFA creates a new MFA from configuration.
+func NewMFA(c *caddy.Controller) (*MFA, error) {
+	new := &MFA{
+		Secrets:  make(map[string][]byte),
+		Remember: defaultMFARemember,
+		Cookie:   defaultMFACookie,
+	}
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "user":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			secret, err := DecodeTOTPSecret(args[1])
+			if err != nil {
+				return nil, c.Errf("permission > mfa > user %s: %s", args[0], err)
+			}
+			new.Secrets[args[0]] = secret
+		case "file", "cookie":
+			option := c.Val()
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch option {
+			case "file":
+				new.File = c.Val()
+			case "cookie":
+				new.Cookie = c.Val()
+			}
+		case "remember":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			i, err := strconv.ParseInt(c.Val(), 10, 64)
+			if err != nil || i < 0 {
+				return nil, c.ArgErr()
+			}
+			new.Remember = i
+		case "at_login":
+			new.AtLogin = true
+		default:
+			return nil, c.ArgErr()
+		}
+	}
+
+	if new.File != "" {
+		err := new.loadFile()
+		if err != nil {
+			return nil, c.Errf("permission > mfa: failed to load %s: %s", new.File, err)
+		}
+	}
+
+	return new, nil
+}
+
+// loadFile adds the secrets of the configured file.
+func (mfa *MFA) loadFile() error {
+	data, err := ioutil.ReadFile(mfa.File)
+	if err != nil {
+		return err
+	}
+	file := &mfaFile{}
+	err = decodeConfigFile(mfa.File, data, file)
+	if err != nil {
+		return err
+	}
+	for username, encoded := range file.Users {
+		secret, err := DecodeTOTPSecret(encoded)
+		if err != nil {
+			return fmt.Errorf("user %s: %s", username, err)
+		}
+		mfa.Secrets[username] = secret
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package permission
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// test vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if code := TOTPCode(secret, time.Unix(unix, 0)); code != expected {
+			t.Errorf("%d: expected %s, got %s", unix, expected, code)
+		}
+	}
+
+	if _, err := DecodeTOTPSecret("jbsw y3dp ehpk 3pxp"); err != nil {
+		t.Errorf("failed to decode secret: %s", err)
+	}
+	if _, err := DecodeTOTPSecret("JBSW"); err == nil {
+		t.Error("expected short secret to be rejected")
+	}
+}
+
+func TestMFARules(t *testing.T) {
+	rule, err := NewRule("rw,mfa", "/admin/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rule.MFA || len(rule.Methods) != len(aliases["rw"]) || rule.MethodString() != strings.Join(aliases["rw"], ",")+",mfa" {
+		t.Errorf("unexpected rule: %+v", rule)
+	}
+	rule, _ = NewRule("any,mfa", "/admin/")
+	if !rule.MFA || !rule.MethodsAreBlacklist || len(rule.Methods) != 0 || rule.MethodString() != "any,mfa" {
+		t.Errorf("unexpected rule: %+v", rule)
+	}
+	if messages := LintMethods("ro,mfa"); len(messages) != 0 {
+		t.Errorf("unexpected lint messages: %v", messages)
+	}
+}
+
+func TestMFA(t *testing.T) {
+	handler, next := newTestHandler(t, `
+	permission login /.login {
+		secret 0123456789abcdef
+	}
+	permission mfa {
+		user greg JBSWY3DPEHPK3PXP
+		remember 3600
+	}
+	permission basic {
+		user greg qwerty1
+		rw /files/
+		rw,mfa /admin/
+	}`)
+	secret, _ := DecodeTOTPSecret("JBSWY3DPEHPK3PXP")
+
+	request := func(path string, browser bool, cookies ...*http.Cookie) (bool, *httptest.ResponseRecorder) {
+		next.request = nil
+		r := httptest.NewRequest("GET", path, nil)
+		if len(cookies) == 0 || cookies[0].Name != defaultSessionCookie {
+			r.SetBasicAuth("greg", "qwerty1")
+		}
+		if browser {
+			r.Header.Set("Accept", "text/html")
+		}
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		status, _ := handler.ServeHTTP(w, r)
+		if status != 0 {
+			w.Code = status
+		}
+		return next.request != nil, w
+	}
+	verify := func(code string) *httptest.ResponseRecorder {
+		body := url.Values{"code": {code}, "next": {"/admin/file"}, "remember": {"1"}}
+		r := httptest.NewRequest("POST", "/.login/mfa", strings.NewReader(body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("greg", "qwerty1")
+		w := httptest.NewRecorder()
+		status, _ := handler.ServeHTTP(w, r)
+		if status != 0 {
+			w.Code = status
+		}
+		return w
+	}
+
+	// the first factor is enough for other paths
+	if allowed, _ := request("/files/file", false); !allowed {
+		t.Error("expected first factor to be enough")
+	}
+	if allowed, w := request("/admin/file", false); allowed || w.Code != http.StatusForbidden {
+		t.Errorf("expected request without second factor to be denied, got %d", w.Code)
+	}
+	if allowed, w := request("/admin/file", true); allowed || w.Code != http.StatusFound || w.Header().Get("Location") != "/.login/mfa?next=%2Fadmin%2Ffile" {
+		t.Errorf("expected redirect to challenge, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if _, w := request("/.login/mfa", true); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "greg") {
+		t.Errorf("unexpected challenge page: %d", w.Code)
+	}
+
+	if w := verify("000000"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected wrong code to be rejected, got %d", w.Code)
+	}
+	code := TOTPCode(secret, time.Now())
+	w := verify(code)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/file" || len(w.Result().Cookies()) != 2 {
+		t.Fatalf("expected code to be accepted, got %d", w.Code)
+	}
+	if w := verify(code); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected replayed code to be rejected, got %d", w.Code)
+	}
+
+	var session, device *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		switch cookie.Name {
+		case defaultSessionCookie:
+			session = cookie
+		case defaultMFACookie:
+			device = cookie
+		}
+	}
+	if allowed, _ := request("/admin/file", false, session); !allowed {
+		t.Error("expected upgraded session to be allowed")
+	}
+	if allowed, _ := request("/admin/file", false, device); !allowed {
+		t.Error("expected remembered device to be allowed")
+	}
+	if handler.MFA.Remembered(httptest.NewRequest("GET", "/", nil), "greg") {
+		t.Error("request without cookie is remembered")
+	}
+
+	// upgrading a session ends the session without the second factor
+	form := handler.LoginForm
+	value, _ := form.encode(form.NewSession(NewIdentity("greg", "basic")))
+	before := &http.Cookie{Name: defaultSessionCookie, Value: value}
+	handler.MFA.used = nil
+	body := url.Values{"code": {TOTPCode(secret, time.Now())}}
+	r := httptest.NewRequest("POST", "/.login/mfa", strings.NewReader(body.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(before)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected code to be accepted, got %d", w.Code)
+	}
+	if allowed, _ := request("/files/file", false, before); allowed {
+		t.Error("expected session without second factor to be revoked")
+	}
+
+	// logging out everywhere forgets remembered devices
+	handler.RevokeUser(context.Background(), "greg")
+	if allowed, _ := request("/admin/file", false, device); allowed {
+		t.Error("expected remembered device to be forgotten after logging out everywhere")
+	}
+
+	// users can be asked right after logging in
+	handler.MFA.AtLogin = true
+	body = url.Values{"username": {"greg"}, "password": {"qwerty1"}, "next": {"/files/"}}
+	r = newLoginRequest(handler.LoginForm, body)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/.login/mfa?next=%2Ffiles%2F" {
+		t.Errorf("expected redirect to challenge after login, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// the challenge requires the login form
+	_, err := NewHandler(caddy.NewTestController("http", `
+	permission mfa {
+		user greg JBSWY3DPEHPK3PXP
+	}`), 0)
+	if err == nil {
+		t.Error("expected mfa without login form to fail")
+	}
+}
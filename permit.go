@@ -10,12 +10,31 @@ const (
 	PermitTypeUser
 	PermitTypeDefault
 	PermitTypePublic
+	// PermitTypePolicy is used for decisions of backends that implement Decider.
+	PermitTypePolicy
 )
 
+// PermitTypeName returns a printable name of the permit type.
+func PermitTypeName(permitType uint8) string {
+	switch permitType {
+	case PermitTypeUser:
+		return "user"
+	case PermitTypeDefault:
+		return DefaultIdentifier
+	case PermitTypePublic:
+		return PublicIdentifier
+	case PermitTypePolicy:
+		return "policy"
+	}
+	return ""
+}
+
 // Permit holds permissions and their expiration time.
 type Permit struct {
 	Rules      []*Rule
 	ValidUntil int64
+	// Rate is the rate limit of rules that do not have their own, applied by Finalize.
+	Rate *RateLimit `json:",omitempty"`
 }
 
 func (p Permit) Len() int {
@@ -32,14 +51,20 @@ func (p Permit) Swap(i, j int) {
 
 // Check checks a request against this permission object.
 func (p *Permit) Check(handler *Handler, method, path string, ro bool) (allowed bool, matched bool) {
+	allowed, rule := p.Match(handler, method, path, ro)
+	return allowed, rule != nil
+}
+
+// Match checks a request against this permission object and returns the deciding rule, or nil if no rule matched.
+func (p *Permit) Match(handler *Handler, method, path string, ro bool) (allowed bool, rule *Rule) {
 	for _, rule := range p.Rules {
 		if rule.MatchesPath(path) {
-			return rule.MatchesMethod(method), true
+			return rule.MatchesMethod(method), rule
 		} else if ro && handler.ReadParentPath && rule.MatchesParentPath(path) {
-			return true, true
+			return true, rule
 		}
 	}
-	return false, false
+	return false, nil
 }
 
 // NewPermit creates an empty Permit with the correct cache time.
@@ -54,16 +79,28 @@ func NewPermit(cacheTime int64, now int64) *Permit {
 }
 
 // AddRule adds a permission to the Permit.
-func (p *Permit) AddRule(methods, path string) error {
+// Options, such as "rate 100/m", may follow the path or be appended to the methods, eg. "rw rate 100/m".
+func (p *Permit) AddRule(methods, path string, options ...string) error {
+	methods, embedded := splitRuleOptions(methods)
 	new, err := NewRule(methods, path)
 	if err != nil {
 		return err
 	}
+	err = new.setOptions(append(embedded, options...))
+	if err != nil {
+		return err
+	}
 	p.Rules = append(p.Rules, new)
 	return nil
 }
 
 // Finalize does some final preparing/optimizing on the Permit.
 func (p *Permit) Finalize() {
-	// nothing to do here anymore, preserving for future use.
+	if p.Rate != nil {
+		for _, rule := range p.Rules {
+			if rule.Rate == nil {
+				rule.Rate = p.Rate
+			}
+		}
+	}
 }
@@ -0,0 +1,350 @@
+package permission
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Policy holds the users, groups and rules of backends that are not configured in the Caddyfile.
+// Rules use the same format as API responses: Permissions maps paths to methods, Deny lists denied paths.
+type Policy struct {
+	Users   map[string]*PolicyUser  `json:",omitempty"`
+	Groups  map[string]*PolicyRules `json:",omitempty"`
+	Default *PolicyRules            `json:",omitempty"`
+	Public  *PolicyRules            `json:",omitempty"`
+}
+
+// PolicyRules are the rules of a user, a group, or the default and public permits.
+type PolicyRules struct {
+	Permissions map[string]string `json:",omitempty"`
+	Deny        []string          `json:",omitempty"`
+	// Rate is the rate limit of permissions that do not have their own, eg. "100/m".
+	Rate string `json:",omitempty"`
+}
+
+// PolicyUser is a user of a Policy.
+type PolicyUser struct {
+	// PasswordHash is the bcrypt hash of the password. Users without a password must be authenticated by another backend.
+	PasswordHash string            `json:",omitempty"`
+	Groups       []string          `json:",omitempty"`
+	DisplayName  string            `json:",omitempty"`
+	Email        string            `json:",omitempty"`
+	Headers      map[string]string `json:",omitempty"`
+	// ValidUntil is the unix time when the user expires, 0 means never.
+	ValidUntil int64 `json:",omitempty"`
+	PolicyRules
+}
+
+// Expired returns whether the user is expired.
+func (user *PolicyUser) Expired(now int64) bool {
+	return user.ValidUntil != 0 && user.ValidUntil <= now
+}
+
+// SetPassword sets the password hash of the user.
+func (user *PolicyUser) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = string(hash)
+	return nil
+}
+
+// Copy returns a deep copy of the policy.
+func (policy *Policy) Copy() *Policy {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		// policies only consist of strings, maps and slices
+		panic(err)
+	}
+	copied := &Policy{}
+	err = json.Unmarshal(data, copied)
+	if err != nil {
+		panic(err)
+	}
+	return copied
+}
+
+// addTo adds the rules to the permit. Denied paths are added first, permissions are added longest path first.
+func (rules *PolicyRules) addTo(permit *Permit) error {
+	if rules == nil {
+		return nil
+	}
+
+	for _, path := range rules.Deny {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid path \"%s\", must start with /", path)
+		}
+		err := permit.AddRule("none", path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// maps are not ordered, so the most specific path must come first
+	paths := make([]string, 0, len(rules.Permissions))
+	for path := range rules.Permissions {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid path \"%s\", must start with /", path)
+		}
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i]) != len(paths[j]) {
+			return len(paths[i]) > len(paths[j])
+		}
+		return paths[i] < paths[j]
+	})
+	first := len(permit.Rules)
+	for _, path := range paths {
+		err := permit.AddRule(rules.Permissions[path], path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if rules.Rate != "" {
+		limit, err := ParseRateLimit(rules.Rate)
+		if err != nil {
+			return err
+		}
+		for _, rule := range permit.Rules[first:] {
+			if rule.Rate == nil {
+				rule.Rate = limit
+			}
+		}
+	}
+
+	return nil
+}
+
+// newPolicyPermit creates a permit from rules.
+func newPolicyPermit(rules *PolicyRules) (*Permit, error) {
+	if rules == nil {
+		return nil, nil
+	}
+	permit := NewPermit(0, 0)
+	err := rules.addTo(permit)
+	if err != nil {
+		return nil, err
+	}
+	permit.Finalize()
+	return permit, nil
+}
+
+// compiledPolicy is a validated Policy with permits ready for checking requests. It must not be modified.
+type compiledPolicy struct {
+	policy        *Policy
+	users         map[string]*Permit
+	groups        map[string]*Permit
+	defaultPermit *Permit
+	publicPermit  *Permit
+
+	// verified caches verified credentials, as bcrypt is slow by design.
+	verified     map[[sha256.Size]byte]string
+	verifiedLock sync.Mutex
+}
+
+// compilePolicy validates a policy and creates its permits.
+func compilePolicy(policy *Policy) (*compiledPolicy, error) {
+	if policy == nil {
+		policy = &Policy{}
+	}
+	compiled := &compiledPolicy{
+		policy:   policy,
+		users:    make(map[string]*Permit),
+		groups:   make(map[string]*Permit),
+		verified: make(map[[sha256.Size]byte]string),
+	}
+
+	var err error
+	for name, rules := range policy.Groups {
+		if rules == nil {
+			return nil, fmt.Errorf("group %s has no rules", name)
+		}
+		compiled.groups[name], err = newPolicyPermit(rules)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %s", name, err)
+		}
+	}
+	for name, user := range policy.Users {
+		if user == nil {
+			return nil, fmt.Errorf("user %s is empty", name)
+		}
+		if user.PasswordHash != "" {
+			_, err = bcrypt.Cost([]byte(user.PasswordHash))
+			if err != nil {
+				return nil, fmt.Errorf("user %s: invalid password hash: %s", name, err)
+			}
+		}
+		for _, group := range user.Groups {
+			if _, ok := policy.Groups[group]; !ok {
+				return nil, fmt.Errorf("user %s is member of unknown group %s", name, group)
+			}
+		}
+		compiled.users[name], err = newPolicyPermit(&user.PolicyRules)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %s", name, err)
+		}
+	}
+	compiled.defaultPermit, err = newPolicyPermit(policy.Default)
+	if err != nil {
+		return nil, fmt.Errorf("default: %s", err)
+	}
+	compiled.publicPermit, err = newPolicyPermit(policy.Public)
+	if err != nil {
+		return nil, fmt.Errorf("public: %s", err)
+	}
+
+	return compiled, nil
+}
+
+// authenticate checks the credentials of a user and returns the user, if successful.
+func (compiled *compiledPolicy) authenticate(username, password string) (*PolicyUser, error) {
+	user, ok := compiled.policy.Users[username]
+	if !ok || user.PasswordHash == "" || user.Expired(time.Now().Unix()) {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(username + ":" + password))
+	compiled.verifiedLock.Lock()
+	verifiedUser, ok := compiled.verified[key]
+	compiled.verifiedLock.Unlock()
+	if ok && verifiedUser == username {
+		return user, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	compiled.verifiedLock.Lock()
+	compiled.verified[key] = username
+	compiled.verifiedLock.Unlock()
+	return user, nil
+}
+
+// permit returns the permit of the given type for the identity. User permits consist of the rules of the user, followed by the rules of the groups of the user and the identity.
+// Identities of the policy itself (own) only get the groups the user currently has, and no permit once the user is deleted or expired,
+// as their groups may stem from a login session that outlives the user.
+func (compiled *compiledPolicy) permit(identity *Identity, permitType uint8, own bool) *Permit {
+	switch permitType {
+	case PermitTypeDefault:
+		return compiled.defaultPermit
+	case PermitTypePublic:
+		return compiled.publicPermit
+	case PermitTypeUser:
+	default:
+		return nil
+	}
+	if identity == nil {
+		return nil
+	}
+
+	permit := NewPermit(0, 0)
+	var groups []string
+	user, ok := compiled.policy.Users[identity.Username]
+	if ok && !user.Expired(time.Now().Unix()) {
+		permit.Rules = append(permit.Rules, compiled.users[identity.Username].Rules...)
+		groups = append(groups, user.Groups...)
+	} else if own {
+		return nil
+	}
+	if !own {
+		groups = append(groups, identity.Groups...)
+	}
+
+	added := make(map[string]bool)
+	for _, group := range groups {
+		groupPermit, ok := compiled.groups[group]
+		if ok && !added[group] {
+			permit.Rules = append(permit.Rules, groupPermit.Rules...)
+			added[group] = true
+		}
+	}
+
+	if len(permit.Rules) == 0 {
+		return nil
+	}
+	return permit
+}
+
+// policyBackend authenticates and authorizes requests with a Policy that may be replaced at any time.
+type policyBackend struct {
+	lock     sync.RWMutex
+	compiled *compiledPolicy
+}
+
+// Authenticate authenticates users with a password via HTTP Basic Authentication.
+func (backend *policyBackend) Authenticate(ctx context.Context, r *http.Request) (*Identity, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	user, err := backend.current().authenticate(username, password)
+	if user == nil || err != nil {
+		return nil, err
+	}
+	return user.identity(username), nil
+}
+
+// authorize returns the permit of the given type. name is the name of the backend, which identities authenticated by it have as their source.
+func (backend *policyBackend) authorize(identity *Identity, permitType uint8, name string) *Permit {
+	return backend.current().permit(identity, permitType, identity != nil && identity.Source == name)
+}
+
+// Login asks for HTTP Basic Authentication, if there are users with a password.
+func (backend *policyBackend) Login(w http.ResponseWriter, r *http.Request, realm string) (bool, int, error) {
+	for _, user := range backend.current().policy.Users {
+		if user.PasswordHash != "" {
+			if realm == "" {
+				realm = "Restricted"
+			}
+			w.Header().Set("WWW-Authenticate", "Basic realm=\""+realm+"\"")
+			return true, http.StatusUnauthorized, nil
+		}
+	}
+	return false, 0, nil
+}
+
+// current returns the current compiled policy.
+func (backend *policyBackend) current() *compiledPolicy {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	return backend.compiled
+}
+
+// replace replaces the current compiled policy.
+func (backend *policyBackend) replace(compiled *compiledPolicy) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.compiled = compiled
+}
+
+// identity returns the identity of a user. The source is set by the handler.
+func (user *PolicyUser) identity(username string) *Identity {
+	identity := NewIdentity(username, "")
+	identity.Groups = user.Groups
+	identity.Headers = user.Headers
+	if user.DisplayName != "" {
+		identity.SetAttribute(AttributeDisplayName, user.DisplayName)
+	}
+	if user.Email != "" {
+		identity.SetAttribute(AttributeEmail, user.Email)
+	}
+	return identity
+}
@@ -0,0 +1,201 @@
+package permission
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateOption starts the rate limit of a rule, eg. "rw /api/ rate 100/m".
+const rateOption = "rate"
+
+// rateLimitPruneInterval is the minimum time between removing full buckets.
+const rateLimitPruneInterval = 60
+
+var rateUnits = map[string]int64{
+	"s": 1,
+	"m": 60,
+	"h": 3600,
+	"d": 24 * 3600,
+}
+
+// RateLimit limits requests to a number per period.
+type RateLimit struct {
+	Requests int64
+	// Period is the length of the period in seconds.
+	Period int64
+}
+
+// ParseRateLimit parses a rate limit in the form "100/m": a number of requests per second (s), minute (m), hour (h) or day (d).
+// The unit may be preceded by a number, eg. "100/15m".
+func ParseRateLimit(value string) (*RateLimit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid rate limit \"%s\", expected requests per period, eg. 100/m", value)
+	}
+	requests, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || requests <= 0 {
+		return nil, fmt.Errorf("invalid rate limit \"%s\", the number of requests must be positive", value)
+	}
+	unit, ok := rateUnits[parts[1][len(parts[1])-1:]]
+	if !ok {
+		return nil, fmt.Errorf("invalid rate limit \"%s\", unknown unit, expected s, m, h or d", value)
+	}
+	periods := int64(1)
+	if len(parts[1]) > 1 {
+		periods, err = strconv.ParseInt(parts[1][:len(parts[1])-1], 10, 64)
+		if err != nil || periods <= 0 {
+			return nil, fmt.Errorf("invalid rate limit \"%s\", invalid period", value)
+		}
+	}
+	return &RateLimit{
+		Requests: requests,
+		Period:   periods * unit,
+	}, nil
+}
+
+// String returns the rate limit in the configuration format.
+func (limit *RateLimit) String() string {
+	for _, unit := range []string{"d", "h", "m", "s"} {
+		if limit.Period%rateUnits[unit] == 0 {
+			periods := limit.Period / rateUnits[unit]
+			if periods == 1 {
+				return fmt.Sprintf("%d/%s", limit.Requests, unit)
+			}
+			return fmt.Sprintf("%d/%d%s", limit.Requests, periods, unit)
+		}
+	}
+	return fmt.Sprintf("%d/%ds", limit.Requests, limit.Period)
+}
+
+// splitRuleOptions separates the options of a rule, such as a rate limit, from its methods, eg. "rw rate 100/m".
+func splitRuleOptions(methods string) (string, []string) {
+	fields := strings.Fields(methods)
+	for i, field := range fields {
+		if field == rateOption {
+			return strings.Join(fields[:i], " "), fields[i:]
+		}
+	}
+	return methods, nil
+}
+
+// setOptions sets the options of a rule from the arguments following its path.
+func (r *Rule) setOptions(options []string) error {
+	for i := 0; i < len(options); i++ {
+		switch {
+		case options[i] == rateOption && i+1 < len(options):
+			i++
+			limit, err := ParseRateLimit(options[i])
+			if err != nil {
+				return err
+			}
+			r.Rate = limit
+		default:
+			return fmt.Errorf("unknown rule option \"%s\" of %s", options[i], r.Path)
+		}
+	}
+	return nil
+}
+
+// RateLimiter enforces rate limits with a token bucket per user (or client IP) and rule.
+type RateLimiter struct {
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune int64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	period int64
+}
+
+// NewRateLimiter creates a new RateLimiter without buckets.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Take takes a token from the bucket of key, which holds up to limit.Requests tokens and is refilled over limit.Period.
+// It returns whether a token was available, the remaining tokens and the seconds until the bucket is full again, or until the next token is available, if none was.
+func (limiter *RateLimiter) Take(key string, limit *RateLimit, now time.Time) (allowed bool, remaining int64, reset int64) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.prune(now)
+
+	capacity := float64(limit.Requests)
+	refill := capacity / float64(limit.Period)
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*refill)
+	bucket.last = now
+	bucket.period = limit.Period
+
+	if bucket.tokens < 1 {
+		return false, 0, int64(math.Ceil((1 - bucket.tokens) / refill))
+	}
+	bucket.tokens--
+	return true, int64(bucket.tokens), int64(math.Ceil((capacity - bucket.tokens) / refill))
+}
+
+// prune removes buckets that are full again. The caller must hold the lock.
+func (limiter *RateLimiter) prune(now time.Time) {
+	if now.Unix()-limiter.lastPrune < rateLimitPruneInterval {
+		return
+	}
+	limiter.lastPrune = now.Unix()
+	for key, bucket := range limiter.buckets {
+		if int64(now.Sub(bucket.last).Seconds()) >= bucket.period {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// rateLimit takes a token for the deciding rule of an allowed request, if it has a rate limit, and sets the RateLimit headers.
+// Buckets are kept per user, or per client IP for public permits, behind the trusted_proxies of the lockout. It returns false if the limit is exceeded.
+func (handler *Handler) rateLimit(w http.ResponseWriter, r *http.Request, identity *Identity, decision *Decision) bool {
+	if decision.Rule == nil || decision.Rule.Rate == nil {
+		return true
+	}
+	limit := decision.Rule.Rate
+
+	client := "ip:" + handler.Lockout.clientIP(r)
+	if identity != nil && decision.PermitType != PermitTypePublic {
+		client = "user:" + identity.Username
+	}
+	key := fmt.Sprintf("%s|%s|%s|%s|%s|%s", client, decision.BackendName(), PermitTypeName(decision.PermitType), decision.Rule.MethodString(), decision.Rule.Path, limit)
+
+	allowed, remaining, reset := handler.RateLimiter.Take(key, limit, time.Now())
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(limit.Requests, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.FormatInt(reset, 10))
+	}
+	return allowed
+}
+
+// rateLimited rejects a request that exceeds the rate limit of its rule with 429 Too Many Requests.
+// In report only mode, the request is forwarded instead and tagged with the Caddy-Auth-Would-Deny header.
+func (handler *Handler) rateLimited(w http.ResponseWriter, r *http.Request, identity *Identity, decision *Decision, start time.Time) (int, error) {
+	if printDebug {
+		fmt.Printf("[permission] %s%srate limit of %s exceeded: %s %s\n", getUserForPrinting(identity), getPermitBackendForPrinting(decision.Backend, decision.PermitType), decision.Rule.Path, r.Method, r.RequestURI)
+	}
+	if handler.ReportOnly {
+		countDecision(decision, OutcomeWouldDeny)
+		handler.Audit.Log(r, identity, decision, OutcomeWouldDeny, start)
+		r.Header.Set(WouldDenyHeader, OutcomeRateLimited)
+		return handler.Forward(w, r, identity, decision)
+	}
+	countDecision(decision, OutcomeRateLimited)
+	handler.Audit.Log(r, identity, decision, OutcomeRateLimited, start)
+	return http.StatusTooManyRequests, nil
+}
@@ -0,0 +1,194 @@
+package permission
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for value, expected := range map[string]RateLimit{
+		"100/m":  {Requests: 100, Period: 60},
+		"10/s":   {Requests: 10, Period: 1},
+		"5/15m":  {Requests: 5, Period: 900},
+		"1000/d": {Requests: 1000, Period: 86400},
+	} {
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			t.Errorf("%s: %s", value, err)
+			continue
+		}
+		if *limit != expected || limit.String() != value {
+			t.Errorf("%s: unexpected rate limit %+v (%s)", value, limit, limit)
+		}
+	}
+
+	for _, value := range []string{"", "100", "100/", "0/m", "-1/m", "100/w", "100/0m", "x/m"} {
+		if _, err := ParseRateLimit(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestRateLimitRules(t *testing.T) {
+	permit := NewPermit(0, 0)
+	if err := permit.AddRule("rw", "/api/", "rate", "100/m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := permit.AddRule("GET, HEAD rate 10/s", "/embedded/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := permit.AddRule("ro", "/other/"); err != nil {
+		t.Fatal(err)
+	}
+	permit.Rate = &RateLimit{Requests: 1, Period: 1}
+	permit.Finalize()
+
+	if permit.Rules[0].Rate.String() != "100/m" {
+		t.Errorf("unexpected rate limit of rule: %s", permit.Rules[0].Rate)
+	}
+	if permit.Rules[1].Rate.String() != "10/s" || permit.Rules[1].MethodString() != "GET,HEAD" {
+		t.Errorf("unexpected embedded rate limit: %s %s", permit.Rules[1].MethodString(), permit.Rules[1].Rate)
+	}
+	if permit.Rules[2].Rate.String() != "1/s" {
+		t.Errorf("expected permit rate limit, got %s", permit.Rules[2].Rate)
+	}
+
+	if err := permit.AddRule("rw", "/api/", "rate"); err == nil {
+		t.Error("expected missing rate limit to be rejected")
+	}
+	if err := permit.AddRule("rw", "/api/", "burst", "5"); err == nil {
+		t.Error("expected unknown option to be rejected")
+	}
+	if messages := LintMethods("rw rate 100/m"); len(messages) != 0 {
+		t.Errorf("unexpected lint messages: %v", messages)
+	}
+
+	// rules of policies apply the limit of their block
+	compiled, err := compilePolicy(&Policy{
+		Groups: map[string]*PolicyRules{
+			"customers": {
+				Permissions: map[string]string{"/api/": "rw", "/api/bulk/": "rw rate 5/h"},
+				Rate:        "100/m",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range compiled.groups["customers"].Rules {
+		if (rule.Path == "/api/" && rule.Rate.String() != "100/m") || (rule.Path == "/api/bulk/" && rule.Rate.String() != "5/h") {
+			t.Errorf("unexpected rate limit of %s: %s", rule.Path, rule.Rate)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter()
+	limit := &RateLimit{Requests: 2, Period: 60}
+	now := time.Unix(1000000, 0)
+
+	if allowed, remaining, reset := limiter.Take("greg", limit, now); !allowed || remaining != 1 || reset != 30 {
+		t.Errorf("unexpected first take: %v %d %d", allowed, remaining, reset)
+	}
+	if allowed, remaining, reset := limiter.Take("greg", limit, now); !allowed || remaining != 0 || reset != 60 {
+		t.Errorf("unexpected second take: %v %d %d", allowed, remaining, reset)
+	}
+	if allowed, _, reset := limiter.Take("greg", limit, now); allowed || reset != 30 {
+		t.Errorf("expected empty bucket, got %v %d", allowed, reset)
+	}
+	if allowed, _, _ := limiter.Take("george", limit, now); !allowed {
+		t.Error("expected buckets to be separate")
+	}
+
+	// one token is refilled every 30 seconds
+	if allowed, _, _ := limiter.Take("greg", limit, now.Add(30*time.Second)); !allowed {
+		t.Error("expected refilled token")
+	}
+
+	// full buckets are removed
+	limiter.Take("greg", limit, now.Add(time.Hour))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expected full buckets to be pruned, got %d buckets", len(limiter.buckets))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	handler, next := newTestHandler(t, `
+	permission basic {
+		user greg qwerty1
+		rw /api/ rate 2/m
+		user george qwerty2
+		rw /api/ rate 2/m
+		public
+		ro /public/ rate 1/h
+	}`)
+
+	request := func(path, username, remoteAddr string) *httptest.ResponseRecorder {
+		next.request = nil
+		r := httptest.NewRequest("GET", path, nil)
+		if username != "" {
+			r.SetBasicAuth(username, map[string]string{"greg": "qwerty1", "george": "qwerty2"}[username])
+		}
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		status, _ := handler.ServeHTTP(w, r)
+		if status != 0 {
+			w.Code = status
+		}
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := request("/api/file", "greg", "192.0.2.1:1234")
+		if next.request == nil || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != []string{"1", "0"}[i] {
+			t.Errorf("request %d: expected to be allowed with rate limit headers, got %d %v", i+1, w.Code, w.Header())
+		}
+	}
+	w := request("/api/file", "greg", "192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests || next.request != nil || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("expected rate limited request, got %d (Retry-After %q)", w.Code, w.Header().Get("Retry-After"))
+	}
+	if request("/api/file", "george", "192.0.2.1:1234"); next.request == nil {
+		t.Error("expected other user to have own bucket")
+	}
+
+	// public rules are limited per client IP
+	if request("/public/file", "", "192.0.2.1:1234"); next.request == nil {
+		t.Error("expected public request to be allowed")
+	}
+	if w := request("/public/file", "greg", "192.0.2.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected public bucket to be shared by client IP, got %d", w.Code)
+	}
+	if request("/public/file", "", "192.0.2.2:1234"); next.request == nil {
+		t.Error("expected other client IP to have own bucket")
+	}
+
+	// report only mode forwards requests over the limit
+	handler.ReportOnly = true
+	request("/api/file", "greg", "192.0.2.1:1234")
+	if next.request == nil || next.request.Header.Get(WouldDenyHeader) != OutcomeRateLimited {
+		t.Error("expected rate limited request to be forwarded in report only mode")
+	}
+
+	// behind trusted proxies, the client IP is taken from X-Forwarded-For
+	handler, next = newTestHandler(t, `
+	permission lockout {
+		trusted_proxies 10.0.0.0/8
+	}
+	permission basic {
+		public
+		ro /public/ rate 1/h
+	}`)
+	for _, client := range []string{"192.0.2.1", "192.0.2.2"} {
+		next.request = nil
+		r := httptest.NewRequest("GET", "/public/file", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", client)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if next.request == nil {
+			t.Errorf("expected client %s behind a trusted proxy to have own bucket", client)
+		}
+	}
+}
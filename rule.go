@@ -9,14 +9,22 @@ type Rule struct {
 	Path                string
 	Methods             []string
 	MethodsAreBlacklist bool
+	// Name identifies rules of backends that decide requests themselves, such as policy rules.
+	Name string `json:",omitempty"`
+	// MFA requires the user to have passed a second factor, the rule does not allow the request otherwise.
+	MFA bool `json:",omitempty"`
+	// Rate limits the requests the rule allows per user, or per client IP for public permits.
+	Rate *RateLimit `json:",omitempty"`
 }
 
 const (
 	blacklistChar = "~"
+	// mfaFlag is added to the methods of a rule to require a second factor, eg. "rw,mfa".
+	mfaFlag = "mfa"
 )
 
 var (
-	errUnknownMethod = "failed to create Rule: method \"%s\" unknown."
+	errUnknownMethod = "unknown method \"%s\""
 )
 
 // MatchesMethod checks if the permission matches the given HTTP method.
@@ -50,11 +58,32 @@ func (r *Rule) MatchesParentPath(path string) bool {
 	return strings.HasPrefix(r.Path, path)
 }
 
+// MethodString returns the methods of the rule in the configuration format.
+func (r *Rule) MethodString() string {
+	if r.MFA {
+		return r.methodString() + "," + mfaFlag
+	}
+	return r.methodString()
+}
+
+func (r *Rule) methodString() string {
+	switch {
+	case len(r.Methods) == 0 && r.MethodsAreBlacklist:
+		return "any"
+	case len(r.Methods) == 0:
+		return "none"
+	case r.MethodsAreBlacklist:
+		return blacklistChar + strings.Join(r.Methods, ",")
+	}
+	return strings.Join(r.Methods, ",")
+}
+
 // NewRule creates a new permission rule with the given concatenated method string and path
 func NewRule(methods, path string) (*Rule, error) {
 	new := Rule{
 		Path: path,
 	}
+	methods, new.MFA = trimMFAFlag(methods)
 
 	if methods == blacklistChar || methods == "none" {
 		return &new, nil
@@ -83,3 +112,18 @@ func NewRule(methods, path string) (*Rule, error) {
 
 	return &new, nil
 }
+
+// trimMFAFlag removes the mfa flag from a concatenated method string and returns whether it was present.
+func trimMFAFlag(methods string) (string, bool) {
+	splitted := strings.Split(methods, ",")
+	remaining := splitted[:0]
+	for _, method := range splitted {
+		if strings.TrimSpace(method) != mfaFlag {
+			remaining = append(remaining, method)
+		}
+	}
+	if len(remaining) == len(splitted) {
+		return methods, false
+	}
+	return strings.Join(remaining, ","), true
+}
@@ -1,6 +1,7 @@
 package permission
 
 import (
+	"log"
 	"time"
 
 	"github.com/caddyserver/caddy"
@@ -21,6 +22,9 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return err
 	}
+	for _, warning := range handler.Warnings {
+		log.Printf("[WARNING] permission: %s", warning)
+	}
 
 	cfg := httpserver.GetConfig(c)
 	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
@@ -28,5 +32,30 @@ func setup(c *caddy.Controller) error {
 		return handler
 	})
 
+	// manage lifecycle of backends
+	key := cfg.Addr.String()
+	c.OnStartup(func() error {
+		predecessor := takePredecessor(key)
+		if predecessor != nil {
+			err := handler.TakeOver(predecessor)
+			if err != nil {
+				return err
+			}
+		}
+		return handler.Start()
+	})
+	c.OnRestart(func() error {
+		registerPredecessor(key, handler)
+		return nil
+	})
+	c.OnRestartFailed(func() error {
+		unregisterPredecessor(key, handler)
+		return nil
+	})
+	c.OnShutdown(func() error {
+		unregisterPredecessor(key, handler)
+		return handler.Close()
+	})
+
 	return nil
 }
@@ -0,0 +1,198 @@
+package permission
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+)
+
+// SimulationSource is the identity source of simulated users.
+const SimulationSource = "simulation"
+
+// Expectations of simulation cases
+const (
+	ExpectAllow = "allow"
+	ExpectDeny  = "deny"
+)
+
+// SimulationCase describes a request to simulate.
+type SimulationCase struct {
+	// User is the username of the request, anonymous if empty.
+	User    string
+	Groups  []string
+	Method  string
+	Path    string
+	Headers map[string]string
+	// Expect is ExpectAllow, ExpectDeny or empty, if there is no expectation.
+	Expect string
+}
+
+// SimulationResult describes the outcome of a simulated request.
+type SimulationResult struct {
+	Case     *SimulationCase
+	Decision *Decision
+	Error    error
+}
+
+// Allowed returns whether the simulated request was allowed.
+func (result *SimulationResult) Allowed() bool {
+	return result.Error == nil && result.Decision.Allowed
+}
+
+// Outcome returns ExpectAllow or ExpectDeny.
+func (result *SimulationResult) Outcome() string {
+	if result.Allowed() {
+		return ExpectAllow
+	}
+	return ExpectDeny
+}
+
+// Passed returns whether the outcome matches the expectation. Cases without an expectation always pass.
+func (result *SimulationResult) Passed() bool {
+	return result.Case.Expect == "" || result.Case.Expect == result.Outcome()
+}
+
+// NewSimulationRequest creates the request of a simulation case.
+func NewSimulationRequest(ctx context.Context, simulationCase *SimulationCase) (*http.Request, error) {
+	method := strings.ToUpper(simulationCase.Method)
+	if method == "" {
+		method = "GET"
+	}
+	path := simulationCase.Path
+	if path == "" {
+		path = "/"
+	}
+	requestURL, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &http.Request{
+		Method:     method,
+		URL:        requestURL,
+		RequestURI: path,
+		Host:       "localhost",
+		RemoteAddr: "127.0.0.1:0",
+		Header:     make(http.Header),
+	}
+	if method == "WEBSOCKET" {
+		r.Method = "GET"
+		r.Header.Set("Upgrade", "websocket")
+	}
+	for key, value := range simulationCase.Headers {
+		r.Header.Set(key, value)
+	}
+	return r.WithContext(ctx), nil
+}
+
+// simulationKey marks the context of simulated requests.
+type simulationKey struct{}
+
+// isSimulation returns whether the context belongs to a simulated request. Backends must not contact external services in simulations.
+func isSimulation(ctx context.Context) bool {
+	simulation, _ := ctx.Value(simulationKey{}).(bool)
+	return simulation
+}
+
+// NotSimulated returns the names of the backends whose permits are skipped in simulations, because they need external services.
+func (handler *Handler) NotSimulated() []string {
+	var names []string
+	for _, backend := range handler.Backends {
+		switch unwrapBackend(backend).(type) {
+		case *APIBackend, *SQLBackend:
+			names = append(names, backend.Name())
+		}
+	}
+	return names
+}
+
+// Simulate checks the permissions of a simulated request, without authenticating it.
+// Backends that need external services are not asked, see NotSimulated.
+func (handler *Handler) Simulate(ctx context.Context, simulationCase *SimulationCase) *SimulationResult {
+	result := &SimulationResult{
+		Case:     simulationCase,
+		Decision: &Decision{},
+	}
+	ctx = context.WithValue(ctx, simulationKey{}, true)
+
+	r, err := NewSimulationRequest(ctx, simulationCase)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+
+	var identity *Identity
+	if simulationCase.User != "" {
+		identity = NewIdentity(simulationCase.User, SimulationSource)
+		identity.Groups = simulationCase.Groups
+	}
+
+	result.Decision, result.Error = handler.Decide(ctx, r, identity)
+	return result
+}
+
+// ParseConfig creates a Handler from the permission directives of a Caddyfile.
+// If the Caddyfile has more than one site, site selects the site by its address.
+// The input may also consist of permission directives only.
+// The backends are not started, so persisted state is not loaded and no connections to databases or caches are opened.
+// The permits of backends that need them, or other external services, are skipped in simulations.
+func ParseConfig(filename string, input io.Reader, site string) (*Handler, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	// permission directives only
+	dispenser := caddyfile.NewDispenser(filename, bytes.NewReader(data))
+	if dispenser.Next() && dispenser.Val() == "permission" {
+		return NewHandler(&caddy.Controller{
+			Dispenser: caddyfile.NewDispenser(filename, bytes.NewReader(data)),
+		}, 0)
+	}
+
+	blocks, err := caddyfile.Parse(filename, bytes.NewReader(data), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []caddyfile.ServerBlock
+	for _, block := range blocks {
+		if len(block.Tokens["permission"]) == 0 {
+			continue
+		}
+		if site == "" || inList(site, block.Keys) {
+			found = append(found, block)
+		}
+	}
+	switch {
+	case len(found) == 0 && site == "":
+		return nil, fmt.Errorf("%s: no site with permission directives found", filename)
+	case len(found) == 0:
+		return nil, fmt.Errorf("%s: no site %s with permission directives found", filename, site)
+	case len(found) > 1:
+		return nil, fmt.Errorf("%s: more than one site with permission directives found, please select one", filename)
+	}
+
+	return NewHandler(&caddy.Controller{
+		Dispenser:       caddyfile.NewDispenserTokens(filename, found[0].Tokens["permission"]),
+		Key:             found[0].Keys[0],
+		ServerBlockKeys: found[0].Keys,
+	}, 0)
+}
+
+func inList(s string, list []string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package permission
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// CacheStore caches the users and permits of a backend.
+// Stores do not check expiry, this is left to the backend, but may drop expired entries at any time.
+type CacheStore interface {
+	// User returns the user cached with the given authentication key (eg. a cookie), or nil.
+	User(key string) (*User, error)
+	// SetUser caches the user with the given authentication key.
+	SetUser(key string, user *User) error
+	// Permit returns the cached permit of a user, or nil.
+	Permit(username string) (*Permit, error)
+	// SetPermit caches the permit of a user.
+	SetPermit(username string, permit *Permit) error
+	// Invalidate removes the permit and all cached authentications of a user, on all nodes sharing the store.
+	Invalidate(username string) error
+	// Clean removes entries that expired before now and returns the number of removed users and permits.
+	Clean(now int64) (evictedUsers, evictedPermits int)
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// MemoryStore is a CacheStore that keeps everything in memory of the local process.
+type MemoryStore struct {
+	Lock    sync.RWMutex
+	Users   map[string]*User
+	Permits map[string]*Permit
+}
+
+// NewMemoryStore creates a new, empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		Users:   make(map[string]*User),
+		Permits: make(map[string]*Permit),
+	}
+}
+
+// User returns the user cached with the given authentication key, or nil.
+func (store *MemoryStore) User(key string) (*User, error) {
+	store.Lock.RLock()
+	defer store.Lock.RUnlock()
+	return store.Users[key], nil
+}
+
+// SetUser caches the user with the given authentication key.
+func (store *MemoryStore) SetUser(key string, user *User) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+	store.Users[key] = user
+	return nil
+}
+
+// Permit returns the cached permit of a user, or nil.
+func (store *MemoryStore) Permit(username string) (*Permit, error) {
+	store.Lock.RLock()
+	defer store.Lock.RUnlock()
+	return store.Permits[username], nil
+}
+
+// SetPermit caches the permit of a user.
+func (store *MemoryStore) SetPermit(username string, permit *Permit) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+	store.Permits[username] = permit
+	return nil
+}
+
+// Invalidate removes the permit and all cached authentications of a user.
+func (store *MemoryStore) Invalidate(username string) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+	for key, user := range store.Users {
+		if user.Username == username {
+			delete(store.Users, key)
+		}
+	}
+	delete(store.Permits, username)
+	return nil
+}
+
+// Clean removes entries that expired before now.
+func (store *MemoryStore) Clean(now int64) (evictedUsers, evictedPermits int) {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	for key, user := range store.Users {
+		if user.ValidUntil < now {
+			delete(store.Users, key)
+			evictedUsers++
+		}
+	}
+	for username, permit := range store.Permits {
+		if permit.ValidUntil < now {
+			delete(store.Permits, username)
+			evictedPermits++
+		}
+	}
+	return evictedUsers, evictedPermits
+}
+
+// Close does nothing.
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+// merge copies all entries of other into the store.
+func (store *MemoryStore) merge(other *MemoryStore) {
+	other.Lock.RLock()
+	defer other.Lock.RUnlock()
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	for key, user := range other.Users {
+		store.Users[key] = user
+	}
+	for username, permit := range other.Permits {
+		store.Permits[username] = permit
+	}
+}
+
+// Cache store types
+const (
+	StoreMemory = "memory"
+	StoreRedis  = "redis"
+)
+
+// checkCacheStore returns an error if a CacheStore of the given type cannot be created with args. It does not connect to anything.
+func checkCacheStore(storeType string, args []string) error {
+	switch storeType {
+	case StoreMemory:
+		if len(args) != 0 {
+			return fmt.Errorf("%s store takes no arguments", StoreMemory)
+		}
+		return nil
+	case StoreRedis:
+		if len(args) != 1 {
+			return fmt.Errorf("%s store requires the URL of the server", StoreRedis)
+		}
+		_, err := redis.ParseURL(args[0])
+		return err
+	}
+	return fmt.Errorf("unknown store \"%s\"", storeType)
+}
+
+// NewCacheStore creates a CacheStore of the given type. Redis takes the URL of the server as argument, keys are prefixed with prefix.
+// Redis stores connect right away, so backends create them when they start, not while the configuration is parsed.
+func NewCacheStore(storeType string, args []string, prefix string) (CacheStore, error) {
+	err := checkCacheStore(storeType, args)
+	if err != nil {
+		return nil, err
+	}
+	if storeType == StoreRedis {
+		return NewRedisStore(args[0], prefix)
+	}
+	return NewMemoryStore(), nil
+}
@@ -0,0 +1,195 @@
+package permission
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// redisSubscribeTimeout is the time to wait for the subscription to the invalidation channel when the store is created.
+const redisSubscribeTimeout = 5 * time.Second
+
+// RedisStore is a CacheStore that shares users and permits between nodes through Redis.
+// Entries are additionally kept in memory of the local process. Invalidations are published to all nodes, which then drop their local copies.
+type RedisStore struct {
+	Client *redis.Client
+	Prefix string
+
+	local  *MemoryStore
+	pubsub *redis.PubSub
+}
+
+// NewRedisStore connects to the Redis server at url (eg. redis://localhost:6379/0) and subscribes to invalidations.
+// All keys are prefixed with prefix.
+func NewRedisStore(url, prefix string) (*RedisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &RedisStore{
+		Client: redis.NewClient(options),
+		Prefix: prefix,
+		local:  NewMemoryStore(),
+	}
+
+	// wait for the subscription, so that no invalidation is missed
+	store.pubsub = store.Client.Subscribe(store.channel())
+	_, err = store.pubsub.ReceiveTimeout(redisSubscribeTimeout)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to subscribe to invalidations: %s", err)
+	}
+	go store.receive(store.pubsub.Channel())
+
+	return store, nil
+}
+
+// receive drops local entries of invalidated users until the subscription is closed.
+func (store *RedisStore) receive(messages <-chan *redis.Message) {
+	for message := range messages {
+		store.local.Invalidate(message.Payload)
+	}
+}
+
+func (store *RedisStore) channel() string {
+	return store.Prefix + "invalidate"
+}
+
+// userKey returns the Redis key of an authentication key. Authentication keys may contain credentials, so they are hashed.
+func (store *RedisStore) userKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return store.Prefix + "user:" + hex.EncodeToString(hash[:])
+}
+
+func (store *RedisStore) sessionsKey(username string) string {
+	return store.Prefix + "sessions:" + username
+}
+
+func (store *RedisStore) permitKey(username string) string {
+	return store.Prefix + "permit:" + username
+}
+
+// get loads and unpacks a value, it returns false if the key does not exist.
+func (store *RedisStore) get(key string, value interface{}) (bool, error) {
+	data, err := store.Client.Get(key).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = json.Unmarshal(data, value)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// set packs and saves a value until validUntil.
+func (store *RedisStore) set(key string, value interface{}, validUntil int64) (time.Duration, error) {
+	ttl := time.Until(time.Unix(validUntil, 0))
+	if ttl <= 0 {
+		return 0, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+	return ttl, store.Client.Set(key, data, ttl).Err()
+}
+
+// User returns the user cached with the given authentication key, or nil.
+func (store *RedisStore) User(key string) (*User, error) {
+	user, _ := store.local.User(key)
+	if user != nil && user.ValidUntil > time.Now().Unix() {
+		return user, nil
+	}
+
+	user = &User{}
+	ok, err := store.get(store.userKey(key), user)
+	if !ok || err != nil {
+		return nil, err
+	}
+	store.local.SetUser(key, user)
+	return user, nil
+}
+
+// SetUser caches the user with the given authentication key.
+func (store *RedisStore) SetUser(key string, user *User) error {
+	store.local.SetUser(key, user)
+
+	userKey := store.userKey(key)
+	ttl, err := store.set(userKey, user, user.ValidUntil)
+	if ttl == 0 || err != nil {
+		return err
+	}
+
+	// remember the key, so that all authentications of the user can be invalidated
+	sessionsKey := store.sessionsKey(user.Username)
+	err = store.Client.SAdd(sessionsKey, userKey).Err()
+	if err != nil {
+		return err
+	}
+	if current := store.Client.TTL(sessionsKey).Val(); current < ttl {
+		return store.Client.Expire(sessionsKey, ttl).Err()
+	}
+	return nil
+}
+
+// Permit returns the cached permit of a user, or nil.
+func (store *RedisStore) Permit(username string) (*Permit, error) {
+	permit, _ := store.local.Permit(username)
+	if permit != nil && permit.ValidUntil >= time.Now().Unix() {
+		return permit, nil
+	}
+
+	permit = &Permit{}
+	ok, err := store.get(store.permitKey(username), permit)
+	if !ok || err != nil {
+		return nil, err
+	}
+	store.local.SetPermit(username, permit)
+	return permit, nil
+}
+
+// SetPermit caches the permit of a user.
+func (store *RedisStore) SetPermit(username string, permit *Permit) error {
+	store.local.SetPermit(username, permit)
+	_, err := store.set(store.permitKey(username), permit, permit.ValidUntil)
+	return err
+}
+
+// Invalidate removes the permit and all cached authentications of a user and tells all nodes to drop their local copies.
+func (store *RedisStore) Invalidate(username string) error {
+	store.local.Invalidate(username)
+
+	sessionsKey := store.sessionsKey(username)
+	keys, err := store.Client.SMembers(sessionsKey).Result()
+	if err != nil {
+		return err
+	}
+	keys = append(keys, sessionsKey, store.permitKey(username))
+	err = store.Client.Del(keys...).Err()
+	if err != nil {
+		return err
+	}
+	return store.Client.Publish(store.channel(), username).Err()
+}
+
+// Clean removes expired local entries, Redis expires its entries by itself.
+func (store *RedisStore) Clean(now int64) (evictedUsers, evictedPermits int) {
+	return store.local.Clean(now)
+}
+
+// Close closes the subscription and the connections to Redis.
+func (store *RedisStore) Close() error {
+	if store.pubsub != nil {
+		store.pubsub.Close()
+	}
+	return store.Client.Close()
+}
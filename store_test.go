@@ -0,0 +1,199 @@
+package permission
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/caddyserver/caddy"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now().Unix()
+	store.SetUser("PHPSESSID=1", &User{Username: "tom", ValidUntil: now + 60})
+	store.SetUser("PHPSESSID=2", &User{Username: "tom", ValidUntil: now - 60})
+	store.SetUser("PHPSESSID=3", &User{Username: "greg", ValidUntil: now + 60})
+	store.SetPermit("tom", NewPermit(60, now))
+
+	users, permits := store.Clean(now)
+	if users != 1 || permits != 0 {
+		t.Errorf("expected to evict 1 user and no permit, got %d and %d", users, permits)
+	}
+
+	store.Invalidate("tom")
+	if user, _ := store.User("PHPSESSID=1"); user != nil {
+		t.Error("user was not invalidated")
+	}
+	if permit, _ := store.Permit("tom"); permit != nil {
+		t.Error("permit was not invalidated")
+	}
+	if user, _ := store.User("PHPSESSID=3"); user == nil {
+		t.Error("other user was invalidated")
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// two nodes sharing the store
+	nodes := make([]*RedisStore, 2)
+	for i := range nodes {
+		nodes[i], err = NewRedisStore("redis://"+server.Addr(), "test:")
+		if err != nil {
+			t.Fatalf("failed to create store: %s", err)
+		}
+		defer nodes[i].Close()
+	}
+
+	now := time.Now().Unix()
+	user := &User{Username: "tom", ValidUntil: now + 60, Groups: []string{"staff"}}
+	permit := NewPermit(60, now)
+	addRule(permit, "rw", "/tmp/")
+	nodes[0].SetUser("auth=Basic dG9tOnB3", user)
+	nodes[0].SetPermit("tom", permit)
+
+	// credentials are not stored in plain text
+	for _, key := range server.Keys() {
+		if strings.Contains(key, "Basic") {
+			t.Errorf("authentication key stored in plain text: %s", key)
+		}
+	}
+
+	cached, err := nodes[1].User("auth=Basic dG9tOnB3")
+	if err != nil || cached == nil || cached.Username != "tom" || cached.Groups[0] != "staff" {
+		t.Fatalf("user was not shared: %+v %s", cached, err)
+	}
+	cachedPermit, err := nodes[1].Permit("tom")
+	if err != nil || cachedPermit == nil || len(cachedPermit.Rules) != 1 {
+		t.Fatalf("permit was not shared: %+v %s", cachedPermit, err)
+	}
+
+	// invalidation reaches the local copies of the other node
+	err = nodes[0].Invalidate("tom")
+	if err != nil {
+		t.Fatalf("failed to invalidate: %s", err)
+	}
+	for i := 0; ; i++ {
+		if local, _ := nodes[1].local.User("auth=Basic dG9tOnB3"); local == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("local copy was not invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cached, _ := nodes[1].User("auth=Basic dG9tOnB3"); cached != nil {
+		t.Error("user was not invalidated")
+	}
+	if cachedPermit, _ := nodes[1].Permit("tom"); cachedPermit != nil {
+		t.Error("permit was not invalidated")
+	}
+}
+
+func TestAPIBackendRedisStore(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var requests int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"Version": 2, "BasicAuth": true, "Username": "tom", "Permissions": {"/tmp/": "rw"}}`)
+	}))
+	defer api.Close()
+
+	config := fmt.Sprintf("user %s/caddyapi\npermit %s/caddyapi/{{username}}\nstore redis redis://%s", api.URL, api.URL, server.Addr())
+	nodes := []*APIBackend{newTestAPIBackend(t, config), newTestAPIBackend(t, config)}
+	for _, node := range nodes {
+		if node.Store != nil {
+			t.Fatal("expected redis store to be opened when the backend starts")
+		}
+		err = node.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+	}
+
+	r := httptest.NewRequest("GET", "/tmp/", nil)
+	r.SetBasicAuth("tom", "pw")
+	for _, node := range nodes {
+		identity, err := node.Authenticate(r.Context(), r)
+		if err != nil || identity == nil {
+			t.Fatalf("failed to authenticate: %s", err)
+		}
+		permit, err := node.Authorize(r.Context(), r, identity, PermitTypeUser)
+		if err != nil || permit == nil || len(permit.Rules) != 1 {
+			t.Fatalf("failed to authorize: %+v %s", permit, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected the second node to use the shared cache, got %d API requests", requests)
+	}
+
+	// persisting is only possible with the memory store
+	c := caddy.NewTestController("http", "permission api {\n"+config+"\npersist /tmp/cache s3cret\n}")
+	c.Next()
+	c.NextArg()
+	if _, err := NewAPIBackend(c, 0); err == nil {
+		t.Error("expected persist with redis store to fail")
+	}
+
+	// unreachable servers fail the start, not the configuration
+	node := newTestAPIBackend(t, fmt.Sprintf("user %s/caddyapi\nstore redis redis://127.0.0.1:1", api.URL))
+	if err := node.Start(); err == nil {
+		t.Error("expected start with unreachable redis server to fail")
+	}
+	node.Close()
+}
+
+func TestSQLBackendRedisStore(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c := caddy.NewTestController("http", "permission sql sqlite3 :memory: {\nstore redis redis://"+server.Addr()+"\n}")
+	c.Next()
+	c.NextArg()
+	backend, err := NewSQLBackend(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := backend.(*SQLBackend)
+	err = node.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	// permits are shared through redis
+	err = node.Store.SetPermit("greg", NewPermit(60, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Exists("caddy-permission:sql:permit:greg") {
+		t.Error("expected permit to be stored in redis")
+	}
+	err = node.Revoke(context.Background(), nil, "greg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists("caddy-permission:sql:permit:greg") {
+		t.Error("expected revoked permit to be removed from redis")
+	}
+}
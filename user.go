@@ -8,6 +8,11 @@ import (
 type User struct {
 	Username   string
 	ValidUntil int64
+
+	Groups      []string
+	DisplayName string
+	Email       string
+	Headers     map[string]string
 }
 
 // NewUser creates a new User with the given name and cache time.
@@ -17,3 +22,17 @@ func NewUser(username string, cacheTime int64) *User {
 		ValidUntil: time.Now().Unix() + cacheTime,
 	}
 }
+
+// Identity returns the Identity of the user.
+func (user *User) Identity(source string) *Identity {
+	identity := NewIdentity(user.Username, source)
+	identity.Groups = user.Groups
+	identity.Headers = user.Headers
+	if user.DisplayName != "" {
+		identity.SetAttribute(AttributeDisplayName, user.DisplayName)
+	}
+	if user.Email != "" {
+		identity.SetAttribute(AttributeEmail, user.Email)
+	}
+	return identity
+}